@@ -0,0 +1,282 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones of access windows, also without system tzdata.
+
+	"github.com/influxdata/influxql"
+)
+
+// ErrOutsideAccessWindow is returned if a query is sent outside of the
+// access windows of the profile.
+var ErrOutsideAccessWindow = errors.New("outside of access window")
+
+// maxScheduleSteps bounds the search for the next time matching a schedule,
+// which is plenty to find a match within several years.
+const maxScheduleSteps = 100000
+
+// schedule is a cron-like schedule of the minutes matching all of its
+// fields, in the order minute, hour, day of month, month and day of week.
+type schedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64 // bit sets of matching values.
+	anyDOM, anyDOW                bool
+}
+
+// scheduleFields are the ranges of the fields of a schedule.
+var scheduleFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseSchedule parses a schedule of five fields like in crontab. Each field
+// is "*" or a comma separated list of values and ranges like "1-5",
+// optionally with a step like "*/15". Day of week 0 and 7 are Sunday.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(scheduleFields) {
+		return nil, fmt.Errorf("schedule %q: want %d fields, got %d", spec, len(scheduleFields), len(fields))
+	}
+
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseScheduleField(f, scheduleFields[i].min, scheduleFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %v", spec, scheduleFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1 << 0
+	}
+	return &schedule{
+		spec:   spec,
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		// Like in cron, fields starting with "*", as "*/2", do not
+		// restrict the day.
+		anyDOM: strings.HasPrefix(fields[2], "*"),
+		anyDOW: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseScheduleField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the minute of t matches the schedule. Like in
+// cron, if both day of month and day of week are restricted, either has to
+// match.
+func (s *schedule) matches(t time.Time) bool {
+	return s.minute&(1<<uint(t.Minute())) != 0 &&
+		s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.month&(1<<uint(t.Month())) != 0 &&
+		s.matchesDay(t)
+}
+
+func (s *schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.anyDOM && !s.anyDOW {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first minute at or after t matching the schedule, and
+// false if there is none within several years.
+func (s *schedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for i := 0; i < maxScheduleSteps; i++ {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// windows is a set of schedules; a time is within the windows if it
+// matches any of them.
+type windows []*schedule
+
+func parseWindows(specs []string) (windows, error) {
+	var ws windows
+	for _, spec := range specs {
+		s, err := parseSchedule(spec)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, s)
+	}
+	return ws, nil
+}
+
+// check returns nil if t is within the windows, or if there are none, and
+// otherwise an error naming the windows and the next time within them.
+func (ws windows) check(t time.Time, what string) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	var (
+		next  time.Time
+		specs []string
+	)
+	for _, s := range ws {
+		if s.matches(t) {
+			return nil
+		}
+		if n, ok := s.next(t); ok && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+		specs = append(specs, fmt.Sprintf("%q", s.spec))
+	}
+	err := fmt.Errorf("%w: %s allowed at %s", ErrOutsideAccessWindow, what, strings.Join(specs, ", "))
+	if next.IsZero() {
+		return err
+	}
+	return &accessWindowError{err: err, next: next}
+}
+
+// accessWindowError is the error of queries outside of the access windows
+// which will open again.
+type accessWindowError struct {
+	err  error
+	next time.Time
+}
+
+func (e *accessWindowError) Error() string {
+	return fmt.Sprintf("%v (%s), next window opens at %s", e.err, e.next.Location(), e.next.Format(time.RFC3339))
+}
+
+func (e *accessWindowError) Unwrap() error { return e.err }
+
+// accessPolicy is the runtime representation of Access.
+type accessPolicy struct {
+	loc            *time.Location
+	windows        windows
+	bulkWindows    windows
+	bulkRange      time.Duration
+	bulkStatements int
+}
+
+func newAccessPolicy(cfg *Access) (*accessPolicy, error) {
+	a := &accessPolicy{loc: time.UTC}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		a.loc = loc
+	}
+	var err error
+	if a.windows, err = parseWindows(cfg.Windows); err != nil {
+		return nil, err
+	}
+	if b := cfg.Bulk; b != nil {
+		if a.bulkWindows, err = parseWindows(b.Windows); err != nil {
+			return nil, fmt.Errorf("bulk: %w", err)
+		}
+		a.bulkRange, a.bulkStatements = time.Duration(b.MinRange), b.MinStatements
+	}
+	return a, nil
+}
+
+// isBulk reports whether q is a bulk query, because of the number of its
+// statements or because its SELECT statements cover a long or unbounded
+// time range.
+func (a *accessPolicy) isBulk(q *influxql.Query, now time.Time) bool {
+	if a.bulkStatements > 0 && len(q.Statements) >= a.bulkStatements {
+		return true
+	}
+	if a.bulkRange <= 0 {
+		return false
+	}
+	tr := queryTimeRange(q, now)
+	if tr == nil {
+		return false
+	}
+	if tr.Start == nil {
+		return true
+	}
+	end := now
+	if tr.End != nil {
+		end = *tr.End
+	}
+	return end.Sub(*tr.Start) >= a.bulkRange
+}
+
+// checkAccess checks that q may be queried at now according to the access
+// windows of the profile.
+func (prof *profile) checkAccess(q *influxql.Query, now time.Time) error {
+	a := prof.access
+	if a == nil {
+		return nil
+	}
+	t := now.In(a.loc)
+	if err := a.windows.check(t, "queries are"); err != nil {
+		return err
+	}
+	if len(a.bulkWindows) > 0 && a.isBulk(q, now) {
+		return a.bulkWindows.check(t, "bulk queries are")
+	}
+	return nil
+}
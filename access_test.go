@@ -0,0 +1,166 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// Monday, 1 June 2020.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2020, 6, day, hour, minute, 30, 0, time.UTC)
+	}
+
+	testCases := map[string]struct {
+		spec    string
+		t       time.Time
+		matches bool
+		next    time.Time
+	}{
+		"always":       {"* * * * *", at(1, 12, 0), true, at(1, 12, 0).Truncate(time.Minute)},
+		"nightBefore":  {"* 0-6,19-23 * * *", at(1, 12, 5), false, at(1, 19, 0).Truncate(time.Minute)},
+		"nightInside":  {"* 0-6,19-23 * * *", at(1, 23, 59), true, at(1, 23, 59).Truncate(time.Minute)},
+		"weekend":      {"* * * * 0,6", at(1, 12, 0), false, at(6, 0, 0).Truncate(time.Minute)},
+		"sunday7":      {"* * * * 7", at(7, 8, 0), true, at(7, 8, 0).Truncate(time.Minute)},
+		"step":         {"*/15 * * * *", at(1, 12, 1), false, at(1, 12, 15).Truncate(time.Minute)},
+		"domOrDow":     {"0 0 15 * 1", at(2, 0, 0), false, at(8, 0, 0).Truncate(time.Minute)},
+		"nextMonth":    {"0 3 1 * *", at(1, 12, 0), false, time.Date(2020, 7, 1, 3, 0, 0, 0, time.UTC)},
+		"nextYear":     {"30 8 1 1 *", at(1, 12, 0), false, time.Date(2021, 1, 1, 8, 30, 0, 0, time.UTC)},
+		"leapDay":      {"0 0 29 2 *", at(1, 12, 0), false, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		"weekdayRange": {"* 8-17 * * 1-5", at(6, 10, 0), false, at(8, 8, 0).Truncate(time.Minute)},
+		"domStepDow":   {"* * */2 * 1-5", at(2, 12, 0), false, at(3, 0, 0).Truncate(time.Minute)},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s, err := parseSchedule(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.matches(tc.t); got != tc.matches {
+				t.Fatalf("got matches %v, want %v", got, tc.matches)
+			}
+			if got, ok := s.next(tc.t); !ok || !got.Equal(tc.next) {
+				t.Fatalf("got next %v, want %v", got, tc.next)
+			}
+		})
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	a, err := newAccessPolicy(&Access{
+		Timezone: "Europe/Rome",
+		Windows:  []string{"* * * * 1-6"},
+		Bulk:     &BulkAccess{MinRange: duration(30 * 24 * time.Hour), MinStatements: 3, Windows: []string{"* 0-6,19-23 * * *"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := &profile{access: a}
+
+	rome, _ := time.LoadLocation("Europe/Rome")
+	noon := time.Date(2020, 6, 1, 12, 0, 0, 0, rome)   // Monday
+	night := time.Date(2020, 6, 1, 20, 0, 0, 0, rome)  // Monday
+	sunday := time.Date(2020, 6, 7, 12, 0, 0, 0, rome) // outside all windows
+
+	testCases := map[string]struct {
+		query string
+		now   time.Time
+		next  time.Time // zero if allowed.
+	}{
+		"small":          {"SELECT * FROM m WHERE time > now() - 1d", noon, time.Time{}},
+		"bulkRange":      {"SELECT * FROM m WHERE time > now() - 60d", noon, time.Date(2020, 6, 1, 19, 0, 0, 0, rome)},
+		"bulkUnbounded":  {"SELECT * FROM m", noon, time.Date(2020, 6, 1, 19, 0, 0, 0, rome)},
+		"bulkStatements": {"SELECT * FROM m WHERE time > now() - 1h; SELECT * FROM m WHERE time > now() - 1h; SELECT * FROM m WHERE time > now() - 1h", noon, time.Date(2020, 6, 1, 19, 0, 0, 0, rome)},
+		"bulkAtNight":    {"SELECT * FROM m", night, time.Time{}},
+		"tagValues":      {`SHOW TAG VALUES FROM m WITH KEY = "station"`, noon, time.Time{}},
+		"sunday":         {"SELECT * FROM m WHERE time > now() - 1d", sunday, time.Date(2020, 6, 8, 0, 0, 0, 0, rome)},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := prof.checkAccess(mustParseQuery(t, tc.query), tc.now)
+			if tc.next.IsZero() {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			var aw *accessWindowError
+			if !errors.As(err, &aw) || !errors.Is(err, ErrOutsideAccessWindow) {
+				t.Fatalf("got error %v, want access window error", err)
+			}
+			if !aw.next.Equal(tc.next) {
+				t.Fatalf("got next window %v, want %v", aw.next, tc.next)
+			}
+		})
+	}
+}
+
+func TestAccessWindowRejected(t *testing.T) {
+	cfg := sourcesConfig("m")
+	// Only allow queries in two hours from now.
+	cfg.Access = &Access{Windows: []string{fmt.Sprintf("* %d * * *", (time.Now().UTC().Hour()+2)%24)}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM m"), nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if !strings.Contains(w.Body.String(), "next window opens at") {
+		t.Fatalf("got body %s", w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+}
+
+func TestAccessWindowRewritten(t *testing.T) {
+	// The authorizer rewrites queries to bulk queries.
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"decision": "rewrite", "query": "SELECT * FROM m"}`)
+	}))
+	defer authz.Close()
+
+	cfg := sourcesConfig("m")
+	cfg.Authorizer = &Authorizer{URL: authz.URL}
+	// Only allow bulk queries in two hours from now.
+	cfg.Access = &Access{Bulk: &BulkAccess{
+		MinRange: duration(30 * 24 * time.Hour),
+		Windows:  []string{fmt.Sprintf("* %d * * *", (time.Now().UTC().Hour()+2)%24)},
+	}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM m WHERE time > now() - 1h"), nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// adminHandler returns the handler of the admin listener, which must not be
+// exposed publicly. If the policy has admin users, all endpoints require
+// authentication.
+//
+// The admin listener serves the following endpoints:
+//
+//	/metrics     proxy metrics in the Prometheus text format
+//	/policy      version and profiles of the current policy
+//	/slo         state and burn rates of the service level objectives
+//	/shadow      comparisons of shadowed queries by fingerprint
+//	/rejections  clients with the most rejected queries
+//	/status/     status page showing the state of the proxy at a glance
+//	/debug/version  build and policy version and configuration checksum
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	metrics := metricsHandler()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		p.sloSummaries(now) // update burn rates
+		servedCertificates.update(now)
+		metrics.ServeHTTP(w, r)
+	})
+	mux.Handle("/policy", p.policyHandler())
+	mux.Handle("/slo", p.sloHandler())
+	mux.Handle("/shadow", p.shadowHandler())
+	mux.Handle("/rejections", p.rejectionsHandler())
+	mux.Handle("/status/", p.statusHandler())
+	mux.Handle("/debug/version", p.infoHandler())
+	return p.requireAdmin(mux)
+}
+
+// requireAdmin authenticates requests to h against the admin users of the
+// current policy, if any.
+func (p *Proxy) requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := p.policy().admin.authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="influxdb-proxy admin"`)
+			reportError(w, err, http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,356 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/influxql"
+)
+
+// newAliases returns the measurements by key of their public alias and the
+// aliases by key of their measurement, or nil maps if there are no aliases.
+func newAliases(aliases map[string]string, key func(string) string) (measurements, public map[string]string) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	measurements = make(map[string]string)
+	public = make(map[string]string)
+	for alias, name := range aliases {
+		measurements[key(alias)] = name
+		public[key(name)] = alias
+	}
+	return measurements, public
+}
+
+// measurementName returns the measurement queried by the source name used
+// by a client, and whether the name can be used by clients at all, which
+// is not the case for the measurements hidden behind an alias.
+func (prof *profile) measurementName(name string) (string, bool) {
+	if actual, ok := prof.aliases[prof.key(name)]; ok {
+		return actual, true
+	}
+	if _, ok := prof.publicNames[prof.key(name)]; ok {
+		return "", false
+	}
+	return name, true
+}
+
+// publicName returns the name of the measurement name exposed to clients.
+func (prof *profile) publicName(name string) string {
+	if alias, ok := prof.publicNames[prof.key(name)]; ok {
+		return alias
+	}
+	return name
+}
+
+// resolveAliases replaces the aliases among the sources of q, which must
+// have been validated, by the measurements they stand for.
+func (prof *profile) resolveAliases(q *influxql.Query) {
+	if prof.aliases == nil {
+		return
+	}
+	influxql.WalkFunc(q, func(n influxql.Node) {
+		if m, ok := n.(*influxql.Measurement); ok && m.Regex == nil {
+			m.Name, _ = prof.measurementName(m.Name)
+		}
+	})
+}
+
+// rewriteAliases resolves the aliases of q and updates the query of r
+// accordingly. If the profile has no aliases nothing is changed.
+func (prof *profile) rewriteAliases(r *http.Request, q *influxql.Query) {
+	if prof.aliases == nil {
+		return
+	}
+	prof.resolveAliases(q)
+	params := r.URL.Query()
+	params.Set("q", q.String())
+	r.URL.RawQuery = params.Encode()
+}
+
+// aliasRenamer returns a rewriteFunc renaming the series of aliased
+// measurements to their aliases, or nil if q, whose aliases must have been
+// resolved, queries no aliased measurement.
+func (prof *profile) aliasRenamer(q *influxql.Query) rewriteFunc {
+	aliased := false
+	influxql.WalkFunc(q, func(n influxql.Node) {
+		if m, ok := n.(*influxql.Measurement); ok && prof.publicName(m.Name) != m.Name {
+			aliased = true
+		}
+	})
+	if !aliased {
+		return nil
+	}
+	return func(resps []*influxResponse) error {
+		for _, resp := range resps {
+			for i := range resp.Results {
+				series := resp.Results[i].Series
+				for j := range series {
+					series[j].Name = prof.publicName(series[j].Name)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// Formats of the responses rewritten by an aliasWriter.
+const (
+	aliasPassThrough = iota // not rewritten, e.g. errors.
+	aliasJSON
+	aliasCSV
+	aliasMsgpack
+)
+
+// aliasWriter is a http.ResponseWriter renaming the series of aliased
+// measurements while the response is streamed. JSON responses are rewritten
+// value by value, that is chunk by chunk if chunked, CSV responses line by
+// line. MessagePack responses are buffered up to maxRewriteSize and
+// rewritten by finish.
+type aliasWriter struct {
+	w      http.ResponseWriter
+	prof   *profile
+	rename rewriteFunc
+	pretty bool // indent JSON responses, see the pretty parameter.
+
+	format int
+	status int
+	wrote  bool         // the header was written to w.
+	buf    bytes.Buffer // incomplete JSON value or CSV line, or MessagePack response.
+	err    error        // if set, the rest of the response is discarded.
+
+	// state of the JSON value at the end of buf
+	scanned  int // bytes of buf scanned.
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+// newAliasWriter returns an aliasWriter renaming the series of the response
+// of r with rename, which is written to w. As the response must be
+// inspected, r is modified so that the backend does not compress it.
+func newAliasWriter(w http.ResponseWriter, r *http.Request, prof *profile, rename rewriteFunc) *aliasWriter {
+	r.Header.Del("Accept-Encoding")
+	return &aliasWriter{
+		w:      w,
+		prof:   prof,
+		rename: rename,
+		pretty: r.URL.Query().Get("pretty") == "true",
+	}
+}
+
+func (aw *aliasWriter) Header() http.Header { return aw.w.Header() }
+
+func (aw *aliasWriter) WriteHeader(code int) {
+	if aw.status != 0 {
+		return
+	}
+	aw.status = code
+	if code != http.StatusOK {
+		aw.writeHeader()
+		return
+	}
+
+	ct := aw.w.Header().Get("Content-Type")
+	switch {
+	case aw.w.Header().Get("Content-Encoding") != "":
+		aw.err = ErrRewriteUnsupported
+	case strings.HasPrefix(ct, "application/json"):
+		aw.format = aliasJSON
+	case strings.HasPrefix(ct, "text/csv") || strings.HasPrefix(ct, "application/csv"):
+		aw.format = aliasCSV
+	case isMsgpack(ct):
+		aw.format = aliasMsgpack
+	default:
+		aw.err = ErrRewriteUnsupported
+	}
+	aw.w.Header().Del("Content-Length")
+}
+
+func (aw *aliasWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.err != nil {
+		return len(b), nil
+	}
+	if aw.format == aliasPassThrough {
+		return aw.w.Write(b)
+	}
+	if aw.buf.Len()+len(b) > maxRewriteSize {
+		aw.fail(ErrRewriteTooLarge)
+		return len(b), nil
+	}
+	aw.buf.Write(b)
+
+	switch aw.format {
+	case aliasJSON:
+		aw.writeJSON()
+	case aliasCSV:
+		aw.writeCSV()
+	}
+	return len(b), nil
+}
+
+// Flush implements http.Flusher so that streaming responses are not delayed.
+func (aw *aliasWriter) Flush() {
+	if !aw.wrote {
+		return
+	}
+	if f, ok := aw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeJSON renames and writes the complete JSON values in the buffer. The
+// whitespace between values is dropped, as each value is terminated by a
+// newline when encoded again.
+func (aw *aliasWriter) writeJSON() {
+	data := aw.buf.Bytes()
+	start := 0
+	for i := aw.scanned; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case aw.inString:
+			if aw.escaped {
+				aw.escaped = false
+			} else if c == '\\' {
+				aw.escaped = true
+			} else if c == '"' {
+				aw.inString = false
+			}
+		case c == '"':
+			aw.inString = true
+		case c == '{' || c == '[':
+			aw.depth++
+		case c == '}' || c == ']':
+			aw.depth--
+			if aw.depth > 0 {
+				continue
+			}
+			resps, err := decodeResponses(data[start : i+1])
+			if err == nil {
+				err = aw.rename(resps)
+			}
+			var out []byte
+			if err == nil {
+				out, err = encodeResponses(resps, aw.pretty)
+			}
+			if err != nil {
+				aw.fail(err)
+				return
+			}
+			aw.output(out)
+			start = i + 1
+		case aw.depth == 0:
+			// Whitespace between values.
+			start = i + 1
+		}
+	}
+	aw.buf.Next(start)
+	aw.scanned = aw.buf.Len()
+}
+
+// writeCSV renames and writes the complete lines in the buffer. The first
+// column of the CSV responses of InfluxDB is the name of the series.
+func (aw *aliasWriter) writeCSV() {
+	for {
+		i := bytes.IndexByte(aw.buf.Bytes(), '\n')
+		if i < 0 {
+			return
+		}
+		aw.output(aw.renameCSV(aw.buf.Next(i + 1)))
+	}
+}
+
+func (aw *aliasWriter) renameCSV(line []byte) []byte {
+	record, err := csv.NewReader(bytes.NewReader(line)).Read()
+	if err != nil || len(record) == 0 {
+		return line
+	}
+	name := aw.prof.publicName(record[0])
+	if name == record[0] {
+		return line
+	}
+	record[0] = name
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(record)
+	cw.Flush()
+	return buf.Bytes()
+}
+
+// output writes b to the underlying ResponseWriter, preceded by the header
+// on the first call.
+func (aw *aliasWriter) output(b []byte) {
+	aw.writeHeader()
+	aw.w.Write(b)
+}
+
+func (aw *aliasWriter) writeHeader() {
+	if !aw.wrote {
+		aw.wrote = true
+		aw.w.WriteHeader(aw.status)
+	}
+}
+
+// fail discards the rest of the response because of err.
+func (aw *aliasWriter) fail(err error) {
+	aw.err = err
+	aw.buf.Reset()
+}
+
+// finish writes what remains of the response to the underlying
+// ResponseWriter. If the response could not be rewritten, an error is sent
+// instead, unless parts of the response were already written.
+func (aw *aliasWriter) finish() {
+	if aw.status == 0 {
+		return
+	}
+	if aw.err == nil {
+		switch aw.format {
+		case aliasJSON:
+			// An incomplete value, e.g. if the backend failed.
+			if aw.buf.Len() > 0 {
+				aw.fail(io.ErrUnexpectedEOF)
+			}
+		case aliasCSV:
+			if aw.buf.Len() > 0 {
+				aw.output(aw.renameCSV(aw.buf.Bytes()))
+			}
+		case aliasMsgpack:
+			resps, err := decodeMsgpackResponses(aw.buf.Bytes())
+			if err == nil {
+				err = aw.rename(resps)
+			}
+			var body []byte
+			if err == nil {
+				body, err = encodeMsgpackResponses(resps)
+			}
+			if err != nil {
+				aw.fail(err)
+				break
+			}
+			aw.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			aw.output(body)
+		}
+	}
+
+	if aw.err == nil {
+		aw.writeHeader()
+		return
+	}
+	if aw.wrote {
+		proxyLog.Warn("response cut off while renaming aliases", "profile", aw.prof.name, "err", aw.err)
+		return
+	}
+	reportError(aw.w, aw.err, http.StatusNotAcceptable)
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAliases(t *testing.T) {
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.Query().Get("q")
+		w.Header().Set("Content-Type", "application/json")
+		name := "lt_st01_t_air_h"
+		if strings.Contains(forwarded, "m1") {
+			name = "m1"
+		}
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":%q,"columns":["time","v"],"values":[[0,1]]}]}]}`, name)
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("lt_st01_t_air_h", "m1")
+	cfg.Aliases = map[string]string{"airtemp_hourly": "lt_st01_t_air_h"}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		query     string
+		status    int
+		forwarded string
+		series    string
+	}{
+		"alias":    {"SELECT * FROM airtemp_hourly", http.StatusOK, "SELECT * FROM lt_st01_t_air_h", "airtemp_hourly"},
+		"subquery": {"SELECT mean(v) FROM (SELECT * FROM airtemp_hourly)", http.StatusOK, "SELECT mean(v) FROM (SELECT * FROM lt_st01_t_air_h)", "airtemp_hourly"},
+		"tagValues": {
+			`SHOW TAG VALUES FROM airtemp_hourly WITH KEY = "station"`, http.StatusOK,
+			`SHOW TAG VALUES FROM lt_st01_t_air_h WITH KEY = station`, "airtemp_hourly",
+		},
+		"unaliased": {"SELECT * FROM m1", http.StatusOK, "SELECT * FROM m1", "m1"},
+		"hidden":    {"SELECT * FROM lt_st01_t_air_h", http.StatusNotAcceptable, "", ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			forwarded = ""
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape(tc.query), nil))
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if forwarded != tc.forwarded {
+				t.Fatalf("got forwarded query %q, want %q", forwarded, tc.forwarded)
+			}
+			if tc.series != "" && !strings.Contains(w.Body.String(), `"name":"`+tc.series+`"`) {
+				t.Fatalf("got %s, want series %q", w.Body, tc.series)
+			}
+		})
+	}
+
+	// Responses of queries without aliases are passed through as they are.
+	r := httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM m1"), nil)
+	r.Header.Set("Accept", "application/csv")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for CSV of unaliased measurement: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/catalog", nil))
+	if b := w.Body.String(); !strings.Contains(b, `"name":"airtemp_hourly"`) || strings.Contains(b, "lt_st01_t_air_h") {
+		t.Fatalf("got catalog %s", b)
+	}
+}
+
+func TestAliasWriter(t *testing.T) {
+	const hidden = "lt_st01_t_air_h"
+	series := func(i int) *influxResponse {
+		return &influxResponse{Results: []influxResult{{Series: []influxSeries{{Name: hidden, Columns: []string{"time", "v"}, Values: [][]interface{}{{int64(i), int64(1)}}}}}}}
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Accept") {
+		case "application/csv":
+			w.Header().Set("Content-Type", "text/csv")
+			fmt.Fprintf(w, "name,tags,time,v\n%s,,0,1\n\nname,tags,time,v\n%s,,1,1", hidden, hidden)
+		case msgpackContentType:
+			w.Header().Set("Content-Type", msgpackContentType)
+			b, err := encodeMsgpackResponses([]*influxResponse{series(0)})
+			if err != nil {
+				t.Error(err)
+			}
+			w.Write(b)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("chunked") == "true" {
+				// Chunks are written in pieces, split within a string.
+				for i := 0; i < 2; i++ {
+					b, _ := encodeResponses([]*influxResponse{series(i)}, false)
+					w.Write(b[:20])
+					w.(http.Flusher).Flush()
+					w.Write(b[20:])
+					w.(http.Flusher).Flush()
+				}
+				return
+			}
+			b, _ := encodeResponses([]*influxResponse{series(0)}, r.URL.Query().Get("pretty") == "true")
+			w.Write(b)
+		}
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig(hidden)
+	cfg.Aliases = map[string]string{"airtemp_hourly": hidden}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := func(pretty bool, n int) string {
+		var resps []*influxResponse
+		for i := 0; i < n; i++ {
+			resp := series(i)
+			resp.Results[0].Series[0].Name = "airtemp_hourly"
+			resps = append(resps, resp)
+		}
+		b, _ := encodeResponses(resps, pretty)
+		return string(b)
+	}
+	testCases := map[string]struct {
+		accept string
+		params string
+		want   string
+	}{
+		"json":    {"", "", renamed(false, 1)},
+		"pretty":  {"", "&pretty=true", renamed(true, 1)},
+		"chunked": {"", "&chunked=true", renamed(false, 2)},
+		"csv":     {"application/csv", "", "name,tags,time,v\nairtemp_hourly,,0,1\n\nname,tags,time,v\nairtemp_hourly,,1,1\n"},
+		"msgpack": {msgpackContentType, "", ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM airtemp_hourly")+tc.params, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			if tc.accept == msgpackContentType {
+				resps, err := decodeMsgpackResponses(w.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := resps[0].Results[0].Series[0].Name; got != "airtemp_hourly" {
+					t.Fatalf("got series %q, want airtemp_hourly", got)
+				}
+				return
+			}
+			if got := w.Body.String(); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAliasStreaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"results":[{"statement_id":0,"series":[{"name":"m"}]}]}`+"\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, `{"results":[{"statement_id":0,"series":[{"name":"m"}]}]}`+"\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	cfg := sourcesConfig("m")
+	cfg.Aliases = map[string]string{"alias": "m"}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.setFlushInterval(10 * time.Millisecond)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/query?chunked=true&q=" + url.QueryEscape("SELECT * FROM alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first chunk must arrive renamed while the backend is still
+	// blocked.
+	line := make(chan string)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if !strings.Contains(s, `"name":"alias"`) {
+			t.Fatalf("got unexpected first chunk %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first chunk was not streamed to the client")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// apiDescription is the machine-readable description of the public surface
+// of the proxy, as seen by a client of a profile.
+type apiDescription struct {
+	Version      string           `json:"version"`
+	Profile      string           `json:"profile"`
+	Auth         string           `json:"auth"`
+	Endpoints    []apiEndpoint    `json:"endpoints"`
+	Databases    []string         `json:"databases,omitempty"`
+	Measurements []apiMeasurement `json:"measurements"`
+}
+
+type apiEndpoint struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+	Parameters  []string `json:"parameters,omitempty"`
+}
+
+// apiMeasurement describes an allowed measurement. GroupBy is a pointer, as
+// an empty list, allowing to group by time only, differs from no list.
+type apiMeasurement struct {
+	Name    string    `json:"name"`
+	Fields  []string  `json:"fields,omitempty"`
+	GroupBy *[]string `json:"group_by,omitempty"`
+}
+
+// describeAPI returns the description of the API of the profile.
+func (p *Proxy) describeAPI(prof *profile) *apiDescription {
+	api := &apiDescription{
+		Version:      version,
+		Profile:      prof.name,
+		Auth:         "none",
+		Databases:    []string{},
+		Measurements: []apiMeasurement{},
+	}
+	if prof.users != nil {
+		api.Auth = "basic"
+	}
+
+	endpoint := func(path, description string, methods ...string) {
+		var params []string
+		for k := range knownParams[path] {
+			params = append(params, k)
+		}
+		sort.Strings(params)
+		api.Endpoints = append(api.Endpoints, apiEndpoint{
+			Path:        prof.prefix + path,
+			Methods:     methods,
+			Description: description,
+			Parameters:  params,
+		})
+	}
+	endpoint("/ping", "Checks the status of the backend.", "GET", "HEAD")
+	endpoint("/query", "Runs InfluxQL queries on the allowed measurements.", "GET", "POST")
+	if p.exports != nil {
+		endpoint("/export", "Starts an export job of a large time range.", "POST")
+	}
+	endpoint("/api.json", "Describes the API.", "GET")
+	endpoint("/catalog", "Lists the allowed measurements with their metadata.", "GET")
+
+	for db := range prof.databases {
+		api.Databases = append(api.Databases, db)
+	}
+	sort.Strings(api.Databases)
+	for _, m := range prof.measurements {
+		am := apiMeasurement{Name: prof.publicName(m.Name), Fields: m.Fields}
+		if m.GroupBy != nil {
+			groupBy := m.GroupBy
+			am.GroupBy = &groupBy
+		}
+		api.Measurements = append(api.Measurements, am)
+	}
+	sort.Slice(api.Measurements, func(i, j int) bool {
+		return api.Measurements[i].Name < api.Measurements[j].Name
+	})
+	return api
+}
+
+// serveAPI serves the description of the API of the profile to its
+// authenticated clients.
+func (p *Proxy) serveAPI(w http.ResponseWriter, r *http.Request, prof *profile) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		reportError(w, ErrMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := prof.authenticate(r); err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="InfluxDB"`)
+		reportError(w, err, http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.describeAPI(prof))
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAPIDescription(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := sourcesConfig("m1")
+	cfg.Profiles = []Profile{{
+		Name:         "partner",
+		Prefix:       "/partner",
+		Measurements: []Measurement{{Name: "m3", Fields: []string{"v"}, GroupBy: []string{"station"}}, {Name: "m2"}, {Name: "m4", GroupBy: []string{}}},
+		Databases:    map[string]string{"public": "lt_data"},
+		Auth:         &Auth{Users: map[string]string{"alice": string(hash)}},
+	}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/partner/api.json", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	r := httptest.NewRequest("GET", "/partner/api.json", nil)
+	r.SetBasicAuth("alice", "secret")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `{"name":"m4","group_by":[]}`) {
+		t.Fatalf("got body %s, want empty group_by of m4", w.Body)
+	}
+	var api apiDescription
+	if err := json.NewDecoder(w.Body).Decode(&api); err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Profile != "partner" || api.Auth != "basic" {
+		t.Fatalf("got profile %q with auth %q, want partner with basic", api.Profile, api.Auth)
+	}
+	var paths []string
+	for _, e := range api.Endpoints {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"/partner/ping", "/partner/query", "/partner/api.json", "/partner/catalog"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got endpoints %v, want %v", paths, want)
+	}
+	if want := []string{"public"}; !reflect.DeepEqual(api.Databases, want) {
+		t.Fatalf("got databases %v, want %v", api.Databases, want)
+	}
+	want := []apiMeasurement{{Name: "m2"}, {Name: "m3", Fields: []string{"v"}, GroupBy: &[]string{"station"}}, {Name: "m4", GroupBy: &[]string{}}}
+	if !reflect.DeepEqual(api.Measurements, want) {
+		t.Fatalf("got measurements %+v, want %+v", api.Measurements, want)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// Authorizer errors.
+var (
+	ErrAuthorizerDenied = errors.New("query denied by policy")
+	ErrAuthorizerFailed = errors.New("authorization service unavailable")
+)
+
+// Decisions of an external authorizer.
+const (
+	DecisionAllow   = "allow"
+	DecisionDeny    = "deny"
+	DecisionRewrite = "rewrite" // allow the query given in the decision instead.
+)
+
+// defaultAuthorizerTimeout is the timeout of decision requests if
+// Authorizer.Timeout is not set.
+const defaultAuthorizerTimeout = 5 * time.Second
+
+// maxDecisionBody is the maximum size of a decision response.
+const maxDecisionBody = 1 << 20
+
+// authorizer delegates decisions about queries to an external service.
+type authorizer struct {
+	Authorizer
+	client *http.Client
+}
+
+func newAuthorizer(cfg Authorizer) *authorizer {
+	timeout := time.Duration(cfg.Timeout)
+	if timeout == 0 {
+		timeout = defaultAuthorizerTimeout
+	}
+	return &authorizer{Authorizer: cfg, client: &http.Client{Timeout: timeout}}
+}
+
+// decisionRequest is posted as JSON to the authorizer.
+type decisionRequest struct {
+	Profile      string     `json:"profile"`
+	Client       string     `json:"client"`
+	User         string     `json:"user,omitempty"`
+	RemoteAddr   string     `json:"remote_addr"`
+	Database     string     `json:"db,omitempty"`
+	Query        string     `json:"query"`
+	Statements   []string   `json:"statements"`
+	Measurements []string   `json:"measurements"`
+	TimeRange    *timeRange `json:"time_range,omitempty"`
+}
+
+// timeRange is the time range queried, either end may be unbounded.
+type timeRange struct {
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// decision is the response of the authorizer.
+type decision struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+	Query    string `json:"query,omitempty"` // replacement of rewrite decisions.
+}
+
+// decide posts req to the authorizer and returns its decision.
+func (a *authorizer) decide(ctx context.Context, req *decisionRequest) (*decision, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", a.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDecisionBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorizer responded with %s", resp.Status)
+	}
+
+	d := new(decision)
+	if err := json.Unmarshal(body, d); err != nil {
+		return nil, err
+	}
+	switch d.Decision {
+	case DecisionAllow, DecisionDeny:
+	case DecisionRewrite:
+		if d.Query == "" {
+			return nil, errors.New("rewrite decision without query")
+		}
+	default:
+		return nil, fmt.Errorf("unknown decision %q", d.Decision)
+	}
+	return d, nil
+}
+
+// authorize asks the authorizer of the profile, if any, about query of
+// client and returns the query to run, which is the one of a rewrite
+// decision if the authorizer rewrote it. Rewritten queries must pass the
+// checks of the profile as well, except for the access windows, which the
+// caller checks on the returned query.
+func (prof *profile) authorize(r *http.Request, client, user string, query *influxql.Query) (*influxql.Query, error) {
+	a := prof.authorizer
+	if a == nil {
+		return query, nil
+	}
+
+	req := &decisionRequest{
+		Profile:      prof.name,
+		Client:       client,
+		User:         user,
+		RemoteAddr:   r.RemoteAddr,
+		Database:     r.URL.Query().Get("db"),
+		Query:        query.String(),
+		Statements:   []string{},
+		Measurements: queryMeasurements(query),
+		TimeRange:    queryTimeRange(query, time.Now()),
+	}
+	for _, stmt := range query.Statements {
+		req.Statements = append(req.Statements, stmt.String())
+	}
+	d, err := a.decide(r.Context(), req)
+	if err != nil {
+		if a.FailOpen {
+			proxyLog.Warn("authorizer failed, allowing query", "profile", prof.name, "err", err)
+			return query, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrAuthorizerFailed, err)
+	}
+
+	switch d.Decision {
+	case DecisionDeny:
+		if d.Reason != "" {
+			return nil, fmt.Errorf("%w: %s", ErrAuthorizerDenied, d.Reason)
+		}
+		return nil, ErrAuthorizerDenied
+	case DecisionRewrite:
+		if err := prof.checkTombstones(d.Query); err != nil {
+			return nil, err
+		}
+		rewritten, err := validate(d.Query, prof.allows)
+		if err == nil {
+			prof.resolveAliases(rewritten)
+			err = prof.checkTags(rewritten)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: rewritten query: %v", ErrAuthorizerDenied, err)
+		}
+		params := r.URL.Query()
+		params.Set("q", rewritten.String())
+		r.URL.RawQuery = params.Encode()
+		return rewritten, nil
+	}
+	return query, nil
+}
+
+// queryTimeRange returns the time range covered by the SELECT statements of
+// q, or nil if q has none.
+func queryTimeRange(q *influxql.Query, now time.Time) *timeRange {
+	var (
+		tr                 *timeRange
+		openStart, openEnd bool
+	)
+	for _, stmt := range q.Statements {
+		s, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			continue
+		}
+		_, r, err := influxql.ConditionExpr(s.Condition, &influxql.NowValuer{Now: now})
+		if err != nil {
+			continue
+		}
+		if tr == nil {
+			tr = new(timeRange)
+		}
+		if start := r.Min; start.IsZero() {
+			openStart = true
+		} else if tr.Start == nil || start.Before(*tr.Start) {
+			tr.Start = &start
+		}
+		if end := r.Max; end.IsZero() {
+			openEnd = true
+		} else if tr.End == nil || end.After(*tr.End) {
+			tr.End = &end
+		}
+	}
+	if tr != nil && openStart {
+		tr.Start = nil
+	}
+	if tr != nil && openEnd {
+		tr.End = nil
+	}
+	return tr
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeRange(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	date := func(s string) *time.Time {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &d
+	}
+
+	testCases := map[string]struct {
+		in   string
+		want *timeRange
+	}{
+		"none":      {"SHOW TAG VALUES FROM m1 WITH KEY = \"station\"", nil},
+		"unbounded": {"SELECT * FROM m1", &timeRange{}},
+		"relative":  {"SELECT * FROM m1 WHERE time > now() - 1h", &timeRange{Start: date("2020-06-01T11:00:00.000000001Z")}},
+		"absolute": {
+			"SELECT * FROM m1 WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-02-01T00:00:00Z'",
+			&timeRange{Start: date("2020-01-01T00:00:00Z"), End: date("2020-01-31T23:59:59.999999999Z")},
+		},
+		"union": {
+			"SELECT * FROM m1 WHERE time >= '2020-01-01T00:00:00Z' AND time <= '2020-01-02T00:00:00Z'; " +
+				"SELECT * FROM m2 WHERE time >= '2019-01-01T00:00:00Z' AND time <= '2019-01-02T00:00:00Z'",
+			&timeRange{Start: date("2019-01-01T00:00:00Z"), End: date("2020-01-02T00:00:00Z")},
+		},
+		"oneOpen": {
+			"SELECT * FROM m1 WHERE time >= '2020-01-01T00:00:00Z' AND time <= '2020-01-02T00:00:00Z'; SELECT * FROM m2",
+			&timeRange{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := queryTimeRange(mustParseQuery(t, tc.in), now); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	var got decisionRequest
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = decisionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		switch {
+		case strings.Contains(got.Query, "denied"):
+			io.WriteString(w, `{"decision": "deny", "reason": "embargoed"}`)
+		case strings.Contains(got.Query, "rewritten"):
+			io.WriteString(w, `{"decision": "rewrite", "query": "SELECT * FROM allowed WHERE station = 's1'"}`)
+		case strings.Contains(got.Query, "forbidden"):
+			io.WriteString(w, `{"decision": "rewrite", "query": "SELECT * FROM secret"}`)
+		case strings.Contains(got.Query, "renamed"):
+			io.WriteString(w, `{"decision": "rewrite", "query": "SELECT * FROM air_t"}`)
+		case strings.Contains(got.Query, "broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			io.WriteString(w, `{"decision": "allow"}`)
+		}
+	}))
+	defer authz.Close()
+
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.Query().Get("q")
+		io.WriteString(w, `{"results":[]}`)
+	}))
+	defer backend.Close()
+
+	sources := []Measurement{{Name: "allowed"}, {Name: "denied"}, {Name: "rewritten"}, {Name: "forbidden"}, {Name: "broken"}, {Name: "renamed"}}
+	cfg := sourcesConfig()
+	cfg.Profiles = []Profile{
+		{Name: "closed", Prefix: "/closed", Measurements: sources, Authorizer: &Authorizer{URL: authz.URL}, Tombstones: map[string]Tombstone{"air_t": {}}},
+		{Name: "open", Prefix: "/open", Measurements: sources, Authorizer: &Authorizer{URL: authz.URL, FailOpen: true}},
+	}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		path      string
+		query     string
+		status    int
+		forwarded string
+	}{
+		"allow":          {"/closed", "SELECT * FROM allowed", http.StatusOK, "SELECT * FROM allowed"},
+		"deny":           {"/closed", "SELECT * FROM denied", http.StatusNotAcceptable, ""},
+		"rewrite":        {"/closed", "SELECT * FROM rewritten", http.StatusOK, "SELECT * FROM allowed WHERE station = 's1'"},
+		"rewriteInvalid": {"/closed", "SELECT * FROM forbidden", http.StatusNotAcceptable, ""},
+		"rewriteTomb":    {"/closed", "SELECT * FROM renamed", http.StatusGone, ""},
+		"failClosed":     {"/closed", "SELECT * FROM broken", http.StatusServiceUnavailable, ""},
+		"failOpen":       {"/open", "SELECT * FROM broken", http.StatusOK, "SELECT * FROM broken"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			forwarded = ""
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", tc.path+"/query?db=mydb&q="+url.QueryEscape(tc.query), nil))
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if forwarded != tc.forwarded {
+				t.Fatalf("got forwarded query %q, want %q", forwarded, tc.forwarded)
+			}
+		})
+	}
+
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/open/query?db=mydb&q=SELECT+*+FROM+broken", nil))
+	if got.Profile != "open" || got.Client != "ip:192.0.2.1" || got.Database != "mydb" || !reflect.DeepEqual(got.Measurements, []string{"broken"}) {
+		t.Fatalf("got decision request %+v", got)
+	}
+}
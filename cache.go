@@ -0,0 +1,379 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// maxCacheEntrySize is the maximum size of a response body which will be
+// stored in the cache. Larger responses are proxied but not cached.
+const maxCacheEntrySize = 10 << 20
+
+// defaultMemoryCacheSize is the byte budget of the memory cache if none is
+// given.
+const defaultMemoryCacheSize = 256 << 20
+
+// Cache is the interface implemented by the storage backends used for caching
+// query responses.
+type Cache interface {
+	// Get returns the value stored for key. The boolean reports whether the
+	// key was found and is not expired.
+	Get(key string) ([]byte, bool, error)
+
+	// Set stores value for key, which expires after ttl.
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// NewCache returns the cache backend described by spec, which is one of:
+//
+//	memory[:<megabytes>]    in-memory cache of at most 256 or the given
+//	                        megabytes, lost on restart
+//	dir:/path/to/dir        on-disk cache, survives restarts
+//	redis://host:port[/db]  Redis cache, survives restarts and can be shared
+//	                        between multiple proxies
+func NewCache(spec string) (Cache, error) {
+	switch {
+	case spec == "memory":
+		return newMemoryCache(), nil
+	case strings.HasPrefix(spec, "memory:"):
+		mb, err := strconv.Atoi(strings.TrimPrefix(spec, "memory:"))
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("invalid memory cache size in %q", spec)
+		}
+		c := newMemoryCache()
+		c.maxBytes = mb << 20
+		return c, nil
+	case strings.HasPrefix(spec, "dir:"):
+		return newDiskCache(strings.TrimPrefix(spec, "dir:"))
+	case strings.HasPrefix(spec, "redis://"):
+		return newRedisCache(spec)
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", spec)
+}
+
+// memoryCache is a Cache storing entries in memory. Expired entries are
+// removed lazily on access and periodically on writes. If the values exceed
+// the byte budget, the least recently used entries are evicted.
+type memoryCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element // of *memoryEntry, in lru.
+	lru      *list.List               // most recently used first.
+	writes   int
+	size     int // bytes of all values.
+	maxBytes int
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		maxBytes: defaultMemoryCacheSize,
+	}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*memoryEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false, nil
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true, nil
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*memoryEntry)
+	c.size -= len(e.value)
+	delete(c.entries, e.key)
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if len(value) > c.maxBytes {
+		return nil
+	}
+	now := time.Now()
+	c.writes++
+	if c.writes%1000 == 0 {
+		for _, el := range c.entries {
+			if now.After(el.Value.(*memoryEntry).expires) {
+				c.remove(el)
+			}
+		}
+	}
+	for c.size+len(value) > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, value: value, expires: now.Add(ttl)})
+	c.size += len(value)
+	return nil
+}
+
+// diskCache is a Cache storing each entry as a file inside a directory. Every
+// file starts with the expiration time as 8 byte big endian Unix nanoseconds
+// followed by the value.
+type diskCache struct {
+	dir string
+}
+
+func newDiskCache(dir string) (*diskCache, error) {
+	if dir == "" {
+		return nil, errors.New("no directory given for disk cache")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &diskCache{dir: dir}, nil
+}
+
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *diskCache) Get(key string) ([]byte, bool, error) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(b) < 8 {
+		return nil, false, nil
+	}
+
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	if time.Now().After(expires) {
+		os.Remove(c.path(key))
+		return nil, false, nil
+	}
+	return b[8:], true, nil
+}
+
+func (c *diskCache) Set(key string, value []byte, ttl time.Duration) error {
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	var hdr [8]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(time.Now().Add(ttl).UnixNano()))
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Rename is atomic, so concurrent readers never see a partial entry.
+	return os.Rename(f.Name(), c.path(key))
+}
+
+// queryCacheTTL returns the time to live of the response of the given query
+// at time now, according to the cache policies of the queried measurements,
+// which default to defaultTTL. If the query touches multiple measurements the
+// most restrictive policy wins. A zero duration means the response must not
+// be cached.
+func (prof *profile) queryCacheTTL(q *influxql.Query, defaultTTL time.Duration, now time.Time) time.Duration {
+	ttl := time.Duration(-1)
+	for _, stmt := range q.Statements {
+		selectStmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			return 0
+		}
+
+		for _, m := range selectStmt.Sources.Measurements() {
+			mttl := defaultTTL
+			if policy := prof.measurements[prof.key(m.Name)].Cache; policy != nil {
+				switch policy.Mode {
+				case CacheNone:
+					return 0
+				case CacheBucket:
+					// The range of relative queries moves, so their
+					// responses would be stale under the same key.
+					if usesNow(selectStmt.Condition) {
+						return 0
+					}
+					_, tr, err := influxql.ConditionExpr(selectStmt.Condition, &influxql.NowValuer{Now: now})
+					if err != nil || tr.Max.IsZero() {
+						return 0
+					}
+					if tr.Max.After(now.Add(-time.Duration(policy.Window))) {
+						return 0
+					}
+				}
+				if policy.TTL > 0 {
+					mttl = time.Duration(policy.TTL)
+				}
+			}
+			if ttl < 0 || mttl < ttl {
+				ttl = mttl
+			}
+		}
+	}
+	if ttl < 0 {
+		return defaultTTL
+	}
+	return ttl
+}
+
+// usesNow reports whether expr calls now().
+func usesNow(expr influxql.Expr) bool {
+	found := false
+	influxql.WalkFunc(expr, func(n influxql.Node) {
+		if c, ok := n.(*influxql.Call); ok && strings.EqualFold(c.Name, "now") {
+			found = true
+		}
+	})
+	return found
+}
+
+// cachedResponse is the representation of a proxied response in the cache.
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// cacheKey returns the key under which the response of backend for r is
+// cached. The key covers everything which can influence the response of the
+// backend.
+func cacheKey(backend string, r *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", backend, r.Method, r.URL.Path, r.URL.Query().Encode())
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Header.Get("Accept"), r.Header.Get("Accept-Encoding"), r.Header.Get("Authorization"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serveCached writes the cached response for key to w. It reports whether a
+// usable entry was found.
+func (p *Proxy) serveCached(w http.ResponseWriter, key string) bool {
+	b, ok, err := p.cache.Get(key)
+	if err != nil {
+		cacheLog.Warn("get", "err", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	var resp cachedResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		cacheLog.Warn("decoding entry", "key", key, "err", err)
+		return false
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+	return true
+}
+
+// cacheRecorder is a http.ResponseWriter which passes everything to the
+// underlying ResponseWriter while recording the response for the cache.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.truncated {
+		if rec.body.Len()+len(b) > maxCacheEntrySize {
+			rec.truncated = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so that streaming responses are not delayed.
+func (rec *cacheRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// store saves the recorded response under key, if it is cacheable.
+func (rec *cacheRecorder) store(c Cache, key string, ttl time.Duration) {
+	if rec.status != http.StatusOK || rec.truncated {
+		return
+	}
+
+	header := rec.Header().Clone()
+	header.Del("Date")
+	header.Del("X-Cache")
+	b, err := json.Marshal(cachedResponse{
+		Status: rec.status,
+		Header: header,
+		Body:   rec.body.Bytes(),
+	})
+	if err != nil {
+		cacheLog.Warn("encoding entry", "key", key, "err", err)
+		return
+	}
+	if err := c.Set(key, b, ttl); err != nil {
+		cacheLog.Warn("set", "key", key, "err", err)
+	}
+}
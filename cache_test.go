@@ -0,0 +1,346 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+func testCache(t *testing.T, c Cache) {
+	t.Helper()
+
+	if _, ok, err := c.Get("missing"); ok || err != nil {
+		t.Fatalf("Get(missing): got ok=%v err=%v, want not found", ok, err)
+	}
+
+	if err := c.Set("a", []byte("value"), time.Minute); err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	}
+	got, ok, err := c.Get("a")
+	if err != nil || !ok {
+		t.Fatalf("Get(a): got ok=%v err=%v, want found", ok, err)
+	}
+	if string(got) != "value" {
+		t.Fatalf("Get(a): got %q, want %q", got, "value")
+	}
+
+	if err := c.Set("b", []byte("value"), time.Millisecond); err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok, _ := c.Get("b"); ok {
+		t.Fatal("Get(b): expired entry returned")
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCache(t, newMemoryCache())
+}
+
+func TestMemoryCacheBudget(t *testing.T) {
+	c := newMemoryCache()
+	c.maxBytes = 10
+	c.Set("a", []byte("aaaa"), time.Minute)
+	c.Set("b", []byte("bbbb"), time.Minute)
+	c.Set("a", []byte("aaaa"), time.Minute) // replacing does not count twice.
+	if _, ok, _ := c.Get("b"); !ok || c.size != 8 {
+		t.Fatalf("got size %d, want 8 with both entries", c.size)
+	}
+
+	c.Set("c", []byte("cccc"), time.Minute)
+	if c.size > c.maxBytes || len(c.entries) != 2 {
+		t.Fatalf("got %d entries of %d bytes, want 2 within %d bytes", len(c.entries), c.size, c.maxBytes)
+	}
+	if _, ok, _ := c.Get("c"); !ok {
+		t.Fatal("newest entry evicted")
+	}
+	if _, ok, _ := c.Get("b"); !ok {
+		t.Fatal("recently read entry evicted instead of the least recently used")
+	}
+
+	c.Set("d", []byte("too large value"), time.Minute)
+	if _, ok, _ := c.Get("d"); ok {
+		t.Fatal("entry above the budget stored")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := NewCache("dir:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache(t, c)
+
+	// A new cache on the same directory sees the entries, like after a
+	// restart.
+	c, err = NewCache("dir:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.Get("a"); !ok {
+		t.Fatal("entry not persisted")
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	addr := fakeRedis(t)
+
+	c, err := NewCache("redis://" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache(t, c)
+}
+
+func TestNewRedisClientAddr(t *testing.T) {
+	testCases := map[string]struct {
+		url  string
+		want string
+	}{
+		"hostPort":    {"redis://example.com:6380", "example.com:6380"},
+		"host":        {"redis://example.com/1", "example.com:6379"},
+		"ipv6Port":    {"redis://[::1]:6380", "[::1]:6380"},
+		"ipv6":        {"redis://[::1]", "[::1]:6379"},
+		"ipv6Literal": {"redis://[2001:db8::1]/2", "[2001:db8::1]:6379"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := newRedisClient(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.addr != tc.want {
+				t.Fatalf("got %q, want %q", c.addr, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewCacheUnknown(t *testing.T) {
+	if _, err := NewCache("memcached://localhost"); err == nil {
+		t.Fatal("expected error for unknown backend")
+	}
+	if _, err := NewCache("memory:lots"); err == nil {
+		t.Fatal("expected error for invalid memory cache size")
+	}
+	c, err := NewCache("memory:64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(*memoryCache).maxBytes; got != 64<<20 {
+		t.Fatalf("got budget %d, want %d", got, 64<<20)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"results":[]}`)
+	}))
+	defer backend.Close()
+
+	p, err := NewProxy(backend.URL, sourcesConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache = newMemoryCache()
+	p.cacheTTL = time.Minute
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	for i, want := range []string{"MISS", "HIT"} {
+		resp, err := http.Get(ts.URL + "/query?q=select%20*%20FROM%20test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Fatalf("request %d: got X-Cache %q, want %q", i, got, want)
+		}
+		if string(body) != `{"results":[]}` {
+			t.Fatalf("request %d: got body %q", i, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != "application/json" {
+			t.Fatalf("request %d: got Content-Type %q", i, got)
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("backend got %d requests, want 1", got)
+	}
+}
+
+// fakeRedis starts a server speaking enough of the Redis protocol for the
+// cache and the leader lock and returns its address.
+func fakeRedis(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var (
+		mu   sync.Mutex
+		data = make(map[string]string)
+		exp  = make(map[string]time.Time)
+	)
+	handle := func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args[i] = strings.TrimSuffix(arg, "\r\n")
+			}
+
+			mu.Lock()
+			switch strings.ToUpper(args[0]) {
+			case "SELECT", "AUTH":
+				io.WriteString(c, "+OK\r\n")
+			case "SET":
+				var ms int
+				nx := false
+				for i := 3; i < len(args); i++ {
+					switch strings.ToUpper(args[i]) {
+					case "NX":
+						nx = true
+					case "PX":
+						i++
+						ms, _ = strconv.Atoi(args[i])
+					}
+				}
+				if _, ok := data[args[1]]; nx && ok && time.Now().Before(exp[args[1]]) {
+					io.WriteString(c, "$-1\r\n")
+					break
+				}
+				data[args[1]] = args[2]
+				exp[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				io.WriteString(c, "+OK\r\n")
+			case "EVAL":
+				// Only the script extending the leader lock is supported.
+				key, id := args[3], args[4]
+				ms, _ := strconv.Atoi(args[5])
+				if data[key] == id && time.Now().Before(exp[key]) {
+					exp[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+					io.WriteString(c, ":1\r\n")
+				} else {
+					io.WriteString(c, ":0\r\n")
+				}
+			case "GET":
+				v, ok := data[args[1]]
+				if !ok || time.Now().After(exp[args[1]]) {
+					io.WriteString(c, "$-1\r\n")
+				} else {
+					io.WriteString(c, "$"+strconv.Itoa(len(v))+"\r\n"+v+"\r\n")
+				}
+			default:
+				io.WriteString(c, "-ERR unknown command\r\n")
+			}
+			mu.Unlock()
+		}
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	prof := newProfile(Profile{
+		Measurements: []Measurement{
+			{Name: "plain"},
+			{Name: "short", Cache: &CachePolicy{TTL: duration(10 * time.Second)}},
+			{Name: "never", Cache: &CachePolicy{Mode: CacheNone}},
+			{Name: "Bucket", Cache: &CachePolicy{Mode: CacheBucket, TTL: duration(24 * time.Hour), Window: duration(time.Hour)}},
+		},
+	}, true)
+
+	testCases := map[string]struct {
+		in   string
+		want time.Duration
+	}{
+		"default":         {"SELECT * FROM plain", time.Minute},
+		"unknown":         {"SELECT * FROM other", time.Minute},
+		"ttl":             {"SELECT * FROM short", 10 * time.Second},
+		"none":            {"SELECT * FROM never", 0},
+		"mostRestrictive": {"SELECT * FROM plain, short", 10 * time.Second},
+		"noneWins":        {"SELECT * FROM plain; SELECT * FROM never", 0},
+		"bucketOpen":      {"SELECT * FROM bucket WHERE time > '2020-05-01T00:00:00Z'", 0},
+		"bucketRecent":    {"SELECT * FROM bucket WHERE time < now() - 30m", 0},
+		"bucketRelative":  {"SELECT * FROM bucket WHERE time > now() - 2d AND time < now() - 2h", 0},
+		"bucketAbsolute":  {"SELECT * FROM bucket WHERE time >= '2020-05-01T00:00:00Z' AND time < '2020-05-02T00:00:00Z'", 24 * time.Hour},
+		"bucketMixed":     {"SELECT * FROM bucket, short WHERE time >= '2020-05-01T00:00:00Z' AND time < '2020-05-02T00:00:00Z'", 10 * time.Second},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			q, err := influxql.ParseQuery(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := prof.queryCacheTTL(q, time.Minute, now); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCacheRecorderLimit(t *testing.T) {
+	rec := &cacheRecorder{ResponseWriter: httptest.NewRecorder()}
+	chunk := make([]byte, 1<<20)
+	for i := 0; i < maxCacheEntrySize/len(chunk)+2; i++ {
+		rec.Write(chunk)
+	}
+
+	if !rec.truncated {
+		t.Fatal("response above the limit not marked as truncated")
+	}
+	if rec.body.Len() != 0 {
+		t.Fatalf("recorder still buffers %d bytes", rec.body.Len())
+	}
+
+	c := newMemoryCache()
+	rec.store(c, "key", time.Minute)
+	if _, ok, _ := c.Get("key"); ok {
+		t.Fatal("truncated response stored in cache")
+	}
+}
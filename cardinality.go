@@ -0,0 +1,309 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+var (
+	// ErrTooManySeries is returned if a query matches more series than
+	// allowed by the profile.
+	ErrTooManySeries = errors.New("query matches too many series")
+
+	// ErrSeriesCheck is returned if the series of a query cannot be
+	// counted.
+	ErrSeriesCheck = errors.New("series cardinality of the query cannot be checked")
+)
+
+// Series cardinalities are cached for cardinalityTTL, as counting them is
+// expensive, in at most maxCardinalityEntries entries per profile.
+const (
+	cardinalityTTL        = 5 * time.Minute
+	maxCardinalityEntries = 10000
+)
+
+// checkSeries returns ErrTooManySeries if the SELECT statements of q match
+// more series than the maximum of the profile. Only the cardinalities which
+// are not cached are counted by the backend. Comparisons of fields are not
+// supported by meta queries, so they are dropped from the conditions and the
+// series matching the remaining tag conditions are counted as an upper
+// bound. If the series cannot be counted, an error wrapping ErrSeriesCheck
+// is returned.
+func (prof *profile) checkSeries(r *http.Request, q *influxql.Query) error {
+	if prof.maxSeries <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	db := r.URL.Query().Get("db")
+	var (
+		n       int64
+		missing influxql.Statements
+		keys    []string
+	)
+	for _, stmt := range cardinalityStatements(q, now) {
+		key := db + "\n" + stmt.String()
+		if c, ok := prof.cardinality.get(key, now); ok {
+			n += c
+			continue
+		}
+		missing = append(missing, stmt)
+		keys = append(keys, key)
+	}
+	if len(missing) > 0 {
+		if err := prof.dropFieldConditions(r, missing); err != nil {
+			return fmt.Errorf("%w: %v", ErrSeriesCheck, err)
+		}
+		counts, err := prof.seriesCardinality(r, missing)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSeriesCheck, err)
+		}
+		for i, c := range counts {
+			prof.cardinality.set(keys[i], c, now)
+			n += c
+		}
+	}
+	if n > prof.maxSeries {
+		return fmt.Errorf("%w: %d series, maximum is %d", ErrTooManySeries, n, prof.maxSeries)
+	}
+	return nil
+}
+
+// cardinalityStatements returns a SHOW SERIES EXACT CARDINALITY statement
+// for each measurement queried by the SELECT statements of q, including
+// their subqueries, scoped by the tag conditions of the statement. Time
+// conditions are dropped, as they are not supported by meta queries.
+func cardinalityStatements(q *influxql.Query, now time.Time) influxql.Statements {
+	var stmts influxql.Statements
+	influxql.WalkFunc(q, func(n influxql.Node) {
+		s, ok := n.(*influxql.SelectStatement)
+		if !ok {
+			return
+		}
+		cond, _, err := influxql.ConditionExpr(s.Condition, &influxql.NowValuer{Now: now})
+		if err != nil {
+			cond = nil
+		}
+		for _, src := range s.Sources {
+			// Subqueries are visited on their own.
+			m, ok := src.(*influxql.Measurement)
+			if !ok {
+				continue
+			}
+			stmts = append(stmts, &influxql.ShowSeriesCardinalityStatement{
+				Database:  m.Database,
+				Exact:     true,
+				Sources:   influxql.Sources{m},
+				Condition: cond,
+			})
+		}
+	})
+	return stmts
+}
+
+// dropFieldConditions removes the comparisons of fields from the conditions
+// of the SHOW SERIES CARDINALITY statements stmts. The fields are looked up
+// with SHOW FIELD KEYS on the backend of the profile.
+func (prof *profile) dropFieldConditions(r *http.Request, stmts influxql.Statements) error {
+	var (
+		show    influxql.Statements
+		indexes []int // of the statements in stmts by statement in show.
+	)
+	for i, stmt := range stmts {
+		s := stmt.(*influxql.ShowSeriesCardinalityStatement)
+		if s.Condition == nil {
+			continue
+		}
+		show = append(show, &influxql.ShowFieldKeysStatement{Database: s.Database, Sources: s.Sources})
+		indexes = append(indexes, i)
+	}
+	if len(show) == 0 {
+		return nil
+	}
+
+	params := url.Values{}
+	if db := r.URL.Query().Get("db"); db != "" {
+		params.Set("db", db)
+	}
+	params.Set("q", show.String())
+	resps, err := prof.backendQuery(r, params)
+	if err != nil {
+		return err
+	}
+	fields := make([]map[string]bool, len(show))
+	for i := range fields {
+		fields[i] = make(map[string]bool)
+	}
+	for _, resp := range resps {
+		if resp.Err != "" {
+			return errors.New(resp.Err)
+		}
+		for _, res := range resp.Results {
+			if res.Err != "" {
+				return errors.New(res.Err)
+			}
+			if res.StatementID < 0 || res.StatementID >= len(fields) {
+				return fmt.Errorf("unexpected statement id %d", res.StatementID)
+			}
+			for _, s := range res.Series {
+				for _, row := range s.Values {
+					if len(row) == 0 {
+						continue
+					}
+					if key, ok := row[0].(string); ok {
+						fields[res.StatementID][key] = true
+					}
+				}
+			}
+		}
+	}
+
+	for i, j := range indexes {
+		s := stmts[j].(*influxql.ShowSeriesCardinalityStatement)
+		s.Condition = tagCondition(s.Condition, fields[i])
+	}
+	return nil
+}
+
+// tagCondition returns the condition expr without the comparisons of the
+// given fields, or nil if no condition is left. As InfluxQL conditions have
+// no negation, the result matches at least the series matched by expr.
+// Comparisons of two variables or of variables cast to a field type are
+// removed as well.
+func tagCondition(expr influxql.Expr, fields map[string]bool) influxql.Expr {
+	switch e := expr.(type) {
+	case *influxql.ParenExpr:
+		if cond := tagCondition(e.Expr, fields); cond != nil {
+			return &influxql.ParenExpr{Expr: cond}
+		}
+		return nil
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND:
+			lhs, rhs := tagCondition(e.LHS, fields), tagCondition(e.RHS, fields)
+			if lhs == nil {
+				return rhs
+			}
+			if rhs == nil {
+				return lhs
+			}
+			return &influxql.BinaryExpr{Op: influxql.AND, LHS: lhs, RHS: rhs}
+		case influxql.OR:
+			lhs, rhs := tagCondition(e.LHS, fields), tagCondition(e.RHS, fields)
+			if lhs == nil || rhs == nil {
+				return nil
+			}
+			return &influxql.BinaryExpr{Op: influxql.OR, LHS: lhs, RHS: rhs}
+		}
+		lhs, lok := e.LHS.(*influxql.VarRef)
+		rhs, rok := e.RHS.(*influxql.VarRef)
+		ref := lhs
+		if !lok {
+			ref = rhs
+		}
+		if lok == rok || (ref.Type != influxql.Tag && (ref.Type != influxql.Unknown || fields[ref.Val])) {
+			return nil
+		}
+		return e
+	}
+	return nil
+}
+
+// seriesCardinality runs stmts against the backend of the profile, with the
+// database and credentials of r, and returns the count of each statement.
+func (prof *profile) seriesCardinality(r *http.Request, stmts influxql.Statements) ([]int64, error) {
+	params := url.Values{}
+	if db := r.URL.Query().Get("db"); db != "" {
+		params.Set("db", db)
+	}
+	params.Set("q", stmts.String())
+	resps, err := prof.backendQuery(r, params)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int64, len(stmts))
+	for _, resp := range resps {
+		if resp.Err != "" {
+			return nil, errors.New(resp.Err)
+		}
+		for _, res := range resp.Results {
+			if res.Err != "" {
+				return nil, errors.New(res.Err)
+			}
+			if res.StatementID < 0 || res.StatementID >= len(counts) {
+				return nil, fmt.Errorf("unexpected statement id %d", res.StatementID)
+			}
+			for _, s := range res.Series {
+				for _, row := range s.Values {
+					if len(row) == 0 {
+						continue
+					}
+					n, ok := row[len(row)-1].(json.Number)
+					if !ok {
+						return nil, fmt.Errorf("unexpected series count %v", row[len(row)-1])
+					}
+					i, err := n.Int64()
+					if err != nil {
+						return nil, err
+					}
+					counts[res.StatementID] += i
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// cardinalityCache caches series cardinalities by database and statement.
+// If it is full, it is cleared. A nil cache caches nothing.
+type cardinalityCache struct {
+	mu      sync.Mutex
+	entries map[string]cardinalityEntry
+}
+
+type cardinalityEntry struct {
+	n       int64
+	expires time.Time
+}
+
+func newCardinalityCache() *cardinalityCache {
+	return &cardinalityCache{entries: make(map[string]cardinalityEntry)}
+}
+
+func (c *cardinalityCache) get(key string, now time.Time) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expires) {
+		return 0, false
+	}
+	return e.n, true
+}
+
+func (c *cardinalityCache) set(key string, n int64, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCardinalityEntries {
+		c.entries = make(map[string]cardinalityEntry)
+	}
+	c.entries[key] = cardinalityEntry{n: n, expires: now.Add(cardinalityTTL)}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+func TestCardinalityStatements(t *testing.T) {
+	testCases := map[string]struct {
+		q    string
+		want string
+	}{
+		"noCondition": {"SELECT * FROM m1", "SHOW SERIES EXACT CARDINALITY FROM m1"},
+		"tags":        {"SELECT * FROM m1 WHERE station = 's1'", "SHOW SERIES EXACT CARDINALITY FROM m1 WHERE station = 's1'"},
+		"timeDropped": {"SELECT * FROM m1 WHERE time > now() - 1h AND station = 's1'", "SHOW SERIES EXACT CARDINALITY FROM m1 WHERE station = 's1'"},
+		"database":    {"SELECT * FROM db0.autogen.m1", "SHOW SERIES EXACT CARDINALITY ON db0 FROM db0.autogen.m1"},
+		"multiple":    {"SELECT * FROM m1, m2", "SHOW SERIES EXACT CARDINALITY FROM m1;\nSHOW SERIES EXACT CARDINALITY FROM m2"},
+		"subquery":    {"SELECT max(v) FROM (SELECT * FROM m1 WHERE station = 's1')", "SHOW SERIES EXACT CARDINALITY FROM m1 WHERE station = 's1'"},
+		"showTags":    {"SHOW TAG VALUES FROM m1 WITH KEY = station", ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := cardinalityStatements(mustParseQuery(t, tc.q), time.Now()).String()
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTagCondition(t *testing.T) {
+	fields := map[string]bool{"value": true, "status": true}
+	testCases := map[string]struct {
+		cond string
+		want string
+	}{
+		"tag":         {"station = 's1'", "station = 's1'"},
+		"field":       {"value > 1", ""},
+		"fieldAnd":    {"station = 's1' AND value = value", "station = 's1'"},
+		"fieldOr":     {"station = 's1' OR value > 1", ""},
+		"typedField":  {"station::field = 's1'", ""},
+		"typedTag":    {"value::tag = 'x'", "value::tag = 'x'"},
+		"stringField": {"status = 'ok' AND (station = 's1' OR station = 's2')", "(station = 's1' OR station = 's2')"},
+		"nested":      {"(station = 's1' AND value > 1) OR station = 's2'", "(station = 's1') OR station = 's2'"},
+		"twoVars":     {"station = sensor", ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			expr, err := influxql.ParseExpr(tc.cond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if cond := tagCondition(expr, fields); cond != nil {
+				got = cond.String()
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	captureLogs(t, "error", "console")
+
+	// The backend reports 10 series per measurement and fails for m3 and
+	// for conditions on the field value.
+	var counted int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(q, "SHOW FIELD KEYS") {
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"m1","columns":["fieldKey","fieldType"],"values":[["value","float"]]}]}]}`)
+			return
+		}
+		if !strings.HasPrefix(q, "SHOW SERIES EXACT CARDINALITY") {
+			fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+			return
+		}
+		atomic.AddInt32(&counted, 1)
+		if r.URL.Query().Get("db") != "db0" {
+			t.Errorf("backend: got db %q, want db0", r.URL.Query().Get("db"))
+		}
+		if strings.Contains(q, "m3") || strings.Contains(q, "value") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var results []string
+		for i, stmt := range strings.Split(q, ";") {
+			name := strings.Fields(stmt)[5]
+			results = append(results, fmt.Sprintf(`{"statement_id":%d,"series":[{"name":%q,"columns":["count"],"values":[[10]]}]}`, i, name))
+		}
+		fmt.Fprintf(w, `{"results":[%s]}`, strings.Join(results, ","))
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("m1", "m2", "m3")
+	cfg.Profile.MaxSeries = 15
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		q    string
+		code int
+	}{
+		"below":          {"SELECT * FROM m1", http.StatusOK},
+		"above":          {"SELECT * FROM m1, m2", http.StatusNotAcceptable},
+		"fieldCondition": {"SELECT * FROM m1, m2 WHERE station = 's1' AND value = value", http.StatusNotAcceptable},
+		"backendFailed":  {"SELECT * FROM m3", http.StatusServiceUnavailable},
+		"notSelect":      {"SHOW TAG VALUES FROM m1 WITH KEY = station", http.StatusOK},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			failures := counterValue(seriesCheckFailures, defaultProfileName)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", "/query?db=db0&q="+url.QueryEscape(tc.q), nil))
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tc.code, w.Body)
+			}
+			if tc.code == http.StatusNotAcceptable && !strings.Contains(w.Body.String(), "20 series, maximum is 15") {
+				t.Fatalf("got body %q, want series count", w.Body)
+			}
+			want := 0.0
+			if name == "backendFailed" {
+				want = 1
+			}
+			if got := counterValue(seriesCheckFailures, defaultProfileName) - failures; got != want {
+				t.Fatalf("got %v failed checks, want %v", got, want)
+			}
+		})
+	}
+
+	// The cardinalities of m1 and m2 are cached now.
+	before := atomic.LoadInt32(&counted)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?db=db0&q="+url.QueryEscape("SELECT * FROM m1, m2"), nil))
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusNotAcceptable, w.Body)
+	}
+	if got := atomic.LoadInt32(&counted) - before; got != 0 {
+		t.Fatalf("got %d cardinality queries, want cached counts", got)
+	}
+}
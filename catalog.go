@@ -0,0 +1,289 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// ErrCatalogPage is returned if the limit or offset of a catalog request
+// is invalid.
+var ErrCatalogPage = errors.New("invalid limit or offset")
+
+// Catalog pagination.
+const (
+	defaultCatalogLimit = 100
+	maxCatalogLimit     = 1000
+)
+
+// The time coverage of a measurement is cached for coverageTTL, in at most
+// maxCoverageEntries entries.
+const (
+	coverageTTL        = time.Hour
+	maxCoverageEntries = 10000
+)
+
+// maxCoverageQueries is the number of coverage queries run at once per
+// catalog request.
+const maxCoverageQueries = 4
+
+// catalogPage is a page of the measurements a client may query.
+type catalogPage struct {
+	Total        int                  `json:"total"`
+	Offset       int                  `json:"offset"`
+	Limit        int                  `json:"limit"`
+	Next         *int                 `json:"next,omitempty"` // offset of the next page, if any.
+	Measurements []catalogMeasurement `json:"measurements"`
+}
+
+type catalogMeasurement struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Fields      []string          `json:"fields,omitempty"`
+	Units       map[string]string `json:"units,omitempty"`
+	Coverage    *coverage         `json:"coverage,omitempty"`
+}
+
+// coverage is the time range of the points of a measurement.
+type coverage struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// coverageCache caches the time coverage of measurements by backend,
+// backend credentials, database and measurement, as the credentials may
+// restrict the points visible. If it is full, it is cleared.
+type coverageCache struct {
+	mu      sync.Mutex
+	entries map[string]coverageEntry
+}
+
+type coverageEntry struct {
+	coverage *coverage // nil if the measurement has no points.
+	expires  time.Time
+}
+
+func newCoverageCache() *coverageCache {
+	return &coverageCache{entries: make(map[string]coverageEntry)}
+}
+
+func (c *coverageCache) get(key string, now time.Time) (*coverage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.coverage, true
+}
+
+func (c *coverageCache) set(key string, cov *coverage, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCoverageEntries {
+		c.entries = make(map[string]coverageEntry)
+	}
+	c.entries[key] = coverageEntry{coverage: cov, expires: now.Add(coverageTTL)}
+}
+
+// serveCatalog serves a page of the measurements the authenticated client
+// may query, with their configured metadata. If the db parameter is given,
+// the time coverage of the measurements in that database is included. As
+// this fans out into queries, catalog requests count against the rate limit
+// of the profile like queries.
+func (p *Proxy) serveCatalog(w http.ResponseWriter, r *http.Request, prof *profile) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		reportError(w, ErrMethodNotAllowed, http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := prof.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="InfluxDB"`)
+		reportError(w, err, http.StatusUnauthorized)
+		return
+	}
+	if !prof.allow(clientID(r, user)) {
+		reportError(w, ErrRateLimited, http.StatusTooManyRequests)
+		return
+	}
+
+	params := r.URL.Query()
+	limit, offset, err := catalogRange(params)
+	if err != nil {
+		reportError(w, err, http.StatusBadRequest)
+		return
+	}
+	db := params.Get("db")
+	if db != "" && prof.databases != nil {
+		actual, ok := prof.databases[db]
+		if !ok {
+			reportError(w, ErrDatabaseNotAllowed, http.StatusNotAcceptable)
+			return
+		}
+		db = actual
+	}
+
+	page := prof.catalog(limit, offset)
+	if db != "" {
+		p.addCoverage(r, prof, db, page.Measurements)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// catalogRange returns the limit and offset parameters of a catalog
+// request.
+func catalogRange(params url.Values) (limit, offset int, err error) {
+	limit = defaultCatalogLimit
+	if s := params.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxCatalogLimit {
+			return 0, 0, fmt.Errorf("%w: limit must be between 1 and %d", ErrCatalogPage, maxCatalogLimit)
+		}
+	}
+	if s := params.Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("%w: offset must not be negative", ErrCatalogPage)
+		}
+	}
+	return limit, offset, nil
+}
+
+// catalog returns the page of the allowed measurements of the profile,
+// sorted by name.
+func (prof *profile) catalog(limit, offset int) *catalogPage {
+	names := make([]string, 0, len(prof.measurements))
+	for _, m := range prof.measurements {
+		names = append(names, prof.publicName(m.Name))
+	}
+	sort.Strings(names)
+
+	page := &catalogPage{
+		Total:        len(names),
+		Offset:       offset,
+		Limit:        limit,
+		Measurements: []catalogMeasurement{},
+	}
+	if offset >= len(names) {
+		return page
+	}
+	end := offset + limit
+	if end < len(names) {
+		page.Next = &end
+	} else {
+		end = len(names)
+	}
+	for _, name := range names[offset:end] {
+		actual, _ := prof.measurementName(name)
+		m := prof.measurements[prof.key(actual)]
+		page.Measurements = append(page.Measurements, catalogMeasurement{
+			Name:        name,
+			Description: m.Description,
+			Fields:      m.Fields,
+			Units:       m.Units,
+		})
+	}
+	return page
+}
+
+// addCoverage sets the time coverage of the measurements in the backend
+// database db, from the cache or by querying the first and last point of
+// each. Measurements whose coverage cannot be determined are left without.
+func (p *Proxy) addCoverage(r *http.Request, prof *profile, db string, ms []catalogMeasurement) {
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, maxCoverageQueries)
+	)
+	// The credentials are hashed, so that the cache does not keep them.
+	h := sha256.New()
+	q := r.URL.Query()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Header.Get("Authorization"), q.Get("u"), q.Get("p"))
+	credentials := hex.EncodeToString(h.Sum(nil))
+
+	for i := range ms {
+		m := &ms[i]
+		name, _ := prof.measurementName(m.Name)
+		key := prof.backend + "\x00" + credentials + "\x00" + db + "\x00" + name
+		if cov, ok := p.coverage.get(key, time.Now()); ok {
+			m.Coverage = cov
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			cov, err := prof.measurementCoverage(r, db, name)
+			if err != nil {
+				proxyLog.Warn("measurement coverage failed", "profile", prof.name, "db", db, "measurement", name, "err", err)
+				return
+			}
+			p.coverage.set(key, cov, time.Now())
+			m.Coverage = cov
+		}()
+	}
+	wg.Wait()
+}
+
+// measurementCoverage returns the time range of the points of the
+// measurement name in db, or nil if it has none. The first and last point
+// are cheap to find, as InfluxDB stores points ordered by time.
+func (prof *profile) measurementCoverage(r *http.Request, db, name string) (*coverage, error) {
+	m := influxql.QuoteIdent(name)
+	params := url.Values{}
+	params.Set("db", db)
+	params.Set("q", fmt.Sprintf("SELECT * FROM %s LIMIT 1; SELECT * FROM %s ORDER BY time DESC LIMIT 1", m, m))
+	resps, err := prof.backendQuery(r, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var times []time.Time
+	for _, resp := range resps {
+		if resp.Err != "" {
+			return nil, errors.New(resp.Err)
+		}
+		for _, res := range resp.Results {
+			if res.Err != "" {
+				return nil, errors.New(res.Err)
+			}
+			for _, s := range res.Series {
+				if len(s.Values) == 0 || len(s.Values[0]) == 0 || len(s.Columns) == 0 || s.Columns[0] != "time" {
+					continue
+				}
+				v, ok := s.Values[0][0].(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected time %v", s.Values[0][0])
+				}
+				t, err := time.Parse(time.RFC3339Nano, v)
+				if err != nil {
+					return nil, err
+				}
+				times = append(times, t)
+			}
+		}
+	}
+	if len(times) != 2 {
+		return nil, nil
+	}
+	return &coverage{First: times[0], Last: times[1]}, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCatalogRange(t *testing.T) {
+	testCases := map[string]struct {
+		in            string
+		limit, offset int
+		err           error
+	}{
+		"default":       {"", defaultCatalogLimit, 0, nil},
+		"page":          {"limit=10&offset=20", 10, 20, nil},
+		"zeroLimit":     {"limit=0", 0, 0, ErrCatalogPage},
+		"largeLimit":    {"limit=1001", 0, 0, ErrCatalogPage},
+		"invalidLimit":  {"limit=ten", 0, 0, ErrCatalogPage},
+		"negativeStart": {"offset=-1", 0, 0, ErrCatalogPage},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			params, _ := url.ParseQuery(tc.in)
+			limit, offset, err := catalogRange(params)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if limit != tc.limit || offset != tc.offset {
+				t.Fatalf("got limit %d offset %d, want %d %d", limit, offset, tc.limit, tc.offset)
+			}
+		})
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if got := r.URL.Query().Get("db"); got != "lt_data" {
+			t.Errorf("got db %q, want lt_data", got)
+		}
+		q := r.URL.Query().Get("q")
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(q, "FROM air ") {
+			io.WriteString(w, `{"results":[{"statement_id":0},{"statement_id":1}]}`)
+			return
+		}
+		io.WriteString(w, `{"results":[`+
+			`{"statement_id":0,"series":[{"name":"air","columns":["time","t"],"values":[["2019-01-01T00:00:00Z",1]]}]},`+
+			`{"statement_id":1,"series":[{"name":"air","columns":["time","t"],"values":[["2020-06-01T12:00:00Z",2]]}]}]}`)
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig()
+	cfg.Profiles = []Profile{{
+		Name:    "partner",
+		Prefix:  "/partner",
+		Backend: backend.URL,
+		Measurements: []Measurement{
+			{Name: "water"},
+			{Name: "air", Description: "Air temperature", Fields: []string{"t"}, Units: map[string]string{"t": "°C"}},
+			{Name: "snow"},
+		},
+		Databases: map[string]string{"public": "lt_data"},
+	}}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) (int, *catalogPage) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/partner/catalog?"+query, nil))
+		var page catalogPage
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, &page
+	}
+
+	code, page := get("limit=2")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if page.Total != 3 || page.Next == nil || *page.Next != 2 || len(page.Measurements) != 2 {
+		t.Fatalf("got page %+v, want 2 of 3 measurements with next 2", page)
+	}
+	m := page.Measurements[0]
+	if m.Name != "air" || m.Description != "Air temperature" || m.Units["t"] != "°C" || m.Coverage != nil {
+		t.Fatalf("got %+v, want air with metadata and without coverage", m)
+	}
+	if _, page = get("limit=2&offset=2"); page.Next != nil || len(page.Measurements) != 1 || page.Measurements[0].Name != "water" {
+		t.Fatalf("got last page %+v, want water only", page)
+	}
+
+	if code, _ = get("db=lt_data"); code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d for unmapped database, want %d", code, http.StatusNotAcceptable)
+	}
+	for i := 0; i < 2; i++ {
+		_, page = get("db=public")
+		cov := page.Measurements[0].Coverage
+		if cov == nil || !cov.First.Equal(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)) || !cov.Last.Equal(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)) {
+			t.Fatalf("request %d: got coverage %+v of air", i, cov)
+		}
+		if cov := page.Measurements[1].Coverage; cov != nil {
+			t.Fatalf("request %d: got coverage %+v of empty measurement", i, cov)
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Fatalf("backend got %d requests, want 3", got)
+	}
+
+	// Coverages are cached by the credentials passed on to the backend,
+	// which may see other points.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/partner/catalog?db=public", nil)
+	r.SetBasicAuth("reader", "secret")
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("with credentials: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := atomic.LoadInt32(&hits); got != 6 {
+		t.Fatalf("backend got %d requests, want 6", got)
+	}
+}
+
+func TestCoverageCacheFull(t *testing.T) {
+	c := newCoverageCache()
+	now := time.Now()
+	for i := 0; i < maxCoverageEntries+1; i++ {
+		c.set(strconv.Itoa(i), nil, now)
+	}
+	if n := len(c.entries); n != 1 {
+		t.Fatalf("got %d entries, want cache cleared when full", n)
+	}
+}
+
+func TestCatalogRateLimit(t *testing.T) {
+	cfg := sourcesConfig("m")
+	cfg.Profile.RateLimit = &RateLimit{Requests: 1, Per: duration(time.Hour)}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/catalog", nil))
+		if w.Code != want {
+			t.Fatalf("got status %d, want %d", w.Code, want)
+		}
+	}
+}
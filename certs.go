@@ -0,0 +1,236 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// hardenTLS restricts cfg to TLS 1.2 or later with forward secrecy.
+func hardenTLS(cfg *tls.Config) {
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.CurvePreferences = []tls.CurveID{
+		tls.CurveP256,
+		tls.X25519, // Go 1.8 only
+	}
+	cfg.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, // Go 1.8 only
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,   // Go 1.8 only
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+}
+
+// certReloader serves a certificate and client CA bundle from files and
+// reloads them when they change, so that rotated certificates are picked
+// up without a restart.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	pool  *x509.CertPool // nil if client certificates are not verified
+	stamp string         // modification times and sizes of the loaded files
+}
+
+// newCertReloader loads the certificate and key and, if caFile is not
+// empty, the client CA bundle.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files watched by r.
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// reload loads the files again if any of them changed since they were
+// loaded last and reports whether it did. On error the previous
+// certificate and CA bundle are kept.
+func (r *certReloader) reload() (bool, error) {
+	var stamp string
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", f, fi.ModTime().UnixNano(), fi.Size())
+	}
+	r.mu.RLock()
+	unchanged := stamp == r.stamp
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return false, err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		b, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return false, fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.stamp = &cert, pool, stamp
+	r.mu.Unlock()
+
+	servedCertificates.reset()
+	servedCertificates.observe(&cert)
+	return true, nil
+}
+
+// run checks the files for changes every interval.
+func (r *certReloader) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := r.reload()
+		if err != nil {
+			tlsLog.Error("reloading certificate", "cert", r.certFile, "err", err)
+			continue
+		}
+		if reloaded {
+			tlsLog.Info("reloaded certificate", "cert", r.certFile, "expires", r.certificate().Leaf.NotAfter)
+		}
+	}
+}
+
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *certReloader) clientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// tlsConfig returns a configuration serving the current certificate. If
+// a CA bundle is given, clients must present a certificate signed by one
+// of the current CAs.
+func (r *certReloader) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+	}
+	hardenTLS(cfg)
+	if r.caFile == "" {
+		return cfg
+	}
+
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.clientCAs()
+		return c, nil
+	}
+	return cfg
+}
+
+// serveTLS serves handler on addr with the certificate in certFile and
+// keyFile, requiring client certificates signed by the CAs in caFile if
+// it is not empty. The files are checked for changes every interval.
+func serveTLS(addr string, handler http.Handler, certFile, keyFile, caFile string, interval time.Duration) error {
+	if certFile == "" || keyFile == "" {
+		return errors.New("both certificate and key are required")
+	}
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	if interval > 0 {
+		go r.run(interval)
+	}
+
+	s := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: r.tlsConfig(),
+		ErrorLog:  tlsLog.stdLogger(levelDebug),
+	}
+	tlsLog.Info("listening", "addr", addr, "cert", certFile, "client_ca", caFile)
+	return s.ListenAndServeTLS("", "")
+}
+
+// servedCertificates records the expiry of the certificates served.
+var servedCertificates = &certExpiry{notAfter: make(map[string]time.Time)}
+
+// certExpiry tracks the expiry of certificates by domain.
+type certExpiry struct {
+	mu       sync.Mutex
+	notAfter map[string]time.Time
+}
+
+// observe records the expiry of cert under its first DNS name or, if it
+// has none, its common name.
+func (e *certExpiry) observe(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	domain := leaf.Subject.CommonName
+	if len(leaf.DNSNames) > 0 {
+		domain = leaf.DNSNames[0]
+	}
+
+	e.mu.Lock()
+	e.notAfter[domain] = leaf.NotAfter
+	e.mu.Unlock()
+}
+
+func (e *certExpiry) reset() {
+	e.mu.Lock()
+	e.notAfter = make(map[string]time.Time)
+	e.mu.Unlock()
+}
+
+// update sets the expiry metric to the days left at now.
+func (e *certExpiry) update(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tlsCertificateExpiry.Reset()
+	for domain, notAfter := range e.notAfter {
+		tlsCertificateExpiry.Set(notAfter.Sub(now).Hours()/24, domain)
+	}
+}
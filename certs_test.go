@@ -0,0 +1,224 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gaugeValue returns the value of the series of g with the given labels.
+func gaugeValue(g *gaugeVec, labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s, ok := g.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM encoded certificate and key for name valid for
+// the given number of days.
+func (ca *testCA) issue(t *testing.T, serial int64, name string, days int) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Duration(days) * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+// writeFile writes b to name and sets its modification time to mtime, as
+// rotations within the resolution of the file system would go unnoticed.
+func writeFile(t *testing.T, name string, b []byte, mtime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCA(t)
+	now := time.Now()
+	cert, key := ca.issue(t, 2, "proxy.example.org", 30)
+	writeFile(t, certFile, cert, now)
+	writeFile(t, keyFile, key, now)
+	writeFile(t, caFile, ca.pem, now)
+
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go s.Serve(ln)
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientCert, clientKey := ca.issue(t, 3, "client", 30)
+	pair, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dial returns the serial number of the server certificate.
+	dial := func(certs ...tls.Certificate) (int64, error) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+			ServerName:   "proxy.example.org",
+		})
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		// TLS 1.3 reports rejected client certificates on the first read.
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+			return 0, err
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			return 0, err
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+
+	if serial, err := dial(pair); err != nil || serial != 2 {
+		t.Fatalf("got serial %d, err %v; want 2", serial, err)
+	}
+	if _, err := dial(); err == nil {
+		t.Fatal("expected error without client certificate")
+	}
+
+	servedCertificates.update(now)
+	if got := gaugeValue(tlsCertificateExpiry, "proxy.example.org"); math.Abs(got-30) > 0.1 {
+		t.Fatalf("got expiry of %v days, want 30", got)
+	}
+
+	if reloaded, err := r.reload(); err != nil || reloaded {
+		t.Fatalf("got reloaded %v, err %v for unchanged files", reloaded, err)
+	}
+
+	// A broken rotation keeps the previous certificate.
+	later := now.Add(time.Minute)
+	writeFile(t, keyFile, []byte("garbage"), later)
+	if _, err := r.reload(); err == nil {
+		t.Fatal("expected error for broken key")
+	}
+	if serial, err := dial(pair); err != nil || serial != 2 {
+		t.Fatalf("got serial %d, err %v after broken rotation; want 2", serial, err)
+	}
+
+	// Rotating the certificate and the CA bundle applies to new connections.
+	otherCA := newTestCA(t)
+	cert, key = ca.issue(t, 4, "proxy.example.org", 90)
+	later = later.Add(time.Minute)
+	writeFile(t, certFile, cert, later)
+	writeFile(t, keyFile, key, later)
+	writeFile(t, caFile, append(ca.pem, otherCA.pem...), later)
+	if reloaded, err := r.reload(); err != nil || !reloaded {
+		t.Fatalf("got reloaded %v, err %v", reloaded, err)
+	}
+	otherCert, otherKey := otherCA.issue(t, 5, "client", 30)
+	otherPair, err := tls.X509KeyPair(otherCert, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := dial(otherPair); err != nil || serial != 4 {
+		t.Fatalf("got serial %d, err %v after rotation; want 4", serial, err)
+	}
+
+	servedCertificates.update(now)
+	if got := gaugeValue(tlsCertificateExpiry, "proxy.example.org"); math.Abs(got-90) > 0.1 {
+		t.Fatalf("got expiry of %v days, want 90", got)
+	}
+}
+
+func TestServeTLSRequiresKey(t *testing.T) {
+	err := serveTLS("127.0.0.1:0", http.NotFoundHandler(), "tls.crt", "", "", 0)
+	if err == nil || !strings.Contains(err.Error(), "key") {
+		t.Fatalf("got %v, want error about missing key", err)
+	}
+}
@@ -0,0 +1,679 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the proxy as read from the JSON file given
+// with -config. A minimal configuration looks like:
+//
+//	{
+//		"measurements": [
+//			{"name": "m1"},
+//			{"name": "m2", "cache": {"mode": "none"}},
+//			{"name": "m3", "cache": {"mode": "bucket", "ttl": "24h", "window": "1h"}}
+//		],
+//		"profiles": [
+//			{
+//				"name": "partner",
+//				"prefix": "/partner",
+//				"measurements": [{"name": "m4"}],
+//				"rate_limit": {"requests": 60, "per": "1m", "burst": 10},
+//				"auth": {"users": {"alice": "$2a$10$..."}}
+//			}
+//		]
+//	}
+//
+// The top level settings form the default profile, which is used for all
+// requests not matching any other profile.
+type Config struct {
+	Profile
+
+	// CaseInsensitive matches measurement names case insensitive in all
+	// profiles. By default they are case sensitive, like in InfluxDB.
+	CaseInsensitive bool `json:"case_insensitive"`
+
+	// Profiles are additional named policy profiles.
+	Profiles []Profile `json:"profiles"`
+
+	// Sentry enables reporting of panics and upstream errors to Sentry.
+	Sentry *Sentry `json:"sentry,omitempty"`
+
+	// Warmup periodically runs queries, e.g. to populate the cache.
+	Warmup *Warmup `json:"warmup,omitempty"`
+
+	// Grafana enables recognizing requests of Grafana.
+	Grafana *Grafana `json:"grafana,omitempty"`
+
+	// AdminAuth requires authentication for all endpoints of the admin
+	// listener, including the status page.
+	AdminAuth *Auth `json:"admin_auth,omitempty"`
+}
+
+// Grafana enables recognizing requests of Grafana by their User-Agent or
+// X-Grafana-Org-Id header. Their dashboard and panel, if sent by Grafana,
+// are added to metrics and logs.
+type Grafana struct {
+	// Profile, if set, serves the requests of trusted Grafana instances
+	// instead of the profile selected by host or path prefix.
+	Profile string `json:"profile,omitempty"`
+
+	// Trusted are the IP addresses or CIDR networks of the trusted
+	// Grafana instances.
+	Trusted []string `json:"trusted,omitempty"`
+}
+
+// Warmup runs a set of queries every Interval, like a client of the proxy
+// would, to populate the cache before users need the data and to verify
+// that the backends answer them. Failures are counted by metrics and
+// reported to Webhook.
+type Warmup struct {
+	Interval duration      `json:"interval"`
+	Webhook  string        `json:"webhook"`
+	Queries  []WarmupQuery `json:"queries"`
+}
+
+// WarmupQuery is a query run by Warmup. It must be allowed by its profile.
+type WarmupQuery struct {
+	Name string `json:"name"`
+
+	// Profile is the name of the profile the query is run with. Defaults
+	// to the default profile.
+	Profile string `json:"profile"`
+
+	DB    string `json:"db"`
+	Query string `json:"q"`
+
+	// Headers are sent with the query. As they are part of the cache key,
+	// they should match the ones sent by the clients, e.g. Accept-Encoding.
+	Headers map[string]string `json:"headers"`
+}
+
+// Sentry configures the reporting of errors to Sentry. Panics in request
+// handlers are reported with their stack trace. Upstream 5xx responses and
+// failed backend requests are reported if they occur in bursts, i.e. if at
+// least BurstThreshold of them happen within BurstWindow.
+type Sentry struct {
+	// DSN is the Sentry client key, like
+	// "https://<key>@sentry.example.com/<project>".
+	DSN         string `json:"dsn"`
+	Environment string `json:"environment"`
+
+	// BurstThreshold defaults to 10 and BurstWindow to one minute.
+	BurstThreshold int      `json:"burst_threshold"`
+	BurstWindow    duration `json:"burst_window"`
+}
+
+// Profile is a named policy profile with its own allowlist, rate limit and
+// authentication requirements. A request is served by the first profile one
+// of whose hosts matches the Host header or, failing that, by the profile
+// with the longest matching path prefix.
+type Profile struct {
+	Name string `json:"name"`
+
+	// Prefix is the path prefix the InfluxDB endpoints are exposed at, e.g.
+	// "/open" exposes "/open/query" and "/open/ping".
+	Prefix string `json:"prefix"`
+
+	// Hosts are virtual hosts selecting the profile. With -https
+	// certificates are requested for all of them.
+	Hosts []string `json:"hosts"`
+
+	// Backend is the address of the InfluxDB server of the profile
+	// (protocol://host:port). Defaults to -addr.
+	Backend string `json:"backend"`
+
+	// Shadow mirrors a share of the allowed queries to a secondary
+	// backend, e.g. to evaluate a new InfluxDB version.
+	Shadow *Shadow `json:"shadow,omitempty"`
+
+	// Measurements are the allowed measurements. For the default profile
+	// these are in addition to the ones given with -sources.
+	Measurements []Measurement `json:"measurements"`
+
+	// Databases maps the public database names used by clients to the
+	// databases of the backend. If set, only the listed databases can be
+	// queried, both with the db parameter and in fully qualified sources.
+	Databases map[string]string `json:"databases,omitempty"`
+
+	// Aliases maps public measurement names used by clients to the
+	// measurements of the backend. Aliased measurements can be queried by
+	// their alias only and their series are renamed to it in responses.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Tombstones are removed measurements. Queries using them are rejected
+	// with an explanation and their replacement instead of the generic
+	// error of measurements which are not allowed.
+	Tombstones map[string]Tombstone `json:"tombstones,omitempty"`
+
+	Params         *Params         `json:"params,omitempty"`
+	RateLimit      *RateLimit      `json:"rate_limit,omitempty"`
+	StatementLimit *StatementLimit `json:"statement_limit,omitempty"`
+	Auth           *Auth           `json:"auth,omitempty"`
+
+	// Authorizer is an external service deciding about the queries which
+	// passed the checks of the profile.
+	Authorizer *Authorizer `json:"authorizer,omitempty"`
+
+	// MaxSeries, if set, is the maximum number of series the SELECT
+	// statements of a query may match, as counted by SHOW SERIES EXACT
+	// CARDINALITY on the backend before the query is forwarded.
+	MaxSeries int64 `json:"max_series,omitempty"`
+
+	// QueryTimeout, if set, is the deadline of queries at the backend.
+	// Queries still running are cancelled and the client gets a 504.
+	QueryTimeout duration `json:"query_timeout,omitempty"`
+
+	// Access restricts the times the profile can be queried.
+	Access *Access `json:"access,omitempty"`
+
+	// SplitStatements, if set, runs the statements of multi-statement
+	// queries as separate backend queries, at most SplitStatements at
+	// once, so that a slow statement does not delay the others and each
+	// statement is cached on its own.
+	SplitStatements int `json:"split_statements,omitempty"`
+
+	// SLOs are the service level objectives tracked for the profile.
+	SLOs []SLO `json:"slos,omitempty"`
+}
+
+// SLO is a service level objective for the requests of an endpoint, like
+// "/query", of a profile. A request is bad if it fails with a server error
+// or, for latency objectives, if it takes longer than Latency.
+type SLO struct {
+	// Name distinguishes objectives of the same endpoint. Defaults to
+	// "latency" for latency objectives and "errors" otherwise.
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+
+	// Latency is the threshold of latency objectives. If zero, the
+	// objective is on the error rate only.
+	Latency duration `json:"latency"`
+
+	// Objective is the fraction of requests which must be good, e.g. 0.99.
+	Objective float64 `json:"objective"`
+}
+
+// name returns the name of the SLO, see SLO.Name.
+func (s SLO) name() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.Latency > 0:
+		return "latency"
+	default:
+		return "errors"
+	}
+}
+
+// RateLimit limits the number of queries per client. A client is identified
+// by its user name if authenticated, otherwise by its IP address.
+type RateLimit struct {
+	// Requests is the number of queries allowed per Per.
+	Requests float64  `json:"requests"`
+	Per      duration `json:"per"`
+
+	// Burst is the number of queries allowed at once. Defaults to
+	// Requests.
+	Burst float64 `json:"burst"`
+}
+
+// Shadow configures the mirroring of queries to a secondary backend.
+type Shadow struct {
+	// Backend is the address of the secondary InfluxDB server
+	// (protocol://host:port).
+	Backend string `json:"backend"`
+
+	// Percent is the share of allowed queries mirrored, between 0
+	// (exclusive) and 100.
+	Percent float64 `json:"percent"`
+
+	// Compare compares the responses of the secondary backend to the ones
+	// of the primary backend instead of discarding them.
+	Compare bool `json:"compare"`
+
+	// Epsilon is the relative difference up to which numbers are equal
+	// when comparing responses. Defaults to 1e-9.
+	Epsilon float64 `json:"epsilon,omitempty"`
+}
+
+// Authorizer configures an external authorization service. For each query
+// the proxy posts a decision request to URL, see authorizer.decide.
+type Authorizer struct {
+	URL string `json:"url"`
+
+	// Timeout of decision requests. Defaults to 5s.
+	Timeout duration `json:"timeout,omitempty"`
+
+	// FailOpen allows queries if the authorizer cannot be reached or
+	// fails. By default they are rejected.
+	FailOpen bool `json:"fail_open,omitempty"`
+}
+
+// Params configures the handling of query parameters.
+type Params struct {
+	// Epoch is the precision of timestamps, e.g. "ms", applied according
+	// to EpochMode.
+	Epoch string `json:"epoch,omitempty"`
+
+	// EpochMode is one of "inject" (default), setting Epoch if the client
+	// did not send one, "force", overriding the epoch of the client, or
+	// "require", rejecting queries without epoch.
+	EpochMode string `json:"epoch_mode,omitempty"`
+
+	// Strict rejects requests to unknown endpoints and with query
+	// parameters unknown to the endpoint with InfluxDB style errors.
+	Strict bool `json:"strict"`
+
+	// Passthrough are further query parameters accepted in strict mode
+	// and forwarded to the backend.
+	Passthrough []string `json:"passthrough,omitempty"`
+}
+
+// Tombstone describes a removed measurement.
+type Tombstone struct {
+	// Replacement is the measurement clients should query instead.
+	Replacement string `json:"replacement,omitempty"`
+
+	// Message is a further explanation, like the date of the removal.
+	Message string `json:"message,omitempty"`
+}
+
+// Access restricts the times a profile can be queried to windows given as
+// cron-like schedules "minute hour day-of-month month day-of-week" of the
+// minutes within the window, e.g. "* 0-6,19-23 * * 1-5" for weekday nights.
+type Access struct {
+	// Timezone is the IANA time zone of the schedules. Defaults to UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Windows are the schedules all queries are allowed in. If empty,
+	// queries are allowed at all times.
+	Windows []string `json:"windows,omitempty"`
+
+	// Bulk restricts expensive queries to further windows.
+	Bulk *BulkAccess `json:"bulk,omitempty"`
+}
+
+// BulkAccess restricts expensive queries, e.g. to off-hours. A query is a
+// bulk query if it has at least MinStatements statements or if its SELECT
+// statements cover a time range of at least MinRange or an unbounded one.
+type BulkAccess struct {
+	MinRange      duration `json:"min_range,omitempty"`
+	MinStatements int      `json:"min_statements,omitempty"`
+	Windows       []string `json:"windows"`
+}
+
+// StatementLimit limits the number of statements per client, independent of
+// the number of queries they are sent in. Clients are identified like for
+// RateLimit.
+type StatementLimit struct {
+	// Statements is the number of statements allowed per Per.
+	Statements float64  `json:"statements"`
+	Per        duration `json:"per"`
+
+	// Burst is the number of statements allowed at once, which is also the
+	// maximum number of statements of a single query. Defaults to
+	// Statements.
+	Burst float64 `json:"burst"`
+}
+
+// Auth requires clients to authenticate, like InfluxDB, either with basic
+// authentication or the u and p query parameters. The credentials are not
+// forwarded to the backend.
+type Auth struct {
+	// Users maps user names to bcrypt hashed passwords.
+	Users map[string]string `json:"users"`
+}
+
+// Measurement is an allowed measurement together with its settings.
+type Measurement struct {
+	Name  string       `json:"name"`
+	Cache *CachePolicy `json:"cache,omitempty"`
+
+	// TagValues restricts the values returned by SHOW TAG VALUES to the
+	// given ones, by tag key. Values of tag keys not listed are returned
+	// unfiltered.
+	TagValues map[string][]string `json:"tag_values,omitempty"`
+
+	// ForbiddenTags are tag keys which queries must not filter by in
+	// their WHERE clause nor group by, e.g. private tags like
+	// "owner_email".
+	ForbiddenTags []string `json:"forbidden_tags,omitempty"`
+
+	// GroupBy, if set, are the only tag keys queries may group by,
+	// besides time. An empty list allows grouping by time only.
+	GroupBy []string `json:"group_by,omitempty"`
+
+	// Fields are the field keys of the measurement, published in the API
+	// description for clients. They do not restrict queries.
+	Fields []string `json:"fields,omitempty"`
+
+	// Description and Units, by field key, are published in the catalog.
+	Description string            `json:"description,omitempty"`
+	Units       map[string]string `json:"units,omitempty"`
+}
+
+// Cache policy modes.
+const (
+	// CacheTTL caches responses for the configured TTL.
+	CacheTTL = "ttl"
+
+	// CacheNone never caches responses.
+	CacheNone = "none"
+
+	// CacheBucket caches responses only if the queried absolute time range
+	// ends before the most recent window. Queries touching the recent
+	// window or relative to now() bypass the cache.
+	CacheBucket = "bucket"
+)
+
+// CachePolicy defines how responses of queries of a measurement are cached.
+type CachePolicy struct {
+	// Mode is one of CacheTTL, CacheNone or CacheBucket. Defaults to
+	// CacheTTL.
+	Mode string `json:"mode"`
+
+	// TTL overrides the time to live given with -query-cache-ttl.
+	TTL duration `json:"ttl"`
+
+	// Window is the most recent time window which bypasses the cache in
+	// CacheBucket mode.
+	Window duration `json:"window"`
+}
+
+// LoadConfig reads the configuration from the JSON file at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// hosts returns the virtual hosts of all profiles.
+func (cfg *Config) hosts() []string {
+	var hosts []string
+	for _, p := range cfg.Profiles {
+		hosts = append(hosts, p.Hosts...)
+	}
+	return hosts
+}
+
+// hasSources reports whether at least one profile allows a measurement.
+func (cfg *Config) hasSources() bool {
+	if len(cfg.Measurements) > 0 {
+		return true
+	}
+	for _, p := range cfg.Profiles {
+		if len(p.Measurements) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Config) validate() error {
+	if err := cfg.Profile.validate(); err != nil {
+		return err
+	}
+	if s := cfg.Sentry; s != nil {
+		if s.DSN == "" {
+			return errors.New("sentry requires a dsn")
+		}
+		if s.BurstThreshold < 0 || s.BurstWindow < 0 {
+			return errors.New("sentry burst threshold and window must not be negative")
+		}
+	}
+	if err := cfg.Warmup.validate(); err != nil {
+		return fmt.Errorf("warmup: %w", err)
+	}
+	if cfg.AdminAuth != nil && len(cfg.AdminAuth.Users) == 0 {
+		return errors.New("admin_auth requires at least one user")
+	}
+	if g := cfg.Grafana; g != nil {
+		if g.Profile != "" && len(g.Trusted) == 0 {
+			return errors.New("grafana: profile requires trusted instances")
+		}
+		for _, t := range g.Trusted {
+			if _, err := parseNetwork(t); err != nil {
+				return fmt.Errorf("grafana: %w", err)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for _, p := range cfg.Profiles {
+		if p.Name == "" {
+			return errors.New("profile without name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Prefix == "" && len(p.Hosts) == 0 {
+			return fmt.Errorf("profile %q: neither prefix nor hosts given", p.Name)
+		}
+		if p.Backend != "" {
+			if u, err := url.Parse(p.Backend); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("profile %q: invalid backend %q", p.Name, p.Backend)
+			}
+		}
+		if p.Prefix != "" {
+			if !strings.HasPrefix(p.Prefix, "/") || strings.HasSuffix(p.Prefix, "/") {
+				return fmt.Errorf("profile %q: prefix must start and must not end with a slash", p.Name)
+			}
+			if prefixes[p.Prefix] {
+				return fmt.Errorf("profile %q: duplicate prefix %q", p.Name, p.Prefix)
+			}
+			prefixes[p.Prefix] = true
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func (w *Warmup) validate() error {
+	if w == nil {
+		return nil
+	}
+	if w.Interval <= 0 {
+		return errors.New("interval required")
+	}
+	if w.Webhook != "" {
+		if u, err := url.Parse(w.Webhook); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid webhook %q", w.Webhook)
+		}
+	}
+	if len(w.Queries) == 0 {
+		return errors.New("at least one query is required")
+	}
+	names := make(map[string]bool)
+	for _, q := range w.Queries {
+		if q.Name == "" || q.Query == "" {
+			return errors.New("queries require a name and q")
+		}
+		if names[q.Name] {
+			return fmt.Errorf("duplicate query %q", q.Name)
+		}
+		names[q.Name] = true
+	}
+	return nil
+}
+
+func (p *Profile) validate() error {
+	if p.RateLimit != nil && (p.RateLimit.Requests <= 0 || p.RateLimit.Per <= 0) {
+		return errors.New("rate limit requires requests and per")
+	}
+	if p.StatementLimit != nil && (p.StatementLimit.Statements <= 0 || p.StatementLimit.Per <= 0) {
+		return errors.New("statement limit requires statements and per")
+	}
+	if p.Auth != nil && len(p.Auth.Users) == 0 {
+		return errors.New("auth requires at least one user")
+	}
+	if sh := p.Shadow; sh != nil {
+		if u, err := url.Parse(sh.Backend); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("shadow: invalid backend %q", sh.Backend)
+		}
+		if sh.Percent <= 0 || sh.Percent > 100 {
+			return errors.New("shadow: percent must be greater than 0 and at most 100")
+		}
+		if sh.Epsilon < 0 {
+			return errors.New("shadow: epsilon must not be negative")
+		}
+	}
+	if a := p.Authorizer; a != nil {
+		if u, err := url.Parse(a.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("authorizer: invalid url %q", a.URL)
+		}
+		if a.Timeout < 0 {
+			return errors.New("authorizer: timeout must not be negative")
+		}
+	}
+	if ps := p.Params; ps != nil {
+		if ps.Epoch != "" && !validEpochs[ps.Epoch] {
+			return fmt.Errorf("params: %w: %q", ErrInvalidEpoch, ps.Epoch)
+		}
+		switch ps.EpochMode {
+		case "", EpochInject, EpochRequire:
+		case EpochForce:
+			if ps.Epoch == "" {
+				return errors.New("params: epoch mode force requires an epoch")
+			}
+		default:
+			return fmt.Errorf("params: unknown epoch mode %q", ps.EpochMode)
+		}
+	}
+	if p.MaxSeries < 0 {
+		return errors.New("max_series must not be negative")
+	}
+	if p.QueryTimeout < 0 {
+		return errors.New("query_timeout must not be negative")
+	}
+	if p.SplitStatements < 0 {
+		return errors.New("split_statements must not be negative")
+	}
+	if a := p.Access; a != nil {
+		if b := a.Bulk; b != nil && (len(b.Windows) == 0 || (b.MinRange <= 0 && b.MinStatements <= 0)) {
+			return errors.New("access: bulk requires windows and min_range or min_statements")
+		}
+		if _, err := newAccessPolicy(a); err != nil {
+			return fmt.Errorf("access: %w", err)
+		}
+	}
+	aliased := make(map[string]bool)
+	for alias, name := range p.Aliases {
+		if alias == "" || name == "" {
+			return errors.New("aliases: alias and measurement must not be empty")
+		}
+		if aliased[name] {
+			return fmt.Errorf("aliases: measurement %q has several aliases", name)
+		}
+		aliased[name] = true
+	}
+	for _, m := range p.Measurements {
+		if _, ok := p.Aliases[m.Name]; ok && !aliased[m.Name] {
+			return fmt.Errorf("aliases: alias %q hides a measurement of the same name", m.Name)
+		}
+		if _, ok := p.Tombstones[m.Name]; ok {
+			return fmt.Errorf("tombstones: measurement %q is still allowed", m.Name)
+		}
+	}
+	for name, t := range p.Tombstones {
+		if name == "" {
+			return errors.New("tombstones: measurement must not be empty")
+		}
+		if _, ok := p.Tombstones[t.Replacement]; ok {
+			return fmt.Errorf("tombstones: replacement %q of %q is deprecated too", t.Replacement, name)
+		}
+	}
+
+	slos := make(map[string]bool)
+	for _, s := range p.SLOs {
+		if !strings.HasPrefix(s.Endpoint, "/") {
+			return fmt.Errorf("slo %q: endpoint must start with a slash", s.name())
+		}
+		if s.Objective <= 0 || s.Objective >= 1 {
+			return fmt.Errorf("slo %q: objective must be between 0 and 1", s.name())
+		}
+		if s.Latency < 0 {
+			return fmt.Errorf("slo %q: negative latency", s.name())
+		}
+		key := s.Endpoint + " " + s.name()
+		if slos[key] {
+			return fmt.Errorf("duplicate slo %q for %s", s.name(), s.Endpoint)
+		}
+		slos[key] = true
+	}
+
+	for _, m := range p.Measurements {
+		if m.Name == "" {
+			return fmt.Errorf("measurement without name")
+		}
+		for _, tag := range m.ForbiddenTags {
+			if tag == "" {
+				return fmt.Errorf("measurement %q: empty forbidden tag", m.Name)
+			}
+		}
+		for _, tag := range m.GroupBy {
+			if tag == "" {
+				return fmt.Errorf("measurement %q: empty group by tag", m.Name)
+			}
+		}
+		if m.Cache == nil {
+			continue
+		}
+		switch m.Cache.Mode {
+		case "", CacheTTL, CacheNone:
+		case CacheBucket:
+			if m.Cache.Window <= 0 {
+				return fmt.Errorf("measurement %q: cache mode %q requires a window", m.Name, CacheBucket)
+			}
+		default:
+			return fmt.Errorf("measurement %q: unknown cache mode %q", m.Name, m.Cache.Mode)
+		}
+	}
+	return nil
+}
+
+// duration is a time.Duration which is represented as a string like "1h30m"
+// in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1h30m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
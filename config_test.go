@@ -0,0 +1,99 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"measurements": [
+			{"name": "m1"},
+			{"name": "m2", "cache": {"mode": "bucket", "ttl": "24h", "window": "1h"}}
+		]
+	}`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Measurements) != 2 {
+		t.Fatalf("got %d measurements, want 2", len(cfg.Measurements))
+	}
+	c := cfg.Measurements[1].Cache
+	if c == nil || c.Mode != CacheBucket || time.Duration(c.TTL) != 24*time.Hour || time.Duration(c.Window) != time.Hour {
+		t.Fatalf("unexpected cache policy: %+v", c)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	testCases := map[string]string{
+		"syntax":        `{"measurements": [`,
+		"noName":        `{"measurements": [{"cache": {"mode": "none"}}]}`,
+		"unknownMode":   `{"measurements": [{"name": "m1", "cache": {"mode": "forever"}}]}`,
+		"bucketWindow":  `{"measurements": [{"name": "m1", "cache": {"mode": "bucket"}}]}`,
+		"badDuration":   `{"measurements": [{"name": "m1", "cache": {"ttl": "soon"}}]}`,
+		"numberAsValue": `{"measurements": [{"name": "m1", "cache": {"ttl": 60}}]}`,
+		"profileNoName": `{"profiles": [{"prefix": "/open"}]}`,
+		"profileNoSel":  `{"profiles": [{"name": "open"}]}`,
+		"profileDup":    `{"profiles": [{"name": "a", "prefix": "/a"}, {"name": "a", "prefix": "/b"}]}`,
+		"prefixDup":     `{"profiles": [{"name": "a", "prefix": "/a"}, {"name": "b", "prefix": "/a"}]}`,
+		"prefixSlash":   `{"profiles": [{"name": "a", "prefix": "/a/"}]}`,
+		"rateLimit":     `{"profiles": [{"name": "a", "prefix": "/a", "rate_limit": {"requests": 10}}]}`,
+		"authNoUsers":   `{"auth": {"users": {}}}`,
+		"backend":       `{"profiles": [{"name": "a", "hosts": ["a.example.org"], "backend": "localhost"}]}`,
+		"sentryNoDSN":   `{"sentry": {"environment": "production"}}`,
+		"sloObjective":  `{"slos": [{"endpoint": "/query", "objective": 99}]}`,
+		"sloEndpoint":   `{"slos": [{"endpoint": "query", "objective": 0.99}]}`,
+		"sloDup":        `{"slos": [{"endpoint": "/query", "objective": 0.9}, {"endpoint": "/query", "objective": 0.99}]}`,
+
+		"warmupNoQueries": `{"warmup": {"interval": "1h"}}`,
+		"warmupInterval":  `{"warmup": {"queries": [{"name": "a", "q": "SELECT * FROM m"}]}}`,
+		"warmupDup":       `{"warmup": {"interval": "1h", "queries": [{"name": "a", "q": "x"}, {"name": "a", "q": "y"}]}}`,
+		"emptyGroupBy":    `{"measurements": [{"name": "m1", "group_by": [""]}]}`,
+		"maxSeries":       `{"max_series": -1}`,
+		"queryTimeout":    `{"query_timeout": "-1s"}`,
+		"authorizerURL":   `{"authorizer": {"url": "/authz"}}`,
+		"splitStatements": `{"split_statements": -1}`,
+		"aliasTwice":      `{"aliases": {"a": "m", "b": "m"}}`,
+		"aliasHides":      `{"measurements": [{"name": "a"}, {"name": "m"}], "aliases": {"a": "m"}}`,
+		"tombstoneKept":   `{"measurements": [{"name": "m"}], "tombstones": {"m": {}}}`,
+		"tombstoneChain":  `{"tombstones": {"a": {"replacement": "b"}, "b": {}}}`,
+		"accessSchedule":  `{"access": {"windows": ["* 25 * * *"]}}`,
+		"accessTimezone":  `{"access": {"timezone": "Europe/Nowhere", "windows": ["* * * * *"]}}`,
+		"accessBulk":      `{"access": {"bulk": {"windows": ["* 0-6 * * *"]}}}`,
+		"statementLimit":  `{"statement_limit": {"statements": 100}}`,
+		"grafanaTrusted":  `{"grafana": {"profile": "grafana"}}`,
+		"grafanaNetwork":  `{"grafana": {"trusted": ["10.0.0.0/33"]}}`,
+		"adminAuth":       `{"admin_auth": {"users": {}}}`,
+		"epoch":           `{"params": {"epoch": "us"}}`,
+		"epochMode":       `{"params": {"epoch": "ms", "epoch_mode": "always"}}`,
+		"epochForce":      `{"params": {"epoch_mode": "force"}}`,
+		"shadowBackend":   `{"shadow": {"backend": "localhost", "percent": 10}}`,
+		"shadowPercent":   `{"shadow": {"backend": "http://localhost:8087", "percent": 0}}`,
+	}
+
+	for name, content := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadConfig(writeConfig(t, content)); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/influxdata/influxql"
+)
+
+// ErrDatabaseNotAllowed is returned if a query uses a database which is not
+// exposed by the profile.
+var ErrDatabaseNotAllowed = errors.New("database not allowed")
+
+// rewriteDatabases maps the public database names used by the db parameter
+// of r and by the fully qualified sources of q to the backend databases of
+// the profile and updates r accordingly. If the profile has no database
+// mapping nothing is changed.
+func (prof *profile) rewriteDatabases(r *http.Request, q *influxql.Query) error {
+	if prof.databases == nil {
+		return nil
+	}
+
+	params := r.URL.Query()
+	if db := params.Get("db"); db != "" {
+		actual, ok := prof.databases[db]
+		if !ok {
+			return ErrDatabaseNotAllowed
+		}
+		params.Set("db", actual)
+	}
+
+	var err error
+	rewrite := func(db *string) {
+		if *db == "" {
+			return
+		}
+		actual, ok := prof.databases[*db]
+		if !ok {
+			err = ErrDatabaseNotAllowed
+			return
+		}
+		*db = actual
+	}
+	influxql.WalkFunc(q, func(n influxql.Node) {
+		switch n := n.(type) {
+		case *influxql.Measurement:
+			rewrite(&n.Database)
+		case *influxql.ShowTagValuesStatement:
+			rewrite(&n.Database)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	params.Set("q", q.String())
+	r.URL.RawQuery = params.Encode()
+	return nil
+}
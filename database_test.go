@@ -0,0 +1,92 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRewriteDatabases(t *testing.T) {
+	prof := newProfile(Profile{
+		Databases: map[string]string{"public": "actual", "other": "backend2"},
+	}, false)
+
+	testCases := map[string]struct {
+		db, query string
+		wantDB    string
+		wantQuery string
+		err       error
+	}{
+		"param": {
+			db: "public", query: "SELECT a FROM m1",
+			wantDB: "actual", wantQuery: "SELECT a FROM m1",
+		},
+		"noParam": {
+			query:     "SELECT a FROM public.autogen.m1",
+			wantQuery: "SELECT a FROM actual.autogen.m1",
+		},
+		"defaultRetention": {
+			db: "other", query: "SELECT a FROM public..m1",
+			wantDB: "backend2", wantQuery: "SELECT a FROM actual..m1",
+		},
+		"subquery": {
+			db: "public", query: "SELECT max(a) FROM (SELECT a FROM other.rp.m1)",
+			wantDB: "actual", wantQuery: "SELECT max(a) FROM (SELECT a FROM backend2.rp.m1)",
+		},
+		"showTagValues": {
+			query:     `SHOW TAG VALUES ON public FROM m1 WITH KEY = station`,
+			wantQuery: `SHOW TAG VALUES ON actual FROM m1 WITH KEY = station`,
+		},
+		"unknownParam": {
+			db: "actual", query: "SELECT a FROM m1",
+			err: ErrDatabaseNotAllowed,
+		},
+		"unknownSource": {
+			db: "public", query: "SELECT a FROM actual.autogen.m1",
+			err: ErrDatabaseNotAllowed,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			params := url.Values{"q": {tc.query}}
+			if tc.db != "" {
+				params.Set("db", tc.db)
+			}
+			r := httptest.NewRequest("GET", "/query?"+params.Encode(), nil)
+
+			err := prof.rewriteDatabases(r, mustParseQuery(t, tc.query))
+			if err != tc.err {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+
+			got := r.URL.Query()
+			if got.Get("db") != tc.wantDB {
+				t.Fatalf("got db %q, want %q", got.Get("db"), tc.wantDB)
+			}
+			if got.Get("q") != tc.wantQuery {
+				t.Fatalf("got query %q, want %q", got.Get("q"), tc.wantQuery)
+			}
+		})
+	}
+}
+
+func TestRewriteDatabasesUnmapped(t *testing.T) {
+	prof := newProfile(Profile{}, false)
+
+	r := httptest.NewRequest("GET", "/query?db=mydb&q=SELECT+a+FROM+mydb..m1", nil)
+	raw := r.URL.RawQuery
+	if err := prof.rewriteDatabases(r, mustParseQuery(t, "SELECT a FROM mydb..m1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.URL.RawQuery != raw {
+		t.Fatalf("request modified: got %q, want %q", r.URL.RawQuery, raw)
+	}
+}
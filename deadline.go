@@ -0,0 +1,38 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrQueryTimeout is returned if a query does not complete within the query
+// timeout of the profile.
+var ErrQueryTimeout = errors.New("query timed out")
+
+// withDeadline returns r with the query timeout of the profile applied to
+// its context. The context is cancelled as well if the client disconnects,
+// which makes InfluxDB kill the query.
+func (prof *profile) withDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	if prof.queryTimeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), prof.queryTimeout)
+	return r.WithContext(ctx), cancel
+}
+
+// countCancelled accounts a query forwarded with ctx as cancelled if the
+// client disconnected or the deadline of ctx passed. client is the context
+// of the client request.
+func countCancelled(prof *profile, client, ctx context.Context) {
+	switch {
+	case client.Err() != nil:
+		cancelledQueries.Inc(prof.name, "client")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		cancelledQueries.Inc(prof.name, "deadline")
+	}
+}
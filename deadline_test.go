@@ -0,0 +1,107 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// counterValue returns the value of the series of c with the label values.
+func counterValue(c *counterVec, labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// blockingBackend returns a backend answering queries only once they are
+// cancelled, which is reported on the returned channel.
+func blockingBackend(t *testing.T) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	cancelled := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend, cancelled
+}
+
+func TestQueryTimeout(t *testing.T) {
+	backend, cancelled := blockingBackend(t)
+	cfg := sourcesConfig()
+	cfg.Profiles = []Profile{{Name: "timeout", Prefix: "/timeout", Measurements: []Measurement{{Name: "m1"}}, QueryTimeout: duration(50 * time.Millisecond)}}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := counterValue(cancelledQueries, "timeout", "deadline")
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/timeout/query?q=SELECT+*+FROM+m1", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	var resp struct{ Error string }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Error != ErrQueryTimeout.Error() {
+		t.Fatalf("got error %q (%v), want %q", resp.Error, err, ErrQueryTimeout)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("query not cancelled at the backend")
+	}
+	if got := counterValue(cancelledQueries, "timeout", "deadline"); got != before+1 {
+		t.Fatalf("got %v cancelled queries, want %v", got, before+1)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	backend, cancelled := blockingBackend(t)
+	p, err := NewProxy(backend.URL, sourcesConfig("m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	before := counterValue(cancelledQueries, defaultProfileName, "client")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/query?q=SELECT+*+FROM+m1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the request to be cancelled")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("query not cancelled at the backend")
+	}
+	// The proxy accounts the query once its handler returned.
+	deadline := time.Now().Add(time.Second)
+	for counterValue(cancelledQueries, defaultProfileName, "client") != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled query not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,804 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// Export errors.
+var (
+	ErrExportDisabled    = errors.New("exports are not enabled")
+	ErrExportUnsupported = errors.New("export requires a single SELECT statement without LIMIT, OFFSET or aggregates outside of GROUP BY time()")
+	ErrExportTimeRange   = errors.New("export requires a time range with start and end, e.g. WHERE time >= '2019-01-01' AND time < '2020-01-01'")
+	ErrExportFormat      = errors.New("export format must be csv or lp")
+	ErrExportChunk       = errors.New("invalid export chunk duration")
+	ErrExportQueueFull   = errors.New("too many pending exports, try again later")
+	ErrExportNotFound    = errors.New("export not found")
+	ErrExportNotFinished = errors.New("export not finished")
+)
+
+// Export settings.
+const (
+	exportWorkers      = 2
+	exportQueueSize    = 100
+	maxExportChunks    = 100000
+	defaultExportChunk = 24 * time.Hour
+
+	// defaultExportTimeout is the deadline of the backend queries of a
+	// chunk, unless the profile has a query timeout.
+	defaultExportTimeout = 10 * time.Minute
+)
+
+// Export job states.
+const (
+	exportQueued  = "queued"
+	exportRunning = "running"
+	exportDone    = "done"
+	exportFailed  = "failed"
+)
+
+// exporter runs export jobs in the background. A job runs a query in chunks
+// of time against the backend and writes the results to a file in dir, which
+// the client downloads once the job is done. Jobs and their files are
+// removed ttl after they finished.
+type exporter struct {
+	dir    string
+	ttl    time.Duration
+	client *http.Client
+	queue  chan *exportJob
+
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+}
+
+// exportJob is an export of a single SELECT statement. The exported fields
+// form the job status, they are guarded by exporter.mu.
+type exportJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Format     string     `json:"format"`
+	Query      string     `json:"query"`
+	Chunks     int        `json:"chunks"`
+	ChunksDone int        `json:"chunks_done"`
+	Rows       int64      `json:"rows"`
+	Error      string     `json:"error,omitempty"`
+	Created    time.Time  `json:"created"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Download   string     `json:"download,omitempty"`
+
+	profile string // name of the profile the job was created by.
+	user    string // authenticated user, if any.
+	prefix  string
+	backend string
+	auth    string        // Authorization header forwarded to the backend.
+	timeout time.Duration // deadline of the backend queries.
+	params  url.Values    // backend query parameters besides q.
+	stmt    *influxql.SelectStatement
+	rename  func(string) string // public name of a measurement, see profile.publicName.
+	policy  func() *policy      // current policy, by which the job is checked before each chunk.
+	ranges  []exportRange
+	file    string
+}
+
+// exportRange is the time range [start, end) of a chunk.
+type exportRange struct{ start, end time.Time }
+
+// newExporter returns an exporter storing files in dir. Files of previous
+// runs are removed, as their jobs are lost.
+func newExporter(dir string, ttl time.Duration) (*exporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "export-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range old {
+		os.Remove(f)
+	}
+
+	e := &exporter{
+		dir:    dir,
+		ttl:    ttl,
+		client: &http.Client{},
+		queue:  make(chan *exportJob, exportQueueSize),
+		jobs:   make(map[string]*exportJob),
+	}
+	for i := 0; i < exportWorkers; i++ {
+		go e.work()
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			e.expire(now)
+		}
+	}()
+	return e, nil
+}
+
+// startExport validates the export request r of the allowed query and
+// enqueues the job.
+func (p *Proxy) startExport(w http.ResponseWriter, r *http.Request, prof *profile, user string, query *influxql.Query) {
+	params := r.URL.Query()
+	job, err := newExportJob(query, params, time.Now())
+	if err != nil {
+		reportError(w, err, http.StatusBadRequest)
+		return
+	}
+	job.profile, job.user, job.prefix, job.backend = prof.name, user, prof.prefix, prof.backend
+	job.rename, job.policy = prof.publicName, p.policy
+	// The status shows the query with the aliases the client used.
+	public := job.stmt.Clone()
+	influxql.WalkFunc(public, func(n influxql.Node) {
+		if m, ok := n.(*influxql.Measurement); ok && m.Regex == nil {
+			m.Name = prof.publicName(m.Name)
+		}
+	})
+	job.Query = public.String()
+	// Credentials are passed on like for queries, unless the profile
+	// authenticated the client itself and removed them.
+	job.auth, job.timeout = r.Header.Get("Authorization"), defaultExportTimeout
+	if prof.queryTimeout > 0 {
+		job.timeout = prof.queryTimeout
+	}
+
+	if err := p.exports.enqueue(job); err != nil {
+		reportError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	exportLog.Info("export queued", "id", job.ID, "profile", prof.name, "client", clientID(r, user), "chunks", len(job.ranges))
+
+	w.Header().Set("Location", job.prefix+"/export/"+job.ID)
+	p.exports.writeStatus(w, job, http.StatusAccepted)
+}
+
+// newExportJob returns a job exporting query with the given request
+// parameters.
+func newExportJob(query *influxql.Query, params url.Values, now time.Time) (*exportJob, error) {
+	if len(query.Statements) != 1 {
+		return nil, ErrExportUnsupported
+	}
+	stmt, ok := query.Statements[0].(*influxql.SelectStatement)
+	if !ok || stmt.Target != nil || stmt.Limit > 0 || stmt.Offset > 0 || stmt.SLimit > 0 || stmt.SOffset > 0 {
+		return nil, ErrExportUnsupported
+	}
+
+	format := params.Get("format")
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "lp":
+	default:
+		return nil, ErrExportFormat
+	}
+
+	chunk := defaultExportChunk
+	if s := params.Get("chunk"); s != "" {
+		var err error
+		chunk, err = time.ParseDuration(s)
+		if err != nil || chunk < time.Minute {
+			return nil, ErrExportChunk
+		}
+	}
+
+	// Aggregates are only correct if no GROUP BY time() interval is split
+	// between chunks.
+	var offset time.Duration
+	if !stmt.IsRawQuery {
+		interval, err := stmt.GroupByInterval()
+		if err != nil || interval == 0 {
+			return nil, ErrExportUnsupported
+		}
+		if chunk%interval != 0 {
+			return nil, fmt.Errorf("%w: chunk must be a multiple of the GROUP BY time() interval", ErrExportChunk)
+		}
+		offset, err = stmt.GroupByOffset()
+		if err != nil {
+			return nil, ErrExportUnsupported
+		}
+	}
+
+	_, tr, err := influxql.ConditionExpr(stmt.Condition, &influxql.NowValuer{Now: now})
+	if err != nil {
+		return nil, err
+	}
+	if tr.Min.IsZero() || tr.Max.IsZero() {
+		return nil, ErrExportTimeRange
+	}
+	ranges, err := exportRanges(tr.Min, tr.Max.Add(time.Nanosecond), chunk, offset)
+	if err != nil {
+		return nil, err
+	}
+	if !stmt.TimeAscending() {
+		for i, j := 0, len(ranges)-1; i < j; i, j = i+1, j-1 {
+			ranges[i], ranges[j] = ranges[j], ranges[i]
+		}
+	}
+
+	backendParams := make(url.Values)
+	for _, k := range []string{"db", "rp", "u", "p"} {
+		if v := params.Get(k); v != "" {
+			backendParams.Set(k, v)
+		}
+	}
+	backendParams.Set("chunked", "true")
+	if format == "lp" {
+		backendParams.Set("epoch", "ns")
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	return &exportJob{
+		ID:      hex.EncodeToString(id[:]),
+		Status:  exportQueued,
+		Format:  format,
+		Query:   stmt.String(),
+		Chunks:  len(ranges),
+		Created: now,
+		params:  backendParams,
+		stmt:    stmt,
+		ranges:  ranges,
+	}, nil
+}
+
+// exportRanges splits [start, end) into chunks. The boundaries between chunks
+// are multiples of chunk since the epoch plus offset, so that they align with
+// GROUP BY time() intervals dividing chunk.
+func exportRanges(start, end time.Time, chunk, offset time.Duration) ([]exportRange, error) {
+	var ranges []exportRange
+	base := time.Unix(0, 0).Add(offset)
+	for t := start; t.Before(end); {
+		m := t.Sub(base) % chunk
+		if m < 0 {
+			m += chunk
+		}
+		next := t.Add(chunk - m)
+		if next.After(end) {
+			next = end
+		}
+		ranges = append(ranges, exportRange{t, next})
+		if len(ranges) > maxExportChunks {
+			return nil, fmt.Errorf("%w: more than %d chunks", ErrExportChunk, maxExportChunks)
+		}
+		t = next
+	}
+	return ranges, nil
+}
+
+func (e *exporter) enqueue(job *exportJob) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	select {
+	case e.queue <- job:
+		e.jobs[job.ID] = job
+		return nil
+	default:
+		return ErrExportQueueFull
+	}
+}
+
+func (e *exporter) work() {
+	for job := range e.queue {
+		e.update(job, func() { job.Status = exportRunning })
+		err := e.run(job)
+		e.update(job, func() {
+			now := time.Now()
+			job.Finished = &now
+			job.Status = exportDone
+			if err != nil {
+				job.Status = exportFailed
+				job.Error = err.Error()
+			}
+		})
+		if err != nil {
+			exportLog.Warn("export failed", "id", job.ID, "profile", job.profile, "err", err)
+			continue
+		}
+		exportLog.Info("export done", "id", job.ID, "profile", job.profile, "rows", job.Rows)
+	}
+}
+
+// update calls fn with the lock held, so fn may modify the job status.
+func (e *exporter) update(job *exportJob, fn func()) {
+	e.mu.Lock()
+	fn()
+	e.mu.Unlock()
+}
+
+// run exports all chunks of job to its file.
+func (e *exporter) run(job *exportJob) error {
+	name := filepath.Join(e.dir, "export-"+job.ID+"."+job.Format)
+	f, err := ioutil.TempFile(e.dir, "export-"+job.ID+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	bw := bufio.NewWriter(f)
+	var w exportWriter
+	if job.Format == "csv" {
+		w = &csvWriter{w: csv.NewWriter(bw)}
+	} else {
+		// JSON does not tell integers from floats without fraction, nor
+		// tags from string fields.
+		types, err := e.fieldTypes(job)
+		if err != nil {
+			return err
+		}
+		tags, err := e.tagKeys(job)
+		if err != nil {
+			return err
+		}
+		w = &lineProtocolWriter{w: bw, types: types, tags: tags}
+	}
+
+	for _, rng := range job.ranges {
+		n, err := e.exportChunk(job, rng, w)
+		if err != nil {
+			return err
+		}
+		e.update(job, func() {
+			job.ChunksDone++
+			job.Rows += n
+		})
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	e.update(job, func() { job.file = name })
+	return nil
+}
+
+// exportChunk queries the backend for the time range rng of job and writes
+// the rows to w, with the series of aliased measurements renamed to their
+// aliases. It returns the number of rows written. As jobs run for long, the
+// current policy is checked before each chunk.
+func (e *exporter) exportChunk(job *exportJob, rng exportRange, w exportWriter) (int64, error) {
+	if err := job.check(time.Now()); err != nil {
+		return 0, err
+	}
+	stmt := job.stmt.Clone()
+	if err := stmt.SetTimeRange(rng.start, rng.end); err != nil {
+		return 0, err
+	}
+
+	var rows int64
+	err := e.query(job, stmt, func(s *influxSeries) error {
+		s.Name = job.rename(s.Name)
+		n, err := w.write(s)
+		rows += n
+		return err
+	})
+	return rows, err
+}
+
+// check returns an error if the current version of the profile of job no
+// longer allows the export at now, because the profile was removed, a
+// measurement is no longer allowed or it is outside of the access windows.
+func (job *exportJob) check(now time.Time) error {
+	prof := job.policy().profile(job.profile)
+	if prof == nil {
+		return fmt.Errorf("%w: profile %q was removed", ErrQueryNotAllowed, job.profile)
+	}
+	for _, m := range job.stmt.Sources.Measurements() {
+		if !prof.allows(prof.publicName(m.Name)) {
+			return fmt.Errorf("%w: measurement %q", ErrQueryNotAllowed, job.rename(m.Name))
+		}
+	}
+	return prof.checkAccess(&influxql.Query{Statements: influxql.Statements{job.stmt}}, now)
+}
+
+// fieldTypes returns the types of the fields by public name of the
+// measurements exported by job, as reported by SHOW FIELD KEYS.
+func (e *exporter) fieldTypes(job *exportJob) (map[string]map[string]string, error) {
+	sources := job.measurements()
+	types := make(map[string]map[string]string)
+	if len(sources) == 0 {
+		return types, nil
+	}
+
+	err := e.query(job, &influxql.ShowFieldKeysStatement{Sources: sources}, func(s *influxSeries) error {
+		s.Name = job.rename(s.Name)
+		if types[s.Name] == nil {
+			types[s.Name] = make(map[string]string)
+		}
+		for _, row := range s.Values {
+			if len(row) < 2 {
+				continue
+			}
+			key, _ := row[0].(string)
+			typ, _ := row[1].(string)
+			types[s.Name][key] = typ
+		}
+		return nil
+	})
+	return types, err
+}
+
+// tagKeys returns the tag keys by public name of the measurements exported
+// by job, as reported by SHOW TAG KEYS.
+func (e *exporter) tagKeys(job *exportJob) (map[string]map[string]bool, error) {
+	keys := make(map[string]map[string]bool)
+	sources := job.measurements()
+	if len(sources) == 0 {
+		return keys, nil
+	}
+
+	err := e.query(job, &influxql.ShowTagKeysStatement{Sources: sources}, func(s *influxSeries) error {
+		s.Name = job.rename(s.Name)
+		if keys[s.Name] == nil {
+			keys[s.Name] = make(map[string]bool)
+		}
+		for _, row := range s.Values {
+			if len(row) < 1 {
+				continue
+			}
+			if key, ok := row[0].(string); ok {
+				keys[s.Name][key] = true
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// measurements returns the measurements among the sources of job.
+func (job *exportJob) measurements() influxql.Sources {
+	var sources influxql.Sources
+	for _, src := range job.stmt.Sources {
+		if m, ok := src.(*influxql.Measurement); ok {
+			sources = append(sources, m)
+		}
+	}
+	return sources
+}
+
+// query runs stmt against the backend of job with the parameters and
+// credentials of the job and calls fn for every series of the response.
+func (e *exporter) query(job *exportJob, stmt influxql.Statement, fn func(s *influxSeries) error) error {
+	u, err := url.Parse(job.backend)
+	if err != nil {
+		return err
+	}
+	params := u.Query()
+	for k, v := range job.params {
+		params[k] = v
+	}
+	params.Set("q", stmt.String())
+	u.Path, u.RawQuery = "/query", params.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), job.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if job.auth != "" {
+		req.Header.Set("Authorization", job.auth)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("backend responded with %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	// Chunked responses are a sequence of JSON objects.
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	for {
+		var r influxResponse
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if r.Err != "" {
+			return errors.New(r.Err)
+		}
+		for _, res := range r.Results {
+			if res.Err != "" {
+				return errors.New(res.Err)
+			}
+			for i := range res.Series {
+				if err := fn(&res.Series[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// job returns the job with the given id if it was created by the profile and
+// user.
+func (e *exporter) job(id string, prof *profile, user string) (*exportJob, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok || job.profile != prof.name || job.user != user {
+		return nil, false
+	}
+	return job, true
+}
+
+// writeStatus writes the status of job as JSON with the given code.
+func (e *exporter) writeStatus(w http.ResponseWriter, job *exportJob, code int) {
+	e.mu.Lock()
+	status := *job
+	e.mu.Unlock()
+	if status.Status == exportDone {
+		status.Download = job.prefix + "/export/" + job.ID + "/download"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&status)
+}
+
+// expire removes jobs which finished more than ttl before now.
+func (e *exporter) expire(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for id, job := range e.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > e.ttl {
+			if job.file != "" {
+				os.Remove(job.file)
+			}
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// serveExport serves the status of the export job id, or its file if path
+// ends with /download.
+func (p *Proxy) serveExport(w http.ResponseWriter, r *http.Request, prof *profile, path string) {
+	user, err := prof.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="InfluxDB"`)
+		reportError(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimSuffix(path, "/download")
+	job, ok := p.exports.job(id, prof, user)
+	if !ok {
+		reportError(w, ErrExportNotFound, http.StatusNotFound)
+		return
+	}
+	if id == path {
+		p.exports.writeStatus(w, job, http.StatusOK)
+		return
+	}
+
+	p.exports.mu.Lock()
+	status, file := job.Status, job.file
+	p.exports.mu.Unlock()
+	if status != exportDone {
+		reportError(w, ErrExportNotFinished, http.StatusConflict)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		reportError(w, ErrExportNotFound, http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		reportError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if job.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(file)))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// exportWriter writes the rows of series in an export format.
+type exportWriter interface {
+	write(s *influxSeries) (rows int64, err error)
+	flush() error
+}
+
+// csvWriter writes series as CSV, like the InfluxDB CLI does. Each row starts
+// with the measurement name and the tags of the series. A header is written
+// whenever the columns change.
+type csvWriter struct {
+	w       *csv.Writer
+	columns []string
+}
+
+func (cw *csvWriter) write(s *influxSeries) (int64, error) {
+	if !equalStrings(cw.columns, s.Columns) {
+		cw.columns = s.Columns
+		if err := cw.w.Write(append([]string{"name", "tags"}, s.Columns...)); err != nil {
+			return 0, err
+		}
+	}
+
+	tags := formatTags(s.Tags, func(s string) string { return s })
+	record := make([]string, 2+len(s.Columns))
+	for _, row := range s.Values {
+		record[0], record[1] = s.Name, tags
+		for i := range s.Columns {
+			record[2+i] = ""
+			if i < len(row) && row[i] != nil {
+				record[2+i] = fmt.Sprint(row[i])
+			}
+		}
+		if err := cw.w.Write(record); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(s.Values)), nil
+}
+
+func (cw *csvWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// lineProtocolWriter writes series in the InfluxDB line protocol. The tags of
+// the series and the columns which are tag keys according to tags, the tag
+// keys by measurement, become tags. All other columns except time become
+// fields. Rows without fields are skipped. Integer fields keep their type
+// according to types, the field types by measurement.
+type lineProtocolWriter struct {
+	w     *bufio.Writer
+	types map[string]map[string]string
+	tags  map[string]map[string]bool
+}
+
+var (
+	lpNameEscaper  = strings.NewReplacer(",", `\,`, " ", `\ `)
+	lpKeyEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	lpValueEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+func (lw *lineProtocolWriter) write(s *influxSeries) (int64, error) {
+	name := lpNameEscaper.Replace(s.Name)
+	types, tagKeys := lw.types[s.Name], lw.tags[s.Name]
+	tagColumns := false
+	isTag := func(c string) bool {
+		// Fields take precedence over tags of the same name, as in
+		// InfluxDB.
+		return tagKeys[c] && types[c] == ""
+	}
+	for _, c := range s.Columns {
+		tagColumns = tagColumns || isTag(c)
+	}
+
+	var rows int64
+	for _, row := range s.Values {
+		tags := s.Tags
+		if tagColumns {
+			tags = make(map[string]string, len(s.Tags)+len(s.Columns))
+			for k, v := range s.Tags {
+				tags[k] = v
+			}
+		}
+		var fields []string
+		var ts string
+		for i, c := range s.Columns {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			if c == "time" {
+				ts = fmt.Sprint(row[i])
+				continue
+			}
+			if isTag(c) {
+				// Line protocol has no empty tag values.
+				if v, ok := row[i].(string); ok && v != "" {
+					tags[c] = v
+				}
+				continue
+			}
+			v := fmt.Sprint(row[i])
+			if str, ok := row[i].(string); ok {
+				v = `"` + lpValueEscaper.Replace(str) + `"`
+			} else if _, ok := row[i].(json.Number); ok {
+				switch types[c] {
+				case "integer":
+					v += "i"
+				case "unsigned":
+					v += "u"
+				}
+			}
+			fields = append(fields, lpKeyEscaper.Replace(c)+"="+v)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		line := name
+		if len(tags) > 0 {
+			line += "," + formatTags(tags, lpKeyEscaper.Replace)
+		}
+		line += " " + strings.Join(fields, ",")
+		if ts != "" {
+			line += " " + ts
+		}
+		if _, err := lw.w.WriteString(line + "\n"); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	return rows, nil
+}
+
+func (lw *lineProtocolWriter) flush() error { return nil }
+
+// formatTags formats tags sorted by key as k1=v1,k2=v2, escaping keys and
+// values with esc.
+func formatTags(tags map[string]string, esc func(string) string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = esc(k) + "=" + esc(tags[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,409 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+func TestExportRanges(t *testing.T) {
+	day := 24 * time.Hour
+	date := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	testCases := map[string]struct {
+		start, end    string
+		chunk, offset time.Duration
+		want          []string
+	}{
+		"aligned": {
+			"2020-01-01T00:00:00Z", "2020-01-03T00:00:00Z", day, 0,
+			[]string{"2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z", "2020-01-03T00:00:00Z"},
+		},
+		"unaligned": {
+			"2020-01-01T12:00:00Z", "2020-01-02T06:00:00Z", day, 0,
+			[]string{"2020-01-01T12:00:00Z", "2020-01-02T00:00:00Z", "2020-01-02T06:00:00Z"},
+		},
+		"offset": {
+			"2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z", day, time.Hour,
+			[]string{"2020-01-01T00:00:00Z", "2020-01-01T01:00:00Z", "2020-01-02T00:00:00Z"},
+		},
+		"beforeEpoch": {
+			"1969-12-30T12:00:00Z", "1969-12-31T12:00:00Z", day, 0,
+			[]string{"1969-12-30T12:00:00Z", "1969-12-31T00:00:00Z", "1969-12-31T12:00:00Z"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ranges, err := exportRanges(date(tc.start), date(tc.end), tc.chunk, tc.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, r := range ranges {
+				if i == 0 {
+					got = append(got, r.start.UTC().Format(time.RFC3339))
+				} else if !r.start.Equal(ranges[i-1].end) {
+					t.Fatalf("gap between %v and %v", ranges[i-1], r)
+				}
+				got = append(got, r.end.UTC().Format(time.RFC3339))
+			}
+			if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewExportJob(t *testing.T) {
+	const timeRange = "time >= '2020-01-01T00:00:00Z' AND time < '2020-01-03T00:00:00Z'"
+
+	testCases := map[string]struct {
+		q      string
+		params string
+		chunks int
+		err    error
+	}{
+		"raw":            {"SELECT * FROM m WHERE " + timeRange, "", 2, nil},
+		"chunk":          {"SELECT * FROM m WHERE " + timeRange, "chunk=1h", 48, nil},
+		"groupByTime":    {"SELECT mean(v) FROM m WHERE " + timeRange + " GROUP BY time(1h)", "", 2, nil},
+		"lp":             {"SELECT * FROM m WHERE " + timeRange, "format=lp", 2, nil},
+		"noEnd":          {"SELECT * FROM m WHERE time >= '2020-01-01T00:00:00Z'", "", 0, ErrExportTimeRange},
+		"noRange":        {"SELECT * FROM m", "", 0, ErrExportTimeRange},
+		"limit":          {"SELECT * FROM m WHERE " + timeRange + " LIMIT 10", "", 0, ErrExportUnsupported},
+		"aggregate":      {"SELECT mean(v) FROM m WHERE " + timeRange, "", 0, ErrExportUnsupported},
+		"multiple":       {"SELECT * FROM m WHERE " + timeRange + "; SELECT * FROM m WHERE " + timeRange, "", 0, ErrExportUnsupported},
+		"chunkInterval":  {"SELECT mean(v) FROM m WHERE " + timeRange + " GROUP BY time(7h)", "", 0, ErrExportChunk},
+		"chunkTooSmall":  {"SELECT * FROM m WHERE " + timeRange, "chunk=1s", 0, ErrExportChunk},
+		"unknownFormat":  {"SELECT * FROM m WHERE " + timeRange, "format=xlsx", 0, ErrExportFormat},
+		"tooManyChunks":  {"SELECT * FROM m WHERE time >= '1900-01-01T00:00:00Z' AND time < '2100-01-01T00:00:00Z'", "chunk=1m", 0, ErrExportChunk},
+		"showTagValues":  {"SHOW TAG VALUES FROM m WITH KEY = k", "", 0, ErrExportUnsupported},
+		"descendingTime": {"SELECT * FROM m WHERE " + timeRange + " ORDER BY time DESC", "", 2, nil},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			params, _ := url.ParseQuery(tc.params)
+			job, err := newExportJob(mustParseQuery(t, tc.q), params, time.Now())
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if job.Chunks != tc.chunks {
+				t.Fatalf("got %d chunks, want %d", job.Chunks, tc.chunks)
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	// The backend returns one row at the start of each queried range.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := influxql.ParseStatement(r.URL.Query().Get("q"))
+		if err != nil {
+			t.Errorf("backend: %v", err)
+			return
+		}
+		if r.URL.Query().Get("db") != "db0" || r.URL.Query().Get("chunked") != "true" {
+			t.Errorf("backend: unexpected parameters %v", r.URL.Query())
+		}
+		if u, p, _ := r.BasicAuth(); u != "reader" || p != "secret" {
+			t.Errorf("backend: got credentials %q:%q, want the ones of the client", u, p)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch q.(type) {
+		case *influxql.ShowFieldKeysStatement:
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"m","columns":["fieldKey","fieldType"],"values":[["v","float"],["n","integer"],["s","string"]]}]}]}`)
+			return
+		case *influxql.ShowTagKeysStatement:
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"m","columns":["tagKey"],"values":[["station"],["sensor"]]}]}]}`)
+			return
+		}
+		_, tr, _ := influxql.ConditionExpr(q.(*influxql.SelectStatement).Condition, nil)
+		ts := tr.Min.UTC().Format(time.RFC3339)
+		if r.URL.Query().Get("epoch") == "ns" {
+			ts = fmt.Sprint(tr.Min.UnixNano())
+		}
+		// Tags not grouped by are columns.
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"station":"s 1"},"columns":["time","v","n","s","sensor"],"values":[[%q,2,3,"a\"b","t"]]}]}]}`, ts)
+	}))
+	defer backend.Close()
+
+	p, err := NewProxy(backend.URL, sourcesConfig("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.exports, err = newExporter(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(format string) string {
+		form := url.Values{
+			"db":     {"db0"},
+			"q":      {"SELECT v, n, s, sensor FROM m WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-01-03T00:00:00Z' GROUP BY station"},
+			"format": {format},
+		}
+		status, body := runExport(t, p, form)
+		if status.Status != exportDone || status.Rows != 2 || status.ChunksDone != 2 {
+			t.Fatalf("got status %+v, want done with 2 rows in 2 chunks", status)
+		}
+		return body
+	}
+
+	wantCSV := `name,tags,time,v,n,s,sensor
+m,station=s 1,2020-01-01T00:00:00Z,2,3,"a""b",t
+m,station=s 1,2020-01-02T00:00:00Z,2,3,"a""b",t
+`
+	if got := run("csv"); got != wantCSV {
+		t.Fatalf("got CSV:\n%s\nwant:\n%s", got, wantCSV)
+	}
+
+	// The float v without fraction stays a float, the integer n keeps its
+	// type and the tag sensor stays a tag.
+	wantLP := `m,sensor=t,station=s\ 1 v=2,n=3i,s="a\"b" 1577836800000000000
+m,sensor=t,station=s\ 1 v=2,n=3i,s="a\"b" 1577923200000000000
+`
+	if got := run("lp"); got != wantLP {
+		t.Fatalf("got line protocol:\n%s\nwant:\n%s", got, wantLP)
+	}
+}
+
+// runExport starts an export of form as the client reader and returns the
+// final status of the job and the exported file.
+func runExport(t *testing.T, p *Proxy, form url.Values) (*exportJob, string) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/export", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("reader", "secret")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST /export: got status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	location := w.Header().Get("Location")
+
+	status := new(exportJob)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		w = httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", location, nil))
+		if err := json.NewDecoder(w.Body).Decode(status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Status == exportDone || status.Status == exportFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("export not finished: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Status != exportDone {
+		return status, ""
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", status.Download, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	return status, w.Body.String()
+}
+
+func TestExportAlias(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		if strings.Contains(q, "airtemp") {
+			t.Errorf("backend: got query %q with alias", q)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(q, "SHOW FIELD KEYS") {
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"lt_air","columns":["fieldKey","fieldType"],"values":[["n","integer"]]}]}]}`)
+			return
+		}
+		if strings.HasPrefix(q, "SHOW TAG KEYS") {
+			fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"lt_air","columns":["time","n"],"values":[[1577836800000000000,3]]}]}]}`)
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("lt_air")
+	cfg.Aliases = map[string]string{"airtemp": "lt_air"}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.exports, err = newExporter(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"q":      {"SELECT n FROM airtemp WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-01-02T00:00:00Z'"},
+		"format": {"lp"},
+	}
+	status, got := runExport(t, p, form)
+	if want := "airtemp n=3i 1577836800000000000\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if strings.Contains(status.Query, "lt_air") {
+		t.Fatalf("got query %q of status, want alias", status.Query)
+	}
+
+	form.Set("format", "csv")
+	if _, got := runExport(t, p, form); !strings.HasPrefix(got, "name,tags,time,n\nairtemp,") {
+		t.Fatalf("got CSV %q, want series renamed to airtemp", got)
+	}
+}
+
+func TestExportAccess(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	cfg := sourcesConfig("m")
+	cfg.Profiles = []Profile{{Name: "other", Prefix: "/other", Measurements: []Measurement{{Name: "m"}}}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/export?q=SELECT+*+FROM+m", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Fatalf("disabled: got status %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+
+	p.exports, err = newExporter(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		method, url string
+		code        int
+	}{
+		"get":        {"GET", "/export?q=SELECT+*+FROM+m", http.StatusMethodNotAllowed},
+		"notAllowed": {"POST", "/export?q=SELECT+*+FROM+x", http.StatusNotAcceptable},
+		"noRange":    {"POST", "/export?q=SELECT+*+FROM+m", http.StatusBadRequest},
+		"unknownJob": {"GET", "/export/0123", http.StatusNotFound},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+		})
+	}
+
+	// Jobs are only visible to the profile which created them.
+	q := url.QueryEscape("SELECT * FROM m WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-01-02T00:00:00Z'")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/export?q="+q, nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	location := w.Header().Get("Location")
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/other"+location, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("other profile: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), ErrExportNotFound.Error()) {
+		t.Fatalf("got body %q, want %q", body, ErrExportNotFound)
+	}
+}
+
+func TestExportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	p, err := NewProxy(backend.URL, sourcesConfig("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &exporter{client: &http.Client{}}
+	job, err := newExportJob(mustParseQuery(t, "SELECT * FROM m WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-01-02T00:00:00Z'"), nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.profile, job.rename, job.policy = p.policy().defaultProfile.name, p.policy().defaultProfile.publicName, p.policy
+	job.backend, job.timeout = backend.URL, 50*time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.exportChunk(job, job.ranges[0], &csvWriter{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("chunk of stuck backend did not time out")
+	}
+}
+
+func TestExportAccessWindow(t *testing.T) {
+	cfg := sourcesConfig("m")
+	// Only allow queries in two hours from now.
+	cfg.Access = &Access{Windows: []string{fmt.Sprintf("* %d * * *", (time.Now().UTC().Hour()+2)%24)}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The job was queued while the window was open.
+	e := &exporter{client: &http.Client{}}
+	job, err := newExportJob(mustParseQuery(t, "SELECT * FROM m WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-01-02T00:00:00Z'"), nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.profile, job.rename, job.policy = p.policy().defaultProfile.name, p.policy().defaultProfile.publicName, p.policy
+	if _, err := e.exportChunk(job, job.ranges[0], &csvWriter{}); !errors.Is(err, ErrOutsideAccessWindow) {
+		t.Fatalf("got error %v, want %v", err, ErrOutsideAccessWindow)
+	}
+
+	// A reload removing the measurement stops the job.
+	if err := p.Reload(sourcesConfig("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.exportChunk(job, job.ranges[0], &csvWriter{}); !errors.Is(err, ErrQueryNotAllowed) {
+		t.Fatalf("after reload: got error %v, want %v", err, ErrQueryNotAllowed)
+	}
+}
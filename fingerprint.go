@@ -0,0 +1,70 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/influxdata/influxql"
+)
+
+// placeholder replaces literals in normalized queries.
+var placeholder = &influxql.StringLiteral{Val: "?"}
+
+// fingerprint returns the normalized form of q and a short identifier of it.
+//
+// Normalization replaces all literals, including time ranges and GROUP BY
+// intervals, by a placeholder and formats the statements canonically, so
+// that queries generated by the same dashboard panel share one fingerprint
+// and no user supplied values are exposed.
+func fingerprint(q *influxql.Query) (normalized, id string) {
+	// Work on a copy as the rewrite modifies the query in place.
+	c, err := parseQuery(q.String())
+	if err != nil {
+		// Should not happen, but never expose the raw query.
+		sum := sha256.Sum256([]byte(q.String()))
+		return "", hex.EncodeToString(sum[:8])
+	}
+
+	stmts := make([]string, 0, len(c.Statements))
+	for _, stmt := range c.Statements {
+		// Rewrite does not descend into subqueries, so rewrite every
+		// SELECT statement on its own.
+		influxql.WalkFunc(stmt, func(n influxql.Node) {
+			switch s := n.(type) {
+			case *influxql.SelectStatement:
+				influxql.RewriteFunc(s, replaceLiteral)
+				if s.Fill == influxql.NumberFill {
+					s.FillValue = 0
+				}
+			case *influxql.ShowTagValuesStatement:
+				s.Condition = influxql.RewriteExpr(s.Condition, func(e influxql.Expr) influxql.Expr {
+					if e == nil {
+						return nil
+					}
+					return replaceLiteral(e).(influxql.Expr)
+				})
+			}
+		})
+		stmts = append(stmts, stmt.String())
+	}
+
+	normalized = strings.Join(stmts, "; ")
+	sum := sha256.Sum256([]byte(normalized))
+	return normalized, hex.EncodeToString(sum[:8])
+}
+
+func replaceLiteral(n influxql.Node) influxql.Node {
+	switch n.(type) {
+	case *influxql.StringLiteral, *influxql.NumberLiteral,
+		*influxql.IntegerLiteral, *influxql.UnsignedLiteral,
+		*influxql.BooleanLiteral, *influxql.TimeLiteral,
+		*influxql.DurationLiteral, *influxql.RegexLiteral:
+		return placeholder
+	}
+	return n
+}
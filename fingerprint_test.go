@@ -0,0 +1,100 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxql"
+)
+
+func TestFingerprint(t *testing.T) {
+	testCases := map[string]struct {
+		a, b string
+		same bool
+	}{
+		"whitespaceAndCase": {
+			"select a from m1",
+			"SELECT   a\n FROM m1",
+			true,
+		},
+		"timeRange": {
+			"SELECT mean(a) FROM m1 WHERE time > now() - 1h GROUP BY time(1m)",
+			"SELECT mean(a) FROM m1 WHERE time > now() - 7d GROUP BY time(10m)",
+			true,
+		},
+		"absoluteTime": {
+			"SELECT a FROM m1 WHERE time >= '2020-01-01T00:00:00Z' AND time < '2020-02-01T00:00:00Z'",
+			"SELECT a FROM m1 WHERE time >= '2021-01-01T00:00:00Z' AND time < '2021-03-01T00:00:00Z'",
+			true,
+		},
+		"tagValues": {
+			"SELECT a FROM m1 WHERE station = 's1' AND a > 10",
+			"SELECT a FROM m1 WHERE station = 's2' AND a > 2.5",
+			true,
+		},
+		"subquery": {
+			"SELECT max(a) FROM (SELECT a FROM m1 WHERE station =~ /s1/)",
+			"SELECT max(a) FROM (SELECT a FROM m1 WHERE station =~ /s2/)",
+			true,
+		},
+		"fill": {
+			"SELECT mean(a) FROM m1 GROUP BY time(1h) fill(0)",
+			"SELECT mean(a) FROM m1 GROUP BY time(1h) fill(-1)",
+			true,
+		},
+		"differentField": {
+			"SELECT a FROM m1",
+			"SELECT b FROM m1",
+			false,
+		},
+		"differentMeasurement": {
+			"SELECT a FROM m1",
+			"SELECT a FROM m2",
+			false,
+		},
+		"differentTag": {
+			"SELECT a FROM m1 WHERE station = 's1'",
+			"SELECT a FROM m1 WHERE sensor = 's1'",
+			false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, a := fingerprint(mustParseQuery(t, tc.a))
+			_, b := fingerprint(mustParseQuery(t, tc.b))
+			if (a == b) != tc.same {
+				t.Fatalf("got fingerprints %s and %s, want same=%v", a, b, tc.same)
+			}
+		})
+	}
+}
+
+func TestFingerprintHidesLiterals(t *testing.T) {
+	q := mustParseQuery(t, "SELECT a FROM m1 WHERE owner = 'alice@example.org' AND time > '2020-01-01T00:00:00Z'")
+	orig := q.String()
+
+	normalized, _ := fingerprint(q)
+	for _, s := range []string{"alice", "2020"} {
+		if strings.Contains(normalized, s) {
+			t.Fatalf("normalized query %q contains %q", normalized, s)
+		}
+	}
+	if q.String() != orig {
+		t.Fatalf("fingerprint modified the query: got %q, want %q", q.String(), orig)
+	}
+}
+
+func mustParseQuery(t *testing.T, s string) *influxql.Query {
+	t.Helper()
+
+	q, err := influxql.ParseQuery(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
@@ -1,6 +1,6 @@
 module github.com/euracresearch/influxdb-proxy
 
-go 1.17
+go 1.18
 
 require (
 	github.com/influxdata/influxql v1.1.0
@@ -0,0 +1,149 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// grafanaMode recognizes requests of Grafana and optionally applies a
+// distinct profile to trusted Grafana instances.
+type grafanaMode struct {
+	profile *profile     // nil if the selected profile is kept.
+	trusted []*net.IPNet // networks of trusted Grafana instances.
+}
+
+func newGrafanaMode(cfg *Grafana, pol *policy) (*grafanaMode, error) {
+	g := new(grafanaMode)
+	if cfg.Profile != "" {
+		g.profile = pol.profile(cfg.Profile)
+		if g.profile == nil {
+			return nil, fmt.Errorf("grafana: unknown profile %q", cfg.Profile)
+		}
+	}
+	for _, s := range cfg.Trusted {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, fmt.Errorf("grafana: %w", err)
+		}
+		g.trusted = append(g.trusted, n)
+	}
+	return g, nil
+}
+
+// parseNetwork parses an IP address or a network in CIDR notation.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// trusts reports whether r was sent from a trusted Grafana instance.
+func (g *grafanaMode) trusts(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range g.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// grafanaSource identifies the dashboard panel a Grafana request was sent
+// for, as far as Grafana provides it.
+type grafanaSource struct {
+	Org       string
+	Dashboard string
+	Panel     string
+}
+
+// maxGrafanaID is the maximum length of the organization, dashboard and
+// panel identifiers sent by Grafana. Dashboard UIDs have at most 40
+// characters.
+const maxGrafanaID = 40
+
+// parseGrafanaSource returns the source of r, or nil if r was not sent by
+// Grafana. As the identifiers are taken from headers, which any client can
+// set, malformed ones are replaced by "invalid".
+func parseGrafanaSource(r *http.Request) *grafanaSource {
+	org := r.Header.Get("X-Grafana-Org-Id")
+	if org == "" && !strings.HasPrefix(r.Header.Get("User-Agent"), "Grafana/") {
+		return nil
+	}
+	return &grafanaSource{
+		Org:       grafanaID(org),
+		Dashboard: grafanaID(r.Header.Get("X-Dashboard-Uid")),
+		Panel:     grafanaID(r.Header.Get("X-Panel-Id")),
+	}
+}
+
+// grafanaID returns s if it is a valid identifier of Grafana, consisting of
+// at most maxGrafanaID letters, digits, dashes and underscores, otherwise
+// "invalid".
+func grafanaID(s string) string {
+	if len(s) > maxGrafanaID {
+		return "invalid"
+	}
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return "invalid"
+		}
+	}
+	return s
+}
+
+// grafanaSource returns the source of r if Grafana requests are recognized
+// and r is one, otherwise nil.
+func (pol *policy) grafanaSource(r *http.Request) *grafanaSource {
+	if pol.grafana == nil {
+		return nil
+	}
+	return parseGrafanaSource(r)
+}
+
+// grafanaProfile returns the Grafana profile if it applies to r, otherwise
+// prof.
+func (pol *policy) grafanaProfile(r *http.Request, prof *profile) *profile {
+	g := pol.grafana
+	if g == nil || g.profile == nil || parseGrafanaSource(r) == nil || !g.trusts(r) {
+		return prof
+	}
+	return g.profile
+}
+
+// fields returns the source as key value pairs for logging.
+func (s *grafanaSource) fields() []interface{} {
+	if s == nil {
+		return nil
+	}
+	kv := []interface{}{"grafana_org", s.Org}
+	if s.Dashboard != "" {
+		kv = append(kv, "grafana_dashboard", s.Dashboard)
+	}
+	if s.Panel != "" {
+		kv = append(kv, "grafana_panel", s.Panel)
+	}
+	return kv
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseGrafanaSource(t *testing.T) {
+	testCases := map[string]struct {
+		headers map[string]string
+		want    *grafanaSource
+	}{
+		"other":     {map[string]string{"User-Agent": "curl/7.68.0"}, nil},
+		"userAgent": {map[string]string{"User-Agent": "Grafana/7.3.4"}, &grafanaSource{}},
+		"orgID":     {map[string]string{"X-Grafana-Org-Id": "1"}, &grafanaSource{Org: "1"}},
+		"panel": {
+			map[string]string{"User-Agent": "Grafana/8.1.0", "X-Grafana-Org-Id": "2", "X-Dashboard-Uid": "abc", "X-Panel-Id": "4"},
+			&grafanaSource{Org: "2", Dashboard: "abc", Panel: "4"},
+		},
+		"invalid": {
+			map[string]string{"X-Grafana-Org-Id": "1", "X-Dashboard-Uid": strings.Repeat("a", 41), "X-Panel-Id": `4"}`},
+			&grafanaSource{Org: "1", Dashboard: "invalid", Panel: "invalid"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/query", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			got := parseGrafanaSource(r)
+			if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGrafanaProfile(t *testing.T) {
+	cfg := sourcesConfig("m1")
+	cfg.Profiles = []Profile{{Name: "grafana", Prefix: "/grafana", Measurements: []Measurement{{Name: "m2"}}}}
+	cfg.Grafana = &Grafana{Profile: "grafana", Trusted: []string{"10.0.0.0/8", "192.0.2.1"}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		remote    string
+		userAgent string
+		want      string
+	}{
+		"trusted":        {"10.1.2.3:1234", "Grafana/7.3.4", "grafana"},
+		"trustedAddress": {"192.0.2.1:1234", "Grafana/7.3.4", "grafana"},
+		"untrusted":      {"192.0.2.2:1234", "Grafana/7.3.4", defaultProfileName},
+		"notGrafana":     {"10.1.2.3:1234", "curl/7.68.0", defaultProfileName},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/query", nil)
+			r.RemoteAddr = tc.remote
+			r.Header.Set("User-Agent", tc.userAgent)
+			prof, path := p.policy().selectProfile(r)
+			if prof.name != tc.want || path != "/query" {
+				t.Fatalf("got %s %s, want %s /query", prof.name, path, tc.want)
+			}
+		})
+	}
+}
+
+func TestGrafanaAnnotation(t *testing.T) {
+	logs := captureLogs(t, "info", "console")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("m1")
+	cfg.Grafana = &Grafana{}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM m1"), nil)
+	r.Header.Set("X-Grafana-Org-Id", "1")
+	r.Header.Set("X-Dashboard-Uid", "weather")
+	r.Header.Set("X-Panel-Id", "7")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	if !strings.Contains(logs.String(), "grafana_org=1 grafana_dashboard=weather grafana_panel=7") {
+		t.Fatalf("got logs %q, want Grafana annotation", logs)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `influxdb_proxy_grafana_queries_total{org="1",dashboard="weather",panel="7"} 1`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("metrics do not contain %q", want)
+	}
+}
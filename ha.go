@@ -0,0 +1,186 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// leaderLock is a lock with an expiry, held by at most one instance.
+type leaderLock interface {
+	// acquire acquires the lock for id or extends it, if id already holds
+	// it, for ttl. It reports whether id holds the lock.
+	acquire(id string, ttl time.Duration) (bool, error)
+}
+
+// newLeaderLock returns the lock for the given specification, file:<path>
+// or redis://host:port[/db].
+func newLeaderLock(spec string) (leaderLock, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return &fileLock{path: strings.TrimPrefix(spec, "file:")}, nil
+	case strings.HasPrefix(spec, "redis://"):
+		c, err := newRedisClient(spec)
+		if err != nil {
+			return nil, err
+		}
+		return &redisLock{client: c, key: "influxdb-proxy:leader"}, nil
+	}
+	return nil, fmt.Errorf("unknown leader lock %q", spec)
+}
+
+// elector elects one of several instances sharing a lock as leader. Only the
+// leader runs background tasks like warm-up queries, the others stand by and
+// take over once the lock of the leader expires.
+type elector struct {
+	lock   leaderLock
+	id     string
+	ttl    time.Duration
+	leader int32 // 1 if leader, accessed atomically.
+}
+
+func newElector(lock leaderLock, id string, ttl time.Duration) *elector {
+	return &elector{lock: lock, id: id, ttl: ttl}
+}
+
+// isLeader reports whether the instance is the leader. Without HA every
+// instance is.
+func (e *elector) isLeader() bool {
+	return e == nil || atomic.LoadInt32(&e.leader) == 1
+}
+
+// run tries to acquire or extend the lock three times per TTL. It never
+// returns.
+func (e *elector) run() {
+	for {
+		e.elect()
+		time.Sleep(e.ttl / 3)
+	}
+}
+
+// elect tries to acquire or extend the lock once. On errors the instance
+// steps down, as it cannot tell whether another one took over.
+func (e *elector) elect() {
+	ok, err := e.lock.acquire(e.id, e.ttl)
+	if err != nil {
+		proxyLog.Error("acquiring leader lock", "err", err)
+	}
+
+	var v int32
+	if ok && err == nil {
+		v = 1
+	}
+	if old := atomic.SwapInt32(&e.leader, v); old != v {
+		if v == 1 {
+			proxyLog.Info("became leader", "id", e.id)
+		} else {
+			proxyLog.Warn("lost leadership", "id", e.id)
+		}
+	}
+	haLeader.Set(float64(v))
+}
+
+// instanceID returns an identifier of the running instance.
+func instanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
+// redisLock is a leaderLock stored in Redis.
+type redisLock struct {
+	client *redisClient
+	key    string
+}
+
+// redisExtend extends the expiry of a key if it holds the given value.
+const redisExtend = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+
+func (l *redisLock) acquire(id string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+	v, err := l.client.Do("SET", l.key, id, "NX", "PX", ms)
+	if err != nil {
+		return false, err
+	}
+	if v != nil {
+		return true, nil
+	}
+	v, err = l.client.Do("EVAL", redisExtend, "1", l.key, id, ms)
+	if err != nil {
+		return false, err
+	}
+	return v == int64(1), nil
+}
+
+// fileLock is a leaderLock stored in a file holding the id of the leader
+// and the expiry of the lock. It is meant for instances sharing a file
+// system. The file is read and written while holding an exclusive lock of
+// the file with the suffix .lock next to it, so that at most one instance
+// acquires an expired lock.
+type fileLock struct {
+	path string
+}
+
+func (l *fileLock) acquire(id string, ttl time.Duration) (bool, error) {
+	unlock, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	holder, expires, err := l.read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if err == nil && holder != id && now.Before(expires) {
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(l.path), ".leader-*")
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Fprintf(f, "%s\n%d\n", id, now.Add(ttl).UnixNano())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// read returns the holder and expiry of the lock. A corrupt file is
+// treated as expired lock.
+func (l *fileLock) read() (string, time.Time, error) {
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		return "", time.Time{}, nil
+	}
+	ns, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, nil
+	}
+	return lines[0], time.Unix(0, ns), nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaderLock(t *testing.T) {
+	specs := map[string]string{
+		"file":  "file:" + filepath.Join(t.TempDir(), "leader"),
+		"redis": "redis://" + fakeRedis(t),
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			lock, err := newLeaderLock(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			acquire := func(id string, ttl time.Duration, want bool) {
+				t.Helper()
+				got, err := lock.acquire(id, ttl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Fatalf("%s: got %v, want %v", id, got, want)
+				}
+			}
+
+			acquire("a", 100*time.Millisecond, true)
+			acquire("b", 100*time.Millisecond, false)
+			acquire("a", 100*time.Millisecond, true) // extends the lock.
+			time.Sleep(150 * time.Millisecond)
+			acquire("b", time.Minute, true)
+			acquire("a", time.Minute, false)
+		})
+	}
+}
+
+func TestFileLockCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader")
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := (&fileLock{path: path}).acquire("a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v, want lock acquired", ok, err)
+	}
+}
+
+func TestFileLockConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader")
+	// The lock of the previous leader a has expired.
+	if err := ioutil.WriteFile(path, []byte("a\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		start  = make(chan struct{})
+		leader int32
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			<-start
+			ok, err := (&fileLock{path: path}).acquire(id, time.Minute)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				atomic.AddInt32(&leader, 1)
+			}
+		}(strconv.Itoa(i))
+	}
+	close(start)
+	wg.Wait()
+	if leader != 1 {
+		t.Fatalf("got %d instances acquiring the lock, want 1", leader)
+	}
+}
+
+func TestElector(t *testing.T) {
+	captureLogs(t, "error", "console")
+
+	var e *elector
+	if !e.isLeader() {
+		t.Fatal("without HA every instance must be leader")
+	}
+
+	lock := &fileLock{path: filepath.Join(t.TempDir(), "leader")}
+	a := newElector(lock, "a", time.Minute)
+	b := newElector(lock, "b", time.Minute)
+	a.elect()
+	b.elect()
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("got leaders a=%v b=%v, want only a", a.isLeader(), b.isLeader())
+	}
+
+	// The instance steps down if it cannot reach the lock.
+	a.lock = &fileLock{path: filepath.Join(t.TempDir(), "missing", "leader")}
+	a.elect()
+	if a.isLeader() {
+		t.Fatal("got leader after lock error")
+	}
+}
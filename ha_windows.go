@@ -0,0 +1,12 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "errors"
+
+// lockFile is not supported on Windows, where a Redis lock must be used.
+func lockFile(path string) (func(), error) {
+	return nil, errors.New("file locks are not supported on Windows, use a Redis lock")
+}
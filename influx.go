@@ -0,0 +1,140 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxBackendQueryBody is the maximum size of the response to a query sent
+// by the proxy itself.
+const maxBackendQueryBody = 1 << 20
+
+// backendClient sends the queries of the proxy itself to the backends.
+var backendClient = &http.Client{Timeout: 10 * time.Second}
+
+// influxResponse is the JSON response of the InfluxDB /query endpoint.
+type influxResponse struct {
+	Results []influxResult `json:"results,omitempty"`
+	Err     string         `json:"error,omitempty"`
+}
+
+// influxResult is the result of a single statement.
+type influxResult struct {
+	StatementID int             `json:"statement_id"`
+	Series      []influxSeries  `json:"series,omitempty"`
+	Messages    json.RawMessage `json:"messages,omitempty"`
+	Partial     bool            `json:"partial,omitempty"`
+	Err         string          `json:"error,omitempty"`
+}
+
+// influxSeries is a series of rows of a result.
+type influxSeries struct {
+	Name    string            `json:"name,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Columns []string          `json:"columns,omitempty"`
+	Values  [][]interface{}   `json:"values,omitempty"`
+	Partial bool              `json:"partial,omitempty"`
+}
+
+// decodeResponses decodes the JSON body of a /query response. Chunked
+// responses consist of multiple responses, which are returned in order.
+func decodeResponses(body []byte) ([]*influxResponse, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var resps []*influxResponse
+	for {
+		resp := new(influxResponse)
+		err := dec.Decode(resp)
+		if err == io.EOF {
+			return resps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		resps = append(resps, resp)
+	}
+}
+
+// encodeResponses is the inverse of decodeResponses. If pretty is set, the
+// responses are indented like InfluxDB does for the pretty parameter.
+func encodeResponses(resps []*influxResponse, pretty bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if pretty {
+		enc.SetIndent("", "    ")
+	}
+	for _, resp := range resps {
+		if err := enc.Encode(resp); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// isMsgpack reports whether contentType is the one of MessagePack responses.
+func isMsgpack(contentType string) bool {
+	return strings.HasPrefix(contentType, msgpackContentType)
+}
+
+// decodeResponsesAs decodes a /query response body with the given content
+// type, JSON or MessagePack.
+func decodeResponsesAs(contentType string, body []byte) ([]*influxResponse, error) {
+	if isMsgpack(contentType) {
+		return decodeMsgpackResponses(body)
+	}
+	return decodeResponses(body)
+}
+
+// backendQuery sends a query with params to the backend of the profile on
+// behalf of the client of r, whose credentials are passed on, and returns
+// the decoded response.
+func (prof *profile) backendQuery(r *http.Request, params url.Values) ([]*influxResponse, error) {
+	u, err := url.Parse(prof.backend)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	for _, k := range []string{"u", "p"} {
+		if v := r.URL.Query().Get(k); v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.Path, u.RawQuery = "/query", q.Encode()
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Credentials checked by the proxy are already removed from r.
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBackendQueryBody))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend responded with %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return decodeResponses(b)
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// started is the time the process started.
+var started = time.Now()
+
+// proxyInfo describes the build and the current policy of the proxy, so that
+// fleet tooling can verify that all instances run the same policy.
+type proxyInfo struct {
+	Version        string    `json:"version"`
+	Commit         string    `json:"commit"`
+	GoVersion      string    `json:"go_version"`
+	ConfigChecksum string    `json:"config_checksum"`
+	PolicyVersion  uint64    `json:"policy_version"`
+	PolicyLoaded   time.Time `json:"policy_loaded"`
+	Started        time.Time `json:"started"`
+	UptimeSeconds  float64   `json:"uptime_seconds"`
+}
+
+// configChecksum returns the SHA-256 sum of the JSON encoding of cfg, which
+// does not depend on the formatting of the configuration file.
+func configChecksum(cfg *Config) string {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// info returns the information about the proxy at now.
+func (p *Proxy) info(now time.Time) *proxyInfo {
+	pol := p.policy()
+	return &proxyInfo{
+		Version:        version,
+		Commit:         commit,
+		GoVersion:      runtime.Version(),
+		ConfigChecksum: pol.checksum,
+		PolicyVersion:  pol.version,
+		PolicyLoaded:   pol.loaded,
+		Started:        started,
+		UptimeSeconds:  now.Sub(started).Seconds(),
+	}
+}
+
+// infoHandler serves the information about the proxy as JSON on the admin
+// listener.
+func (p *Proxy) infoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.info(time.Now()))
+	})
+}
+
+// serveVersion serves the build version as JSON to public clients, which
+// do not get to see the policy and build details of info.
+func serveVersion(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version string `json:"version"`
+	}{version})
+}
+
+// setInfoMetrics exposes the build and the policy pol as info metrics.
+func setInfoMetrics(pol *policy) {
+	buildInfo.Set(1, version, commit, runtime.Version())
+	startTime.Set(float64(started.UnixNano()) / 1e9)
+	policyInfo.Reset()
+	policyInfo.Set(1, strconv.FormatUint(pol.version, 10), pol.checksum)
+}
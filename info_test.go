@@ -0,0 +1,75 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	p, err := NewProxy("http://localhost:8086", sourcesConfig("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/debug/version", nil))
+	if got, want := w.Body.String(), `{"version":""}`+"\n"; got != want {
+		t.Fatalf("got public response %q, want %q", got, want)
+	}
+
+	admin := p.adminHandler()
+	get := func() *proxyInfo {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", "/debug/version", nil))
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Fatalf("got Content-Type %q, want application/json", got)
+		}
+		var info proxyInfo
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		return &info
+	}
+
+	before := get()
+	if before.GoVersion != runtime.Version() || before.PolicyVersion != 0 || len(before.ConfigChecksum) != 64 {
+		t.Fatalf("got %+v", before)
+	}
+
+	if err := p.Reload(sourcesConfig("a")); err != nil {
+		t.Fatal(err)
+	}
+	same := get()
+	if same.PolicyVersion != 1 || same.ConfigChecksum != before.ConfigChecksum {
+		t.Fatalf("same configuration: got version %d checksum %s, want 1 %s", same.PolicyVersion, same.ConfigChecksum, before.ConfigChecksum)
+	}
+
+	if err := p.Reload(sourcesConfig("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	changed := get()
+	if changed.ConfigChecksum == before.ConfigChecksum {
+		t.Fatal("checksum did not change with the configuration")
+	}
+
+	w = httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	want := `influxdb_proxy_policy_info{version="2",checksum="` + changed.ConfigChecksum + `"} 1`
+	if !strings.Contains(out, want+"\n") {
+		t.Fatalf("metrics do not contain %s", want)
+	}
+	if strings.Contains(out, before.ConfigChecksum) {
+		t.Fatal("metrics contain the checksum of a previous policy")
+	}
+	if !strings.Contains(out, `influxdb_proxy_build_info{version="",commit="",goversion="`+runtime.Version()+`"} 1`) {
+		t.Fatal("metrics do not contain the build info")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build integration
+// +build integration
+
+// The integration tests run the proxy against a real InfluxDB server,
+// started in a Docker container, and compare its responses with the golden
+// files in testdata/integration:
+//
+//	go test -tags integration -run Integration
+//
+// Set INFLUXDB_URL to test against a running server instead, and use
+// -update to rewrite the golden files.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the integration tests")
+
+// integrationImage is the InfluxDB image the integration tests run against.
+const integrationImage = "influxdb:1.8"
+
+// integrationDB is the database seeded with integrationPoints.
+const integrationDB = "integration"
+
+// integrationPoints are written to integrationDB in line protocol with
+// second precision, starting at 2020-06-01T00:00:00Z.
+const integrationPoints = `airtemp,station=s1 v=20.5 1590969600
+airtemp,station=s1 v=21.5 1590973200
+airtemp,station=s1 v=22.5 1590976800
+airtemp,station=s2 v=18.5 1590969600
+airtemp,station=s2 v=19.5 1590973200
+airtemp,station=s2 v=19.75 1590976800
+rh,station=s1 v=80.5 1590969600
+rh,station=s2 v=60.5 1590969600
+secret,station=s1 v=1.5 1590969600
+`
+
+// integrationWindow covers all integrationPoints.
+const integrationWindow = "time >= '2020-06-01T00:00:00Z' AND time < '2020-06-01T03:00:00Z'"
+
+// startInfluxDB returns the address of the InfluxDB server to test against,
+// starting a container which is removed at the end of the test if
+// INFLUXDB_URL is not set.
+func startInfluxDB(t *testing.T) string {
+	if addr := os.Getenv("INFLUXDB_URL"); addr != "" {
+		return addr
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not found, set INFLUXDB_URL to test against a running server")
+	}
+
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::8086", integrationImage).Output()
+	if err != nil {
+		t.Fatalf("starting %s: %v", integrationImage, err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if err := exec.Command("docker", "stop", id).Run(); err != nil {
+			t.Logf("stopping container %s: %v", id, err)
+		}
+	})
+
+	out, err = exec.Command("docker", "port", id, "8086/tcp").Output()
+	if err != nil {
+		t.Fatalf("port of container %s: %v", id, err)
+	}
+	addr := "http://" + strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		if err := ping(ctx, addr); err == nil {
+			return addr
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("InfluxDB at %s did not come up", addr)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// seedInfluxDB creates integrationDB and writes integrationPoints.
+func seedInfluxDB(t *testing.T, addr string) {
+	post := func(path, body string) {
+		resp, err := http.Post(addr+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			b, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("%s: got status %d: %s", path, resp.StatusCode, b)
+		}
+	}
+	post("/query?q="+url.QueryEscape("CREATE DATABASE "+integrationDB), "")
+	post("/write?precision=s&db="+integrationDB, integrationPoints)
+}
+
+func TestIntegration(t *testing.T) {
+	addr := startInfluxDB(t)
+	seedInfluxDB(t, addr)
+
+	cfg := sourcesConfig()
+	cfg.Measurements = []Measurement{
+		{Name: "airtemp", Cache: &CachePolicy{Mode: CacheTTL, TTL: duration(time.Hour)}},
+		{Name: "rh", TagValues: map[string][]string{"station": {"s1"}}},
+	}
+	cfg.Aliases = map[string]string{"humidity": "rh"}
+	cfg.Tombstones = map[string]Tombstone{"air_t": {Replacement: "airtemp"}}
+	p, err := NewProxy(addr, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache, p.cacheTTL = newMemoryCache(), time.Minute
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	get := func(t *testing.T, q string, params ...string) (*http.Response, []byte) {
+		v := url.Values{"db": {integrationDB}, "q": {q}}
+		for i := 0; i+1 < len(params); i += 2 {
+			v.Set(params[i], params[i+1])
+		}
+		resp, err := http.Get(proxy.URL + "/query?" + v.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, b
+	}
+
+	testCases := map[string]struct {
+		query  string
+		params []string
+		status int
+	}{
+		"select":     {"SELECT v FROM airtemp WHERE station = 's1' AND " + integrationWindow, nil, http.StatusOK},
+		"groupBy":    {"SELECT mean(v) FROM airtemp WHERE " + integrationWindow + " GROUP BY station", []string{"epoch", "s"}, http.StatusOK},
+		"chunked":    {"SELECT v FROM airtemp WHERE station = 's1' AND " + integrationWindow, []string{"chunked", "true", "chunk_size", "2"}, http.StatusOK},
+		"alias":      {"SELECT v FROM humidity WHERE station = 's1' AND " + integrationWindow, nil, http.StatusOK},
+		"tagValues":  {`SHOW TAG VALUES FROM humidity WITH KEY = "station"`, nil, http.StatusOK},
+		"statements": {"SELECT v FROM airtemp WHERE station = 's2' AND " + integrationWindow + "; SELECT v FROM humidity WHERE station = 's1' AND " + integrationWindow, nil, http.StatusOK},
+		"notAllowed": {"SELECT v FROM secret", nil, http.StatusNotAcceptable},
+		"hidden":     {"SELECT v FROM rh", nil, http.StatusNotAcceptable},
+		"deprecated": {"SELECT v FROM air_t", nil, http.StatusGone},
+		"drop":       {"DROP MEASUREMENT airtemp", nil, http.StatusNotAcceptable},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp, body := get(t, tc.query, tc.params...)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("got status %d, want %d: %s", resp.StatusCode, tc.status, body)
+			}
+			golden(t, name, body)
+		})
+	}
+
+	// Responses are cached, and the rejected DROP has not removed the data.
+	t.Run("cache", func(t *testing.T) {
+		q := "SELECT v FROM airtemp WHERE station = 's2' AND " + integrationWindow
+		for _, want := range []string{"MISS", "HIT"} {
+			resp, body := get(t, q)
+			if got := resp.Header.Get("X-Cache"); got != want {
+				t.Fatalf("got X-Cache %q, want %q", got, want)
+			}
+			golden(t, "cache", body)
+		}
+	})
+}
+
+// golden compares got with the golden file of the named test, or rewrites
+// the file if -update is set.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "integration", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("response differs from %s:\ngot  %s\nwant %s", path, got, want)
+	}
+}
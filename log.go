@@ -0,0 +1,167 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Loggers of the proxy components.
+var (
+	proxyLog  = newLogger("proxy")
+	auditLog  = newLogger("audit")
+	cacheLog  = newLogger("cache")
+	tlsLog    = newLogger("tls")
+	exportLog = newLogger("export")
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+// Log levels, in increasing severity.
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string { return levelNames[l] }
+
+// parseLogLevel returns the level with the given name.
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// logOutput is where all loggers write to. It is shared, so that level and
+// format are configured in a single place.
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+	now   func() time.Time
+}
+
+var logs = &logOutput{w: os.Stderr, level: levelInfo, now: time.Now}
+
+// configureLogs sets the minimum level and the format, "console" or "json",
+// of all loggers.
+func configureLogs(level, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != "console" && format != "json" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	logs.level = l
+	logs.json = format == "json"
+	return nil
+}
+
+// logger writes leveled, structured log messages of a component. Messages
+// are followed by key value pairs giving the context, like:
+//
+//	proxyLog.Info("listening", "addr", addr)
+type logger struct {
+	component string
+}
+
+func newLogger(component string) *logger {
+	return &logger{component: component}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// Fatal logs at error level and exits the program.
+func (l *logger) Fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+
+	if level < logs.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	t := logs.now().UTC().Format(time.RFC3339)
+	if logs.json {
+		m := map[string]interface{}{
+			"time":      t,
+			"level":     level.String(),
+			"component": l.component,
+			"msg":       msg,
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			k := fmt.Sprint(kv[i])
+			switch v := kv[i+1].(type) {
+			case error:
+				m[k] = v.Error()
+			case fmt.Stringer:
+				m[k] = v.String()
+			default:
+				m[k] = v
+			}
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"time": t, "level": "error", "component": l.component, "msg": err.Error()})
+		}
+		buf.Write(b)
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s: %s", t, strings.ToUpper(level.String()), l.component, msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			v := fmt.Sprint(kv[i+1])
+			if v == "" || strings.ContainsAny(v, " \"=") {
+				v = fmt.Sprintf("%q", v)
+			}
+			fmt.Fprintf(&buf, " %v=%s", kv[i], v)
+		}
+	}
+	buf.WriteByte('\n')
+	logs.w.Write(buf.Bytes())
+}
+
+// stdLogger returns a *log.Logger writing to l at the given level, for
+// packages like net/http which expect one.
+func (l *logger) stdLogger(level logLevel) *log.Logger {
+	return log.New(logWriter{l, level}, "", 0)
+}
+
+type logWriter struct {
+	l     *logger
+	level logLevel
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	w.l.log(w.level, strings.TrimSpace(string(b)), nil)
+	return len(b), nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// captureLogs redirects all log output to the returned buffer until the test
+// finishes.
+func captureLogs(t *testing.T, level, format string) *bytes.Buffer {
+	t.Helper()
+
+	logs.mu.Lock()
+	w, lvl, json, now := logs.w, logs.level, logs.json, logs.now
+	buf := new(bytes.Buffer)
+	logs.w = buf
+	logs.now = func() time.Time { return time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC) }
+	logs.mu.Unlock()
+
+	t.Cleanup(func() {
+		logs.mu.Lock()
+		logs.w, logs.level, logs.json, logs.now = w, lvl, json, now
+		logs.mu.Unlock()
+	})
+
+	if err := configureLogs(level, format); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestLoggerConsole(t *testing.T) {
+	buf := captureLogs(t, "info", "console")
+
+	l := newLogger("test")
+	l.Debug("hidden")
+	l.Info("listening", "addr", "localhost:8080")
+	l.Warn("slow query", "query", `SELECT "a" FROM m1`, "duration", 2*time.Second)
+	l.Error("failed", "err", errors.New("boom"))
+
+	want := `2020-06-01T12:00:00Z INFO  test: listening addr=localhost:8080
+2020-06-01T12:00:00Z WARN  test: slow query query="SELECT \"a\" FROM m1" duration=2s
+2020-06-01T12:00:00Z ERROR test: failed err=boom
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := captureLogs(t, "debug", "json")
+
+	l := newLogger("test")
+	l.Debug("rejected", "err", errors.New("query not allowed"), "n", 3, "d", time.Second)
+
+	want := `{"component":"test","d":"1s","err":"query not allowed","level":"debug","msg":"rejected","n":3,"time":"2020-06-01T12:00:00Z"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestConfigureLogsInvalid(t *testing.T) {
+	captureLogs(t, "info", "console")
+
+	if err := configureLogs("verbose", "console"); err == nil {
+		t.Fatal("expected error for unknown level")
+	}
+	if err := configureLogs("info", "xml"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxSeriesPerMetric limits the number of label combinations tracked per
+// metric. Further combinations are accounted to a series with all labels set
+// to "other", so that a flood of distinct queries can not exhaust memory.
+const maxSeriesPerMetric = 1000
+
+// maxGrafanaPanels limits the number of panels tracked by grafanaQueries.
+const maxGrafanaPanels = 200
+
+// Proxy metrics, exposed in the Prometheus text format on the admin
+// listener.
+var (
+	queriesTotal = newCounterVec("influxdb_proxy_queries_total",
+		"Number of allowed queries by fingerprint.", "fingerprint")
+	queryDuration = newHistogramVec("influxdb_proxy_query_duration_seconds",
+		"Latency of allowed queries by fingerprint.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "fingerprint")
+	responseBytes = newCounterVec("influxdb_proxy_response_bytes_total",
+		"Number of response body bytes streamed to clients by profile.", "profile")
+	rejectionsTotal = newCounterVec("influxdb_proxy_rejections_total",
+		"Number of rejected queries by profile and reason.", "profile", "reason")
+	queryFingerprints = newGaugeVec("influxdb_proxy_query_fingerprint_info",
+		"Normalized query of a fingerprint.", "fingerprint", "query")
+	upstreamErrors = newCounterVec("influxdb_proxy_upstream_errors_total",
+		"Number of 5xx responses and failed requests of backends by backend.", "backend")
+	panicsTotal = newCounterVec("influxdb_proxy_panics_total",
+		"Number of panics recovered in request handlers.")
+	warmupQueries = newCounterVec("influxdb_proxy_warmup_queries_total",
+		"Number of warm-up query runs by name and result.", "query", "result")
+	warmupLastSuccess = newGaugeVec("influxdb_proxy_warmup_last_success_timestamp_seconds",
+		"Time of the last successful run of a warm-up query.", "query")
+	sloRequests = newCounterVec("influxdb_proxy_slo_requests_total",
+		"Number of requests counted for SLOs by profile, endpoint, SLO and result.", "profile", "endpoint", "slo", "result")
+	sloBurnRate = newGaugeVec("influxdb_proxy_slo_burn_rate",
+		"Error budget burn rate of SLOs by profile, endpoint, SLO and window.", "profile", "endpoint", "slo", "window")
+	grafanaQueries = newCounterVec("influxdb_proxy_grafana_queries_total",
+		"Number of allowed queries of Grafana by organization, dashboard and panel.", "org", "dashboard", "panel").limit(maxGrafanaPanels)
+	shadowRequests = newCounterVec("influxdb_proxy_shadow_requests_total",
+		"Number of queries mirrored to shadow backends by profile and result.", "profile", "result")
+	shadowComparisons = newCounterVec("influxdb_proxy_shadow_comparisons_total",
+		"Number of compared shadow responses by profile and result.", "profile", "result")
+	backendStatements = newGaugeVec("influxdb_proxy_backend_statements",
+		"Number of statements currently executed by the backends, if limited.")
+	haLeader = newGaugeVec("influxdb_proxy_ha_leader",
+		"Whether the instance is the leader running background tasks (1) or stands by (0).")
+	seriesCheckFailures = newCounterVec("influxdb_proxy_series_check_failures_total",
+		"Number of queries rejected because the backend could not count their series by profile.", "profile")
+	cancelledQueries = newCounterVec("influxdb_proxy_cancelled_queries_total",
+		"Number of queries cancelled at the backend by profile and cause: client disconnect or deadline.", "profile", "cause")
+	buildInfo = newGaugeVec("influxdb_proxy_build_info",
+		"Version, commit and Go version of the build.", "version", "commit", "goversion")
+	startTime = newGaugeVec("influxdb_proxy_start_time_seconds",
+		"Time the process started.")
+	policyInfo = newGaugeVec("influxdb_proxy_policy_info",
+		"Version and configuration checksum of the current policy.", "version", "checksum")
+	cacheRequests = newCounterVec("influxdb_proxy_cache_requests_total",
+		"Number of query cache lookups by result: hit, miss or bypass.", "result")
+	deprecatedQueries = newCounterVec("influxdb_proxy_deprecated_queries_total",
+		"Number of queries rejected for using a tombstoned measurement by profile and measurement.", "profile", "measurement")
+	quarantinedQueries = newCounterVec("influxdb_proxy_quarantined_queries_total",
+		"Number of queries rejected because the InfluxQL parser panicked on them by profile.", "profile")
+	tlsCertificateExpiry = newGaugeVec("influxdb_proxy_tls_certificate_expiry_days",
+		"Days until the served certificate expires by domain.", "domain")
+)
+
+// metricsRegistry contains all metrics in the order they are exposed.
+var metricsRegistry []collector
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// metricVec is the common part of all metrics. It holds one series for each
+// combination of label values.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	max    int // maximum number of series.
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+
+	// histogram only
+	buckets []uint64
+	count   uint64
+}
+
+func newMetricVec(name, help, typ string, labels []string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		max:    maxSeriesPerMetric,
+		series: make(map[string]*series),
+	}
+}
+
+// get returns the series for the label values. The caller must hold v.mu.
+func (v *metricVec) get(labelValues []string, nbuckets int) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(labelValues), len(v.labels)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	if len(v.series) >= v.max {
+		labelValues = make([]string, len(v.labels))
+		for i := range labelValues {
+			labelValues[i] = "other"
+		}
+		key = strings.Join(labelValues, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+
+	s := &series{labelValues: labelValues, buckets: make([]uint64, nbuckets)}
+	v.series[key] = s
+	return s
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+}
+
+// sorted returns the series ordered by their label values. The caller must
+// hold v.mu.
+func (v *metricVec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := make([]*series, len(keys))
+	for i, k := range keys {
+		s[i] = v.series[k]
+	}
+	return s
+}
+
+// labelString formats the labels with the given values, plus the optional
+// extra label, as {a="x",b="y"}.
+func (v *metricVec) labelString(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range v.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", l, labelEscaper.Replace(values[i]))
+	}
+	if len(extra) == 2 {
+		if len(v.labels) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extra[0], labelEscaper.Replace(extra[1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// counterVec is a monotonically increasing metric.
+type counterVec struct{ *metricVec }
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{newMetricVec(name, help, "counter", labels)}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+// limit lowers the maximum number of series of c to n and returns c.
+func (c *counterVec) limit(n int) *counterVec {
+	c.max = n
+	return c
+}
+
+// Add adds delta to the series with the given label values.
+func (c *counterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	c.get(labelValues, 0).value += delta
+	c.mu.Unlock()
+}
+
+// Inc increments the series with the given label values by one.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// totals returns the sum of all series by the value of label, or by "" if
+// label is empty.
+func (c *counterVec) totals(label string) map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idx := -1
+	for i, l := range c.labels {
+		if l == label {
+			idx = i
+		}
+	}
+	totals := make(map[string]float64)
+	for _, s := range c.series {
+		var v string
+		if idx >= 0 {
+			v = s.labelValues[idx]
+		}
+		totals[v] += s.value
+	}
+	return totals
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w)
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(s.labelValues), formatFloat(s.value))
+	}
+}
+
+// gaugeVec is a metric which can go up and down.
+type gaugeVec struct{ *metricVec }
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{newMetricVec(name, help, "gauge", labels)}
+	metricsRegistry = append(metricsRegistry, g)
+	return g
+}
+
+// Set sets the series with the given label values to value.
+func (g *gaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues, 0).value = value
+	g.mu.Unlock()
+}
+
+// Reset removes all series.
+func (g *gaugeVec) Reset() {
+	g.mu.Lock()
+	g.series = make(map[string]*series)
+	g.mu.Unlock()
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.writeHeader(w)
+	for _, s := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(s.labelValues), formatFloat(s.value))
+	}
+}
+
+// histogramVec counts observations in configurable buckets.
+type histogramVec struct {
+	*metricVec
+	bounds []float64
+}
+
+func newHistogramVec(name, help string, bounds []float64, labels ...string) *histogramVec {
+	h := &histogramVec{newMetricVec(name, help, "histogram", labels), bounds}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+// Observe adds the value v to the series with the given label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.get(labelValues, len(h.bounds))
+	for i, b := range h.bounds {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, s := range h.sorted() {
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labelValues, "le", formatFloat(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.labelValues), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.labelValues), s.count)
+	}
+}
+
+// labelEscaper escapes label values as required by the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsHandler serves all registered metrics in the Prometheus text
+// exposition format.
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range metricsRegistry {
+			c.writeTo(w)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := &counterVec{newMetricVec("test_total", "Test counter.", "counter", []string{"a"})}
+	c.Inc("x")
+	c.Add(2, "x")
+	c.Inc(`y"z`)
+
+	var buf bytes.Buffer
+	c.writeTo(&buf)
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="x"} 3
+test_total{a="y\"z"} 1
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &histogramVec{newMetricVec("test_seconds", "Test histogram.", "histogram", nil), []float64{1, 5}}
+	h.Observe(0.5)
+	h.Observe(2)
+	h.Observe(10)
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 12.5
+test_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricSeriesLimit(t *testing.T) {
+	c := &counterVec{newMetricVec("test_total", "Test counter.", "counter", []string{"a"})}
+	for i := 0; i < maxSeriesPerMetric+10; i++ {
+		c.Inc(fmt.Sprint(i))
+	}
+
+	var buf bytes.Buffer
+	c.writeTo(&buf)
+	if !strings.Contains(buf.String(), `test_total{a="other"} 10`) {
+		t.Fatal("series above the limit not accounted to other")
+	}
+}
+
+func TestMetricLowerSeriesLimit(t *testing.T) {
+	c := (&counterVec{newMetricVec("test_total", "Test counter.", "counter", []string{"a"})}).limit(3)
+	for i := 0; i < 5; i++ {
+		c.Inc(fmt.Sprint(i))
+	}
+
+	if got, want := c.totals("a"), map[string]float64{"0": 1, "1": 1, "2": 1, "other": 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCounterTotals(t *testing.T) {
+	c := &counterVec{newMetricVec("test_total", "", "counter", []string{"profile", "reason"})}
+	c.Add(2, "a", "x")
+	c.Add(3, "b", "x")
+	c.Add(1, "b", "y")
+
+	if got, want := c.totals("reason"), map[string]float64{"x": 5, "y": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := c.totals(""), map[string]float64{"": 6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
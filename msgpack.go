@@ -0,0 +1,564 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// msgpackContentType is the content type of MessagePack encoded responses,
+// which InfluxDB sends if requested with the Accept header.
+const msgpackContentType = "application/x-msgpack"
+
+// errMsgpackShort is returned if a MessagePack value is cut off.
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// msgpackExt is a MessagePack extension value, like the timestamps encoded
+// by InfluxDB, which is passed through unchanged.
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// decodeMsgpackResponses decodes a MessagePack /query response. Chunked
+// responses consist of multiple responses, which are returned in order.
+// Numbers are decoded as int64, uint64 or float64.
+func decodeMsgpackResponses(body []byte) ([]*influxResponse, error) {
+	d := &msgpackDecoder{b: body}
+	var resps []*influxResponse
+	for d.off < len(d.b) {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("msgpack: response is %T, not a map", v)
+		}
+		resp := new(influxResponse)
+		resp.Err, _ = m["error"].(string)
+		results, _ := m["results"].([]interface{})
+		for _, r := range results {
+			res, err := msgpackResult(r)
+			if err != nil {
+				return nil, err
+			}
+			resp.Results = append(resp.Results, res)
+		}
+		resps = append(resps, resp)
+	}
+	return resps, nil
+}
+
+func msgpackResult(v interface{}) (influxResult, error) {
+	var res influxResult
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return res, fmt.Errorf("msgpack: result is %T, not a map", v)
+	}
+	id, err := msgpackInt(m["statement_id"])
+	if err != nil {
+		return res, err
+	}
+	res.StatementID = id
+	res.Err, _ = m["error"].(string)
+	res.Partial, _ = m["partial"].(bool)
+	if msgs, ok := m["messages"]; ok {
+		if res.Messages, err = json.Marshal(msgs); err != nil {
+			return res, err
+		}
+	}
+	series, _ := m["series"].([]interface{})
+	for _, s := range series {
+		sm, ok := s.(map[string]interface{})
+		if !ok {
+			return res, fmt.Errorf("msgpack: series is %T, not a map", s)
+		}
+		var row influxSeries
+		row.Name, _ = sm["name"].(string)
+		row.Partial, _ = sm["partial"].(bool)
+		if tags, ok := sm["tags"].(map[string]interface{}); ok {
+			row.Tags = make(map[string]string, len(tags))
+			for k, v := range tags {
+				row.Tags[k], _ = v.(string)
+			}
+		}
+		columns, _ := sm["columns"].([]interface{})
+		for _, c := range columns {
+			name, _ := c.(string)
+			row.Columns = append(row.Columns, name)
+		}
+		values, _ := sm["values"].([]interface{})
+		for _, v := range values {
+			vs, ok := v.([]interface{})
+			if !ok {
+				return res, fmt.Errorf("msgpack: row is %T, not an array", v)
+			}
+			row.Values = append(row.Values, vs)
+		}
+		res.Series = append(res.Series, row)
+	}
+	return res, nil
+}
+
+func msgpackInt(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case int64:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("msgpack: statement_id is %T, not an integer", v)
+}
+
+// encodeMsgpackResponses is the inverse of decodeMsgpackResponses. The
+// layout follows the one of InfluxDB.
+func encodeMsgpackResponses(resps []*influxResponse) ([]byte, error) {
+	e := new(msgpackEncoder)
+	for _, resp := range resps {
+		e.mapHeader(1)
+		if resp.Err != "" {
+			e.str("error")
+			e.str(resp.Err)
+			continue
+		}
+		e.str("results")
+		e.arrayHeader(len(resp.Results))
+		for _, res := range resp.Results {
+			if err := e.result(res); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e.buf.Bytes(), nil
+}
+
+func (e *msgpackEncoder) result(res influxResult) error {
+	if res.Err != "" {
+		e.mapHeader(2)
+		e.str("statement_id")
+		e.value(int64(res.StatementID))
+		e.str("error")
+		e.str(res.Err)
+		return nil
+	}
+
+	var msgs []interface{}
+	if len(res.Messages) > 0 {
+		if err := json.Unmarshal(res.Messages, &msgs); err != nil {
+			return err
+		}
+	}
+	n := 2
+	if len(msgs) > 0 {
+		n++
+	}
+	if res.Partial {
+		n++
+	}
+	e.mapHeader(n)
+	e.str("statement_id")
+	e.value(int64(res.StatementID))
+	if len(msgs) > 0 {
+		e.str("messages")
+		if err := e.value(msgs); err != nil {
+			return err
+		}
+	}
+	e.str("series")
+	e.arrayHeader(len(res.Series))
+	for _, s := range res.Series {
+		n := 2
+		if s.Name != "" {
+			n++
+		}
+		if len(s.Tags) > 0 {
+			n++
+		}
+		if s.Partial {
+			n++
+		}
+		e.mapHeader(n)
+		if s.Name != "" {
+			e.str("name")
+			e.str(s.Name)
+		}
+		if len(s.Tags) > 0 {
+			keys := make([]string, 0, len(s.Tags))
+			for k := range s.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			e.str("tags")
+			e.mapHeader(len(keys))
+			for _, k := range keys {
+				e.str(k)
+				e.str(s.Tags[k])
+			}
+		}
+		e.str("columns")
+		e.arrayHeader(len(s.Columns))
+		for _, c := range s.Columns {
+			e.str(c)
+		}
+		e.str("values")
+		e.arrayHeader(len(s.Values))
+		for _, row := range s.Values {
+			if err := e.value(row); err != nil {
+				return err
+			}
+		}
+		if s.Partial {
+			e.str("partial")
+			e.value(true)
+		}
+	}
+	if res.Partial {
+		e.str("partial")
+		e.value(true)
+	}
+	return nil
+}
+
+// msgpackDecoder decodes MessagePack values from b.
+type msgpackDecoder struct {
+	b   []byte
+	off int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.off < n {
+		return nil, errMsgpackShort
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// value decodes the next value. Maps must have string keys.
+func (d *msgpackDecoder) value() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapValue(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayValue(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		return append([]byte(nil), b...), err
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		v, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return v, nil
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		n := 1 << (c - 0xd0)
+		v, err := d.uint(n)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend.
+		shift := uint(64 - 8*n)
+		return int64(v<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayValue(int(n))
+	case 0xde, 0xdf: // map 16, 32
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: invalid type 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) ext(n int) (interface{}, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return msgpackExt{Type: int8(t[0]), Data: append([]byte(nil), b...)}, nil
+}
+
+func (d *msgpackDecoder) arrayValue(n int) (interface{}, error) {
+	// Every element takes at least one byte.
+	if n > len(d.b)-d.off {
+		return nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapValue(n int) (interface{}, error) {
+	if n > len(d.b)-d.off {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key is %T, not a string", k)
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// msgpackEncoder encodes MessagePack values to buf.
+type msgpackEncoder struct {
+	buf bytes.Buffer
+}
+
+// header writes the type byte c followed by n as big endian integer of
+// size bytes.
+func (e *msgpackEncoder) header(c byte, n uint64, size int) {
+	e.buf.WriteByte(c)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	e.buf.Write(b[8-size:])
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.header(0xde, uint64(n), 2)
+	default:
+		e.header(0xdf, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.header(0xdc, uint64(n), 2)
+	default:
+		e.header(0xdd, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) str(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.header(0xd9, uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.header(0xda, uint64(n), 2)
+	default:
+		e.header(0xdb, uint64(n), 4)
+	}
+	e.buf.WriteString(s)
+}
+
+func (e *msgpackEncoder) int(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f, v < 0 && v >= -32:
+		e.buf.WriteByte(byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		e.header(0xd0, uint64(v), 1)
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		e.header(0xd1, uint64(v), 2)
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		e.header(0xd2, uint64(v), 4)
+	default:
+		e.header(0xd3, uint64(v), 8)
+	}
+}
+
+// value encodes v, which is one of the types returned by
+// msgpackDecoder.value or decoded from JSON.
+func (e *msgpackEncoder) value(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case int64:
+		e.int(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			e.header(0xcf, v, 8)
+		} else {
+			e.int(int64(v))
+		}
+	case float64:
+		e.header(0xcb, math.Float64bits(v), 8)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.int(i)
+			break
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return err
+		}
+		e.header(0xcb, math.Float64bits(f), 8)
+	case string:
+		e.str(v)
+	case []byte:
+		switch n := len(v); {
+		case n <= math.MaxUint8:
+			e.header(0xc4, uint64(n), 1)
+		case n <= math.MaxUint16:
+			e.header(0xc5, uint64(n), 2)
+		default:
+			e.header(0xc6, uint64(n), 4)
+		}
+		e.buf.Write(v)
+	case msgpackExt:
+		switch n := len(v.Data); n {
+		case 1, 2, 4, 8, 16:
+			e.buf.WriteByte(0xd4 + byte(bitsLen(n)))
+		default:
+			switch {
+			case n <= math.MaxUint8:
+				e.header(0xc7, uint64(n), 1)
+			case n <= math.MaxUint16:
+				e.header(0xc8, uint64(n), 2)
+			default:
+				e.header(0xc9, uint64(n), 4)
+			}
+		}
+		e.buf.WriteByte(byte(v.Type))
+		e.buf.Write(v.Data)
+	case []interface{}:
+		e.arrayHeader(len(v))
+		for _, x := range v {
+			if err := e.value(x); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.mapHeader(len(keys))
+		for _, k := range keys {
+			e.str(k)
+			if err := e.value(v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// bitsLen returns log2 of the power of two n.
+func bitsLen(n int) int {
+	i := 0
+	for n > 1 {
+		n >>= 1
+		i++
+	}
+	return i
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// msgpackResponse is the response of InfluxDB to SELECT * FROM m with one
+// point, with the time encoded as timestamp extension.
+var msgpackResponse = []byte{
+	0x81, 0xa7, 'r', 'e', 's', 'u', 'l', 't', 's', 0x91,
+	0x82, 0xac, 's', 't', 'a', 't', 'e', 'm', 'e', 'n', 't', '_', 'i', 'd', 0x00,
+	0xa6, 's', 'e', 'r', 'i', 'e', 's', 0x91,
+	0x83, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'm',
+	0xa7, 'c', 'o', 'l', 'u', 'm', 'n', 's', 0x92, 0xa4, 't', 'i', 'm', 'e', 0xa1, 'v',
+	0xa6, 'v', 'a', 'l', 'u', 'e', 's', 0x91, 0x92,
+	0xc7, 0x0c, 0x05, 0, 0, 0, 0, 0x5e, 0xd4, 0x49, 0x40, 0, 0, 0, 0,
+	0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+}
+
+func TestMsgpackResponses(t *testing.T) {
+	resps, err := decodeMsgpackResponses(msgpackResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*influxResponse{{Results: []influxResult{{
+		Series: []influxSeries{{
+			Name:    "m",
+			Columns: []string{"time", "v"},
+			Values: [][]interface{}{{
+				msgpackExt{Type: 5, Data: []byte{0, 0, 0, 0, 0x5e, 0xd4, 0x49, 0x40, 0, 0, 0, 0}},
+				1.5,
+			}},
+		}},
+	}}}}
+	if !reflect.DeepEqual(resps, want) {
+		t.Fatalf("got %+v, want %+v", resps, want)
+	}
+
+	b, err := encodeMsgpackResponses(resps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, msgpackResponse) {
+		t.Fatalf("got % x, want % x", b, msgpackResponse)
+	}
+
+	if _, err := decodeMsgpackResponses(msgpackResponse[:len(msgpackResponse)-1]); err == nil {
+		t.Fatal("expected error for truncated response")
+	}
+}
+
+func TestMsgpackValues(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	testCases := map[string]interface{}{
+		"nil":         nil,
+		"true":        true,
+		"false":       false,
+		"fixint":      int64(7),
+		"negFixint":   int64(-7),
+		"int8":        int64(-100),
+		"int16":       int64(1000),
+		"int32":       int64(-100000),
+		"int64":       int64(math.MinInt64),
+		"uint64":      uint64(math.MaxUint64),
+		"float":       3.25,
+		"str":         "station",
+		"str16":       long,
+		"bin":         []byte{1, 2, 3},
+		"fixext":      msgpackExt{Type: 1, Data: []byte{1, 2, 3, 4}},
+		"array":       []interface{}{int64(1), "a", nil},
+		"map":         map[string]interface{}{"a": int64(1), "b": []interface{}{true}},
+		"mapNotFixed": map[string]interface{}{"a": nil, "b": nil, "c": nil, "d": nil, "e": nil, "f": nil, "g": nil, "h": nil, "i": nil, "j": nil, "k": nil, "l": nil, "m": nil, "n": nil, "o": nil, "p": nil},
+	}
+
+	for name, v := range testCases {
+		t.Run(name, func(t *testing.T) {
+			e := new(msgpackEncoder)
+			if err := e.value(v); err != nil {
+				t.Fatal(err)
+			}
+			d := &msgpackDecoder{b: e.buf.Bytes()}
+			got, err := d.value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, v) {
+				t.Fatalf("got %#v, want %#v", got, v)
+			}
+			if d.off != len(d.b) {
+				t.Fatalf("%d bytes left", len(d.b)-d.off)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Query parameter errors.
+var (
+	ErrInvalidEpoch     = errors.New("invalid epoch, must be one of h, m, s, ms, u, µ or ns")
+	ErrEpochRequired    = errors.New("epoch parameter required")
+	ErrUnknownParameter = errors.New("unknown query parameter")
+	ErrUnknownEndpoint  = errors.New("unknown endpoint")
+)
+
+// Epoch modes of Params.
+const (
+	EpochInject  = "inject"  // set the epoch if the client did not.
+	EpochRequire = "require" // reject queries without epoch.
+	EpochForce   = "force"   // override the epoch of the client.
+)
+
+// validEpochs are the precisions accepted by InfluxDB for the epoch
+// parameter.
+var validEpochs = map[string]bool{"h": true, "m": true, "s": true, "ms": true, "u": true, "µ": true, "ns": true}
+
+// knownParams are the query parameters understood by the endpoints. Paths
+// ending with a slash stand for all paths below them.
+var knownParams = map[string]map[string]bool{
+	"/ping": {
+		"verbose": true, "wait_for_leader": true,
+	},
+	"/query": {
+		"q": true, "db": true, "rp": true, "epoch": true, "chunked": true, "chunk_size": true,
+		"pretty": true, "params": true, "u": true, "p": true,
+	},
+	"/export": {
+		"q": true, "db": true, "rp": true, "format": true, "chunk": true, "u": true, "p": true,
+	},
+	"/export/": {
+		"u": true, "p": true,
+	},
+	"/catalog": {
+		"db": true, "limit": true, "offset": true, "u": true, "p": true,
+	},
+	"/api.json": {
+		"u": true, "p": true,
+	},
+	"/debug/version": {},
+	"/write":         {},
+}
+
+// strict reports whether the profile rejects requests the proxy does not
+// understand.
+func (prof *profile) strict() bool {
+	return prof.params != nil && prof.params.Strict
+}
+
+// checkEndpoint checks, if the profile is strict, that the endpoint of r
+// exists and that r has no query parameters other than the ones understood
+// by the endpoint or passed through by the profile.
+func (prof *profile) checkEndpoint(r *http.Request) error {
+	if !prof.strict() {
+		return nil
+	}
+	path := r.URL.Path
+	if i := strings.Index(strings.TrimPrefix(path, "/"), "/"); i >= 0 && knownParams[path[:i+2]] != nil {
+		path = path[:i+2]
+	}
+	known, ok := knownParams[path]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownEndpoint, r.URL.Path)
+	}
+
+	var unknown []string
+	for k := range r.URL.Query() {
+		if !known[k] && !prof.params.passes(k) {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%w: %v", ErrUnknownParameter, unknown)
+	}
+	return nil
+}
+
+// passes reports whether the query parameter k is passed through to the
+// backend in strict mode.
+func (ps *Params) passes(k string) bool {
+	for _, p := range ps.Passthrough {
+		if p == k {
+			return true
+		}
+	}
+	return false
+}
+
+// checkParams validates the query parameters of r and applies the epoch
+// settings of the profile.
+func (prof *profile) checkParams(r *http.Request) error {
+	params := r.URL.Query()
+	if epoch := params.Get("epoch"); epoch != "" && !validEpochs[epoch] {
+		return fmt.Errorf("%w: %q", ErrInvalidEpoch, epoch)
+	}
+
+	if err := prof.checkEndpoint(r); err != nil {
+		return err
+	}
+	ps := prof.params
+	if ps == nil {
+		return nil
+	}
+
+	if r.URL.Path != "/query" {
+		return nil
+	}
+	switch ps.EpochMode {
+	case EpochRequire:
+		if params.Get("epoch") == "" {
+			return ErrEpochRequired
+		}
+		return nil
+	case EpochForce:
+		params.Set("epoch", ps.Epoch)
+	default:
+		if ps.Epoch == "" || params.Get("epoch") != "" {
+			return nil
+		}
+		params.Set("epoch", ps.Epoch)
+	}
+	r.URL.RawQuery = params.Encode()
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckParams(t *testing.T) {
+	testCases := map[string]struct {
+		params *Params
+		url    string
+		want   string // epoch sent to the backend.
+		err    error
+	}{
+		"unchanged":      {nil, "/query?q=x&epoch=ms", "ms", nil},
+		"invalidEpoch":   {nil, "/query?q=x&epoch=sec", "", ErrInvalidEpoch},
+		"inject":         {&Params{Epoch: "ms"}, "/query?q=x", "ms", nil},
+		"injectKeeps":    {&Params{Epoch: "ms"}, "/query?q=x&epoch=s", "s", nil},
+		"force":          {&Params{Epoch: "ms", EpochMode: EpochForce}, "/query?q=x&epoch=s", "ms", nil},
+		"require":        {&Params{EpochMode: EpochRequire}, "/query?q=x&epoch=ns", "ns", nil},
+		"requireMissing": {&Params{EpochMode: EpochRequire}, "/query?q=x", "", ErrEpochRequired},
+		"exportNoEpoch":  {&Params{Epoch: "ms"}, "/export?q=x&format=csv", "", nil},
+		"lenient":        {&Params{}, "/query?q=x&foo=1", "", nil},
+		"strict":         {&Params{Strict: true}, "/query?q=x&db=db0&chunked=true&pretty=true", "", nil},
+		"strictUnknown":  {&Params{Strict: true}, "/query?q=x&foo=1", "", ErrUnknownParameter},
+		"strictExport":   {&Params{Strict: true}, "/export?q=x&format=lp&chunk=1h", "", nil},
+		"strictEndpoint": {&Params{Strict: true}, "/export?q=x&chunked=true", "", ErrUnknownParameter},
+		"passthrough":    {&Params{Strict: true, Passthrough: []string{"trace"}}, "/query?q=x&trace=1", "", nil},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			prof := newProfile(Profile{Params: tc.params}, false)
+			r := httptest.NewRequest("GET", tc.url, nil)
+			err := prof.checkParams(r)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := r.URL.Query().Get("epoch"); got != tc.want {
+				t.Fatalf("got epoch %q, want %q", got, tc.want)
+			}
+			if r.URL.Query().Get("q") != "x" {
+				t.Fatalf("lost parameters: %s", r.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func TestStrictEndpoints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("m")
+	cfg.Profiles = []Profile{{Name: "strict", Prefix: "/strict", Measurements: []Measurement{{Name: "m"}}, Params: &Params{Strict: true}}}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		url    string
+		status int
+		err    string // prefix of the JSON error, empty for plain responses.
+	}{
+		"lenientUnknownPath":   {"/foo", http.StatusNotFound, ""},
+		"lenientUnknownParam":  {"/ping?foo=1", http.StatusNoContent, ""},
+		"strictPing":           {"/strict/ping?verbose=true", http.StatusNoContent, ""},
+		"strictPingParam":      {"/strict/ping?foo=1", http.StatusBadRequest, "unknown query parameter"},
+		"strictUnknownPath":    {"/strict/foo", http.StatusNotFound, "unknown endpoint"},
+		"strictUnknownSubpath": {"/strict/ping/foo", http.StatusNotFound, "unknown endpoint"},
+		"strictCatalogParam":   {"/strict/catalog?sort=name", http.StatusBadRequest, "unknown query parameter"},
+		"strictQueryParam":     {"/strict/query?q=SELECT+*+FROM+m&foo=1", http.StatusBadRequest, "unknown query parameter"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.err != "" && !strings.HasPrefix(w.Body.String(), `{"error":"`+tc.err) {
+				t.Fatalf("got body %s, want error %q", w.Body, tc.err)
+			}
+		})
+	}
+}
+
+func TestInvalidEpochRejected(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	p, err := NewProxy("http://localhost:8086", sourcesConfig("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q=SELECT+*+FROM+m&epoch=sec", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
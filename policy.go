@@ -0,0 +1,227 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// policy is an immutable snapshot of the policy profiles. On reload it is
+// replaced as a whole, so that each request is decided by a single, complete
+// version of the policy, even while a new one is applied.
+type policy struct {
+	version        uint64
+	loaded         time.Time
+	checksum       string     // of the configuration, see configChecksum.
+	profiles       []*profile // named profiles, in configuration order.
+	defaultProfile *profile
+	warmup         *Warmup      // nil if there are no warm-up queries.
+	grafana        *grafanaMode // nil if Grafana requests are not recognized.
+	admin          *profile     // authenticates requests to the admin listener.
+	sentry         *Sentry      // error reporting, which a reload cannot change.
+}
+
+// policy returns the current policy.
+func (p *Proxy) policy() *policy {
+	return p.pol.Load().(*policy)
+}
+
+// Reload applies the policy profiles of cfg. Requests already being served
+// keep using the previous policy. The state of rate limits and SLOs is kept
+// if they did not change. Changes of the Sentry settings are rejected, as
+// they are only applied at startup.
+func (p *Proxy) Reload(cfg *Config) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	prev := p.policy()
+	if !sameSentry(prev.sentry, cfg.Sentry) {
+		return errors.New("sentry settings changed: restart the proxy to apply them")
+	}
+	pol, err := p.newPolicy(cfg, prev)
+	if err != nil {
+		return err
+	}
+	pol.version = prev.version + 1
+	p.pol.Store(pol)
+	setInfoMetrics(pol)
+
+	auditLog.Info("policy applied", "policy", pol.version, "profiles", len(pol.profiles))
+	return nil
+}
+
+// newPolicy builds the policy of cfg. Rate limiters, SLO trackers,
+// cardinality caches and shadowers of prev, which may be nil, are reused if
+// they did not change.
+func (p *Proxy) newPolicy(cfg *Config, prev *policy) (*policy, error) {
+	rp, err := p.newReverseProxy(p.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pol := &policy{loaded: time.Now(), checksum: configChecksum(cfg), defaultProfile: newProfile(cfg.Profile, cfg.CaseInsensitive), sentry: cfg.Sentry}
+	pol.defaultProfile.backend, pol.defaultProfile.proxy = p.addr, rp
+	for _, c := range cfg.Profiles {
+		prof := newProfile(c, cfg.CaseInsensitive)
+		prof.backend, prof.proxy = p.addr, rp
+		if c.Backend != "" {
+			prof.backend = c.Backend
+			prof.proxy, err = p.newReverseProxy(c.Backend)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: %w", c.Name, err)
+			}
+		}
+		pol.profiles = append(pol.profiles, prof)
+	}
+	profs := append([]*profile{pol.defaultProfile}, pol.profiles...)
+	for i, c := range append([]Profile{cfg.Profile}, cfg.Profiles...) {
+		if c.Shadow == nil {
+			continue
+		}
+		profs[i].shadow, err = newShadower(*c.Shadow)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: shadow: %w", profs[i].name, err)
+		}
+	}
+
+	for i, c := range append([]Profile{cfg.Profile}, cfg.Profiles...) {
+		if c.Access == nil {
+			continue
+		}
+		profs[i].access, err = newAccessPolicy(c.Access)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: access: %w", profs[i].name, err)
+		}
+	}
+
+	if w := cfg.Warmup; w != nil {
+		for _, q := range w.Queries {
+			prof := pol.warmupProfile(q)
+			if prof == nil {
+				return nil, fmt.Errorf("warmup %q: unknown profile %q", q.Name, q.Profile)
+			}
+			if _, err := validate(q.Query, prof.allows); err != nil {
+				return nil, fmt.Errorf("warmup %q: %w", q.Name, err)
+			}
+		}
+		pol.warmup = w
+	}
+	pol.admin = newProfile(Profile{Name: "admin", Auth: cfg.AdminAuth}, false)
+	if cfg.Grafana != nil {
+		pol.grafana, err = newGrafanaMode(cfg.Grafana, pol)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil {
+		for _, prof := range append([]*profile{pol.defaultProfile}, pol.profiles...) {
+			old := prev.profile(prof.name)
+			if old == nil {
+				continue
+			}
+			if old.limiter.sameRate(prof.limiter) {
+				prof.limiter = old.limiter
+			}
+			if old.stmtLimiter.sameRate(prof.stmtLimiter) {
+				prof.stmtLimiter = old.stmtLimiter
+			}
+			if old.cardinality != nil && prof.cardinality != nil && old.backend == prof.backend && old.maxSeries == prof.maxSeries {
+				prof.cardinality = old.cardinality
+			}
+			if old.shadow != nil && prof.shadow != nil && old.shadow.Shadow == prof.shadow.Shadow {
+				prof.shadow = old.shadow
+			}
+			for i, s := range prof.slos {
+				for _, o := range old.slos {
+					if o.SLO == s.SLO {
+						prof.slos[i] = o
+					}
+				}
+			}
+		}
+	}
+	return pol, nil
+}
+
+// sameSentry reports whether the Sentry settings a and b, which may be nil,
+// are equal.
+func sameSentry(a, b *Sentry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// profile returns the profile with the given name or nil.
+func (pol *policy) profile(name string) *profile {
+	if name == pol.defaultProfile.name {
+		return pol.defaultProfile
+	}
+	for _, prof := range pol.profiles {
+		if prof.name == name {
+			return prof
+		}
+	}
+	return nil
+}
+
+// audit logs a decision about a query of client together with the version of
+// the policy it was made by.
+func audit(pol *policy, prof *profile, client, decision string, kv ...interface{}) {
+	kv = append([]interface{}{"policy", pol.version, "profile", prof.name, "client", client}, kv...)
+	auditLog.Info(decision, kv...)
+}
+
+// profileInfo describes a profile on the admin listener.
+type profileInfo struct {
+	Name         string   `json:"name"`
+	Prefix       string   `json:"prefix,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+	Backend      string   `json:"backend"`
+	Measurements []string `json:"measurements"`
+}
+
+// profileInfos describes the profiles of pol, starting with the default
+// profile.
+func (pol *policy) profileInfos() []profileInfo {
+	var infos []profileInfo
+	for _, prof := range append([]*profile{pol.defaultProfile}, pol.profiles...) {
+		info := profileInfo{
+			Name:         prof.name,
+			Prefix:       prof.prefix,
+			Hosts:        prof.hosts,
+			Backend:      prof.backend,
+			Measurements: []string{},
+		}
+		for _, m := range prof.measurements {
+			info.Measurements = append(info.Measurements, m.Name)
+		}
+		sort.Strings(info.Measurements)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// policyHandler serves the current policy as JSON on the admin listener.
+func (p *Proxy) policyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pol := p.policy()
+		resp := struct {
+			Version  uint64        `json:"version"`
+			Loaded   time.Time     `json:"loaded"`
+			Checksum string        `json:"checksum"`
+			Profiles []profileInfo `json:"profiles"`
+		}{Version: pol.version, Loaded: pol.loaded, Checksum: pol.checksum, Profiles: pol.profileInfos()}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	logs := captureLogs(t, "info", "console")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, err := NewProxy(backend.URL, sourcesConfig("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(q string) int {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+strings.ReplaceAll(q, " ", "+"), nil))
+		return w.Code
+	}
+
+	if got := query("SELECT * FROM b"); got != http.StatusNotAcceptable {
+		t.Fatalf("before reload: got status %d, want %d", got, http.StatusNotAcceptable)
+	}
+	if err := p.Reload(sourcesConfig("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := query("SELECT * FROM b"); got != http.StatusOK {
+		t.Fatalf("after reload: got status %d, want %d", got, http.StatusOK)
+	}
+	if v := p.policy().version; v != 1 {
+		t.Fatalf("got version %d, want 1", v)
+	}
+
+	_, fp := fingerprint(mustParseQuery(t, "SELECT * FROM b"))
+	for _, want := range []string{
+		`audit: query rejected policy=0 profile=default client=ip:192.0.2.1 reason=not_allowed`,
+		`audit: policy applied policy=1`,
+		`audit: query allowed policy=1 profile=default client=ip:192.0.2.1 fingerprint=` + fp,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("got logs %q, want %q", logs.String(), want)
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	p, err := NewProxy("http://localhost:8086", sourcesConfig("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := sourcesConfig("b")
+	cfg.Profiles = []Profile{{Name: "x", Prefix: "/x", Backend: "http://[::1"}}
+	if err := p.Reload(cfg); err == nil {
+		t.Fatal("expected error for invalid backend")
+	}
+	if pol := p.policy(); pol.version != 0 || !pol.defaultProfile.allows("a") {
+		t.Fatalf("got policy version %d, want previous policy to stay in place", pol.version)
+	}
+}
+
+func TestReloadSentry(t *testing.T) {
+	cfg := sourcesConfig("a")
+	cfg.Sentry = &Sentry{DSN: "https://key@sentry.example.com/1"}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = sourcesConfig("a", "b")
+	cfg.Sentry = &Sentry{DSN: "https://key@sentry.example.com/1"}
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = sourcesConfig("a", "b")
+	cfg.Sentry = &Sentry{DSN: "https://key@sentry.example.com/2"}
+	if err := p.Reload(cfg); err == nil {
+		t.Fatal("expected error for changed sentry settings")
+	}
+	if err := p.Reload(sourcesConfig("a", "b")); err == nil {
+		t.Fatal("expected error for removed sentry settings")
+	}
+	if v := p.policy().version; v != 1 {
+		t.Fatalf("got version %d, want 1", v)
+	}
+}
+
+func TestReloadCardinality(t *testing.T) {
+	cfg := sourcesConfig("a")
+	cfg.Profile.MaxSeries = 100
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := p.policy().defaultProfile.cardinality
+
+	cfg = sourcesConfig("a", "b")
+	cfg.Profile.MaxSeries = 100
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if p.policy().defaultProfile.cardinality != c {
+		t.Fatal("cardinality cache not kept for unchanged max_series")
+	}
+
+	cfg.Profile.MaxSeries = 10
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if p.policy().defaultProfile.cardinality == c {
+		t.Fatal("cardinality cache kept for changed max_series")
+	}
+}
+
+func TestReloadRateLimit(t *testing.T) {
+	cfg := func(requests float64) *Config {
+		c := sourcesConfig("a")
+		c.RateLimit = &RateLimit{Requests: requests, Per: duration(time.Minute)}
+		return c
+	}
+
+	p, err := NewProxy("http://localhost:8086", cfg(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.policy().defaultProfile.allow("c") {
+		t.Fatal("first query not allowed")
+	}
+
+	// An unchanged rate limit keeps its state.
+	captureLogs(t, "info", "console")
+	if err := p.Reload(cfg(1)); err != nil {
+		t.Fatal(err)
+	}
+	if p.policy().defaultProfile.allow("c") {
+		t.Fatal("rate limit reset by reload")
+	}
+
+	if err := p.Reload(cfg(2)); err != nil {
+		t.Fatal(err)
+	}
+	if !p.policy().defaultProfile.allow("c") {
+		t.Fatal("changed rate limit not applied")
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, err := NewProxy(backend.URL, sourcesConfig("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q=SELECT+*+FROM+a", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := p.Reload(sourcesConfig("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestPolicyHandler(t *testing.T) {
+	cfg := sourcesConfig("b", "a")
+	cfg.Profiles = []Profile{{Name: "open", Prefix: "/open", Measurements: []Measurement{{Name: "c"}}}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/policy", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var got struct {
+		Version  uint64
+		Profiles []struct {
+			Name         string
+			Prefix       string
+			Measurements []string
+		}
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 0 || len(got.Profiles) != 2 {
+		t.Fatalf("got %+v, want version 0 with 2 profiles", got)
+	}
+	if m := strings.Join(got.Profiles[0].Measurements, ","); got.Profiles[0].Name != defaultProfileName || m != "a,b" {
+		t.Fatalf("got default profile %+v, want measurements a,b", got.Profiles[0])
+	}
+	if p := got.Profiles[1]; p.Name != "open" || p.Prefix != "/open" {
+		t.Fatalf("got profile %+v, want open at /open", p)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultProfileName is the name of the profile formed by the top level
+// configuration.
+const defaultProfileName = "default"
+
+// profile is the runtime representation of a policy profile.
+type profile struct {
+	name         string
+	backend      string                 // address of the InfluxDB server.
+	proxy        *httputil.ReverseProxy // reverse proxy to backend.
+	shadow       *shadower              // nil if queries are not mirrored.
+	prefix       string
+	hosts        []string
+	fold         bool                                  // match measurement names case insensitive.
+	measurements map[string]Measurement                // allowed measurements by key, see profile.key.
+	tagValues    map[string]map[string]map[string]bool // visible tag values, see visibleTagValues.
+	aliases      map[string]string                     // measurement by key of its alias, nil if not aliased.
+	publicNames  map[string]string                     // alias by key of the measurement, nil if not aliased.
+	tombstones   map[string]tombstone                  // deprecated measurements by key, nil if there are none.
+	databases    map[string]string                     // backend database by public name, nil if not mapped.
+	limiter      *rateLimiter                          // nil if not rate limited.
+	stmtLimiter  *rateLimiter                          // statements per client, nil if not limited.
+	users        map[string][]byte                     // bcrypt hashed passwords, nil if no auth is required.
+	maxSeries    int64                                 // 0 if the series cardinality is not checked.
+	cardinality  *cardinalityCache                     // cached series cardinalities, nil if not checked.
+	queryTimeout time.Duration                         // 0 if queries have no deadline.
+	split        int                                   // statements run at once if split, 0 if not split.
+	params       *Params                               // nil if parameters are passed unchanged.
+	authorizer   *authorizer                           // nil if there is no external authorizer.
+	access       *accessPolicy                         // nil if queries are allowed at all times.
+	slos         []*sloTracker
+
+	// verified caches the SHA-256 sum of successfully verified passwords,
+	// as bcrypt is deliberately slow.
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// newProfile returns the profile for cfg. Measurement names are matched case
+// insensitive if caseInsensitive is set, otherwise case sensitive like
+// InfluxDB does.
+func newProfile(cfg Profile, caseInsensitive bool) *profile {
+	prof := &profile{
+		name:         cfg.Name,
+		prefix:       cfg.Prefix,
+		hosts:        cfg.Hosts,
+		fold:         caseInsensitive,
+		measurements: make(map[string]Measurement),
+		databases:    cfg.Databases,
+		maxSeries:    cfg.MaxSeries,
+		queryTimeout: time.Duration(cfg.QueryTimeout),
+		split:        cfg.SplitStatements,
+		params:       cfg.Params,
+	}
+	if prof.name == "" {
+		prof.name = defaultProfileName
+	}
+	for _, m := range cfg.Measurements {
+		prof.measurements[prof.key(m.Name)] = m
+	}
+	prof.tagValues = visibleTagValues(cfg.Measurements, prof.key)
+	prof.aliases, prof.publicNames = newAliases(cfg.Aliases, prof.key)
+	prof.tombstones = newTombstones(cfg.Tombstones, prof.key)
+	if cfg.MaxSeries > 0 {
+		prof.cardinality = newCardinalityCache()
+	}
+	if rl := cfg.RateLimit; rl != nil {
+		prof.limiter = newRateLimiter(rl.Requests, time.Duration(rl.Per), rl.Burst)
+	}
+	if sl := cfg.StatementLimit; sl != nil {
+		prof.stmtLimiter = newRateLimiter(sl.Statements, time.Duration(sl.Per), sl.Burst)
+	}
+	for _, s := range cfg.SLOs {
+		prof.slos = append(prof.slos, &sloTracker{SLO: s, profile: prof.name})
+	}
+	if cfg.Authorizer != nil {
+		prof.authorizer = newAuthorizer(*cfg.Authorizer)
+	}
+	if cfg.Auth != nil {
+		prof.users = make(map[string][]byte)
+		prof.verified = make(map[string][sha256.Size]byte)
+		for u, hash := range cfg.Auth.Users {
+			prof.users[u] = []byte(hash)
+		}
+	}
+	return prof
+}
+
+// key returns the key of the measurement name used for matching it against
+// the configured measurements.
+func (prof *profile) key(name string) string {
+	if prof.fold {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// allows reports whether the measurement name is allowed to be queried.
+// Aliased measurements are allowed by their alias only.
+func (prof *profile) allows(name string) bool {
+	name, ok := prof.measurementName(name)
+	if !ok {
+		return false
+	}
+	_, ok = prof.measurements[prof.key(name)]
+	return ok
+}
+
+// selectProfile returns the profile serving r and the request path relative
+// to the prefix of the profile. Profiles selected by the Host header take
+// precedence over profiles selected by path prefix. Requests of trusted
+// Grafana instances are served by the Grafana profile, if configured.
+func (pol *policy) selectProfile(r *http.Request) (*profile, string) {
+	prof, path := pol.matchProfile(r)
+	return pol.grafanaProfile(r, prof), path
+}
+
+// matchProfile returns the profile selected by the host or path prefix of r
+// and the request path relative to the prefix.
+func (pol *policy) matchProfile(r *http.Request) (*profile, string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var match *profile
+	for _, prof := range pol.profiles {
+		for _, h := range prof.hosts {
+			if strings.EqualFold(h, host) {
+				match = prof
+				break
+			}
+		}
+		if match != nil {
+			break
+		}
+	}
+
+	if match == nil {
+		for _, prof := range pol.profiles {
+			if prof.prefix == "" || !hasPathPrefix(r.URL.Path, prof.prefix) {
+				continue
+			}
+			if match == nil || len(prof.prefix) > len(match.prefix) {
+				match = prof
+			}
+		}
+	}
+
+	if match == nil {
+		return pol.defaultProfile, r.URL.Path
+	}
+	if match.prefix != "" && hasPathPrefix(r.URL.Path, match.prefix) {
+		return match, strings.TrimPrefix(r.URL.Path, match.prefix)
+	}
+	return match, r.URL.Path
+}
+
+// hasPathPrefix reports whether path equals prefix or is below it.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// authenticate checks the credentials of r, given either with basic
+// authentication or with the u and p query parameters, and removes them
+// from the request. It returns the user name, which is empty if the profile
+// does not require authentication.
+func (prof *profile) authenticate(r *http.Request) (string, error) {
+	if prof.users == nil {
+		return "", nil
+	}
+
+	user, pass, ok := r.BasicAuth()
+	q := r.URL.Query()
+	if !ok {
+		user, pass = q.Get("u"), q.Get("p")
+	}
+	r.Header.Del("Authorization")
+	if q.Get("u") != "" || q.Get("p") != "" {
+		q.Del("u")
+		q.Del("p")
+		r.URL.RawQuery = q.Encode()
+	}
+
+	hash, ok := prof.users[user]
+	if user == "" || !ok {
+		return "", ErrUnauthorized
+	}
+
+	sum := sha256.Sum256([]byte(pass))
+	prof.mu.Lock()
+	v, ok := prof.verified[user]
+	prof.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(v[:], sum[:]) == 1 {
+		return user, nil
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return "", ErrUnauthorized
+	}
+	prof.mu.Lock()
+	prof.verified[user] = sum
+	prof.mu.Unlock()
+	return user, nil
+}
+
+// allow reports whether the client may issue another query according to the
+// rate limit of the profile.
+func (prof *profile) allow(client string) bool {
+	if prof.limiter == nil {
+		return true
+	}
+	return prof.limiter.take(client, 1, time.Now())
+}
+
+// allowStatements reports whether the client may send n more statements
+// according to the statement limit of the profile.
+func (prof *profile) allowStatements(client string, n int) bool {
+	if prof.stmtLimiter == nil {
+		return true
+	}
+	return prof.stmtLimiter.take(client, float64(n), time.Now())
+}
+
+// clientID identifies the client of r for rate limiting, either by the
+// authenticated user or by the remote IP address.
+func clientID(r *http.Request, user string) string {
+	if user != "" {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
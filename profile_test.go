@@ -0,0 +1,286 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSelectProfile(t *testing.T) {
+	p, err := NewProxy("http://localhost:8086", &Config{
+		Profiles: []Profile{
+			{Name: "open", Prefix: "/open"},
+			{Name: "partner", Prefix: "/partner"},
+			{Name: "partnerB", Prefix: "/partner/b"},
+			{Name: "sensors", Hosts: []string{"sensors.example.org"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		host, path string
+		profile    string
+		wantPath   string
+	}{
+		"default":      {"localhost", "/query", defaultProfileName, "/query"},
+		"prefix":       {"localhost", "/open/query", "open", "/query"},
+		"prefixOnly":   {"localhost", "/open", "open", ""},
+		"notPrefix":    {"localhost", "/opener/query", defaultProfileName, "/opener/query"},
+		"longest":      {"localhost", "/partner/b/query", "partnerB", "/query"},
+		"shorter":      {"localhost", "/partner/query", "partner", "/query"},
+		"host":         {"sensors.example.org", "/query", "sensors", "/query"},
+		"hostPort":     {"Sensors.Example.org:443", "/ping", "sensors", "/ping"},
+		"hostOverPath": {"sensors.example.org", "/open/query", "sensors", "/open/query"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			r.Host = tc.host
+
+			prof, path := p.policy().selectProfile(r)
+			if prof.name != tc.profile {
+				t.Fatalf("got profile %q, want %q", prof.name, tc.profile)
+			}
+			if path != tc.wantPath {
+				t.Fatalf("got path %q, want %q", path, tc.wantPath)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := newProfile(Profile{Auth: &Auth{Users: map[string]string{"alice": string(hash)}}}, false)
+
+	testCases := map[string]struct {
+		url        string
+		user, pass string
+		want       error
+	}{
+		"basic":      {"/query?q=x", "alice", "secret", nil},
+		"basicWrong": {"/query?q=x", "alice", "wrong", ErrUnauthorized},
+		"params":     {"/query?q=x&u=alice&p=secret", "", "", nil},
+		"paramsUser": {"/query?q=x&u=bob&p=secret", "", "", ErrUnauthorized},
+		"none":       {"/query?q=x", "", "", ErrUnauthorized},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// Twice to cover the cache of verified passwords.
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest("GET", tc.url, nil)
+				if tc.user != "" {
+					r.SetBasicAuth(tc.user, tc.pass)
+				}
+
+				_, err := prof.authenticate(r)
+				if err != tc.want {
+					t.Fatalf("got %v, want %v", err, tc.want)
+				}
+				if r.Header.Get("Authorization") != "" {
+					t.Fatal("Authorization header not removed")
+				}
+				if q := r.URL.Query(); q.Get("u") != "" || q.Get("p") != "" || q.Get("q") != "x" {
+					t.Fatalf("credentials not removed or query modified: %q", r.URL.RawQuery)
+				}
+			}
+		})
+	}
+}
+
+func TestProfileEndpoints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" && r.URL.Path != "/ping" {
+			t.Errorf("backend got path %q", r.URL.Path)
+		}
+		if r.URL.Query().Get("p") != "" {
+			t.Error("backend got credentials")
+		}
+	}))
+	defer backend.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(backend.URL, &Config{
+		Profile: Profile{Measurements: []Measurement{{Name: "public"}}},
+		Profiles: []Profile{
+			{
+				Name:         "open",
+				Prefix:       "/open",
+				Measurements: []Measurement{{Name: "open"}},
+				RateLimit:    &RateLimit{Requests: 2, Per: duration(time.Hour)},
+			},
+			{
+				Name:         "partner",
+				Prefix:       "/partner",
+				Measurements: []Measurement{{Name: "private"}},
+				Auth:         &Auth{Users: map[string]string{"alice": string(hash)}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	testCases := []struct {
+		path  string
+		query string
+		want  int
+	}{
+		{"/query", "select * from public", http.StatusOK},
+		{"/query", "select * from open", http.StatusNotAcceptable},
+		{"/open/ping", "", http.StatusOK},
+		{"/open/query", "select * from open", http.StatusOK},
+		{"/open/query", "select * from public", http.StatusNotAcceptable},
+		{"/open/query", "select * from open", http.StatusTooManyRequests},
+		{"/partner/query", "select * from private", http.StatusUnauthorized},
+		{"/partner/query?u=alice&p=secret", "select * from private", http.StatusOK},
+		{"/partner/query?u=alice&p=secret", "select * from open", http.StatusNotAcceptable},
+	}
+
+	for _, tc := range testCases {
+		u := ts.URL + tc.path
+		if tc.query != "" {
+			sep := "?"
+			if strings.Contains(tc.path, "?") {
+				sep = "&"
+			}
+			u += sep + "q=" + url.QueryEscape(tc.query)
+		}
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %q: got %q, want %q", tc.path, tc.query, resp.Status, http.StatusText(tc.want))
+		}
+	}
+}
+
+func TestVirtualHostBackend(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+		}))
+	}
+	main, sensors := newBackend("main"), newBackend("sensors")
+	defer main.Close()
+	defer sensors.Close()
+
+	p, err := NewProxy(main.URL, &Config{
+		Profile: Profile{Measurements: []Measurement{{Name: "data"}}},
+		Profiles: []Profile{
+			{
+				Name:         "sensors",
+				Hosts:        []string{"sensors.example.org"},
+				Backend:      sensors.URL,
+				Measurements: []Measurement{{Name: "sensor"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	testCases := []struct {
+		host, query string
+		status      int
+		backend     string
+	}{
+		{"data.example.org", "select * from data", http.StatusOK, "main"},
+		{"data.example.org", "select * from sensor", http.StatusNotAcceptable, ""},
+		{"sensors.example.org", "select * from sensor", http.StatusOK, "sensors"},
+		{"sensors.example.org", "select * from data", http.StatusNotAcceptable, ""},
+	}
+
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", ts.URL+"/query?q="+url.QueryEscape(tc.query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tc.host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %q: got %q, want %q", tc.host, tc.query, resp.Status, http.StatusText(tc.status))
+		}
+		if got := resp.Header.Get("X-Backend"); got != tc.backend {
+			t.Errorf("%s %q: got backend %q, want %q", tc.host, tc.query, got, tc.backend)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	cfg := Profile{
+		Measurements: []Measurement{
+			{Name: "M0"},
+			{Name: "m1", TagValues: map[string][]string{"station": {"s1"}}},
+		},
+	}
+
+	testCases := map[string]struct {
+		query string
+		fold  bool
+		err   error
+	}{
+		"sensitiveExact":    {"select a FROM M0; select b FROM m1", false, nil},
+		"sensitiveMixed":    {"select a FROM m0", false, ErrQueryNotAllowed},
+		"insensitiveExact":  {"select a FROM M0; select b FROM m1", true, nil},
+		"insensitiveMixed":  {"select a FROM m0; select b FROM M1", true, nil},
+		"insensitiveShow":   {`SHOW TAG VALUES FROM M1 WITH KEY = "station"`, true, nil},
+		"insensitiveRegex":  {"select a FROM /m0/", true, ErrQueryNotAllowed},
+		"insensitiveAbsent": {"select a FROM m2", true, ErrQueryNotAllowed},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			prof := newProfile(cfg, tc.fold)
+			if _, err := validate(tc.query, prof.allows); err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	// SHOW TAG VALUES results are filtered regardless of the case used in
+	// the query and in the response.
+	prof := newProfile(cfg, true)
+	filter := prof.tagValueFilter(mustParseQuery(t, `SHOW TAG VALUES FROM M1 WITH KEY = "station"`))
+	if filter == nil {
+		t.Fatal("no filter for mixed case measurement")
+	}
+	s := influxSeries{
+		Name:    "M1",
+		Columns: []string{"key", "value"},
+		Values:  [][]interface{}{{"station", "s1"}, {"station", "s2"}},
+	}
+	prof.filterTagValues(&s)
+	if len(s.Values) != 1 {
+		t.Fatalf("got %d values, want 1", len(s.Values))
+	}
+}
@@ -5,19 +5,27 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/influxdata/influxql"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -33,12 +41,12 @@ var (
 	ErrQueryNotAllowed   = errors.New("query not allowed")
 	ErrQueryNotSupported = errors.New("query is not supported")
 	ErrMethodNotAllowed  = errors.New("method not allowed")
+	ErrUnauthorized      = errors.New("authorization failed")
+	ErrRateLimited       = errors.New("rate limit exceeded")
+	ErrInternal          = errors.New("internal server error")
 )
 
 func main() {
-	log.SetPrefix("proxy: ")
-	log.SetFlags(0)
-
 	var (
 		listenAddr = flag.String("listen", "localhost:8080", "HTTP listen:port address.")
 		https      = flag.Bool("https", false, "Serve HTTPS.")
@@ -46,24 +54,142 @@ func main() {
 		cacheDir   = flag.String("cache", ".", "Directory for storing LetsEncrypt certificates.")
 		influxAddr = flag.String("addr", "http://localhost:8086", "InfluxDB server address (protocol://host:port)")
 		sources    = flag.String("sources", "", "Comma separated list of  allowed measurements.")
+		configFile = flag.String("config", "", "JSON configuration file with allowed measurements and their settings.")
+		queryCache = flag.String("query-cache", "", "Query response cache backend: memory[:<megabytes>], dir:<path> or redis://host:port[/db]. (Disabled if empty)")
+		cacheTTL   = flag.Duration("query-cache-ttl", time.Minute, "Time to live of cached query responses.")
+		adminAddr  = flag.String("admin", "", "Admin HTTP listen:port address serving metrics. (Disabled if empty)")
+		slowQuery  = flag.Duration("slow-query", 0, "Log queries taking longer than the given duration. (Disabled if 0)")
+		quarantine = flag.Int("log-quarantined", 0, "Log up to the given number of bytes of queries the InfluxQL parser panicked on. (Disabled if 0)")
+		logLevel   = flag.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error.")
+		logFormat  = flag.String("log-format", "console", "Format of log messages: console or json.")
+		flushEvery = flag.Duration("flush-interval", 100*time.Millisecond, "Interval for flushing streamed responses to the client. (Negative flushes after each write)")
+		exportDir  = flag.String("export-dir", "", "Directory for the files of export jobs. (Exports disabled if empty)")
+		exportTTL  = flag.Duration("export-ttl", 24*time.Hour, "Time export jobs and their files are kept after they finished.")
+		maxStmts   = flag.Int("max-statements", 0, "Maximum number of statements executed by the backends at once; further queries wait. (Unlimited if 0)")
+		haLock     = flag.String("ha-lock", "", "Leader election lock for HA deployments: file:<path> or redis://host:port[/db]. Background tasks run on the leader only. (Disabled if empty)")
+		haTTL      = flag.Duration("ha-ttl", 15*time.Second, "Time after which a standby instance takes over the leader lock of a failed leader.")
+		rejections = flag.String("rejections-file", "", "File the rejection analytics of this instance are persisted to. (Kept in memory only if empty)")
+		tlsCert    = flag.String("tls-cert", "", "Certificate file for serving HTTPS, instead of requesting certificates from LetsEncrypt.")
+		tlsKey     = flag.String("tls-key", "", "Private key file of -tls-cert.")
+		tlsCA      = flag.String("tls-client-ca", "", "CA bundle clients must present a certificate signed by. (Client certificates not required if empty)")
+		tlsReload  = flag.Duration("tls-reload", time.Minute, "Interval for checking the certificate, key and CA bundle files for changes. (Disabled if 0)")
 	)
 	flag.Parse()
 
-	if *sources == "" {
-		log.Fatal("at least one source is required")
+	if err := configureLogs(*logLevel, *logFormat); err != nil {
+		proxyLog.Fatal("invalid logging flags", "err", err)
+	}
+
+	// loadConfig reads the configuration file, if any, and adds -sources.
+	loadConfig := func() (*Config, error) {
+		cfg := new(Config)
+		if *configFile != "" {
+			var err error
+			cfg, err = LoadConfig(*configFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if *sources != "" {
+			for _, name := range strings.Split(*sources, ",") {
+				cfg.Measurements = append(cfg.Measurements, Measurement{Name: name})
+			}
+		}
+		if !cfg.hasSources() {
+			return nil, errors.New("at least one source is required")
+		}
+		return cfg, nil
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		proxyLog.Fatal("loading config", "err", err)
 	}
 
-	p, err := NewProxy(*influxAddr, strings.Split(*sources, ","))
+	p, err := NewProxy(*influxAddr, cfg)
 	if err != nil {
-		log.Fatal(err)
+		proxyLog.Fatal("creating proxy", "err", err)
+	}
+	if *queryCache != "" {
+		p.cache, err = NewCache(*queryCache)
+		if err != nil {
+			cacheLog.Fatal("creating cache", "err", err)
+		}
+		p.cacheTTL = *cacheTTL
+	}
+	p.slowQuery = *slowQuery
+	p.quarantineLog = *quarantine
+	if *maxStmts > 0 {
+		p.statements = newStatementSemaphore(*maxStmts)
+	}
+	p.setFlushInterval(*flushEvery)
+	if *haLock != "" {
+		lock, err := newLeaderLock(*haLock)
+		if err != nil {
+			proxyLog.Fatal("creating leader lock", "err", err)
+		}
+		p.ha = newElector(lock, instanceID(), *haTTL)
+		p.ha.elect()
+		go p.ha.run()
+	}
+	go p.runWarmups()
+	// Unlike the background tasks, the rejections are saved by every
+	// instance, not only the leader, as each one aggregates the rejections
+	// of the queries it served itself. Instances need their own file.
+	if *rejections != "" {
+		if err := p.rejections.load(*rejections); err != nil {
+			proxyLog.Fatal("loading rejections", "err", err)
+		}
+	}
+	go p.rejections.run(*rejections, time.Minute)
+	if *exportDir != "" {
+		p.exports, err = newExporter(*exportDir, *exportTTL)
+		if err != nil {
+			exportLog.Fatal("creating exporter", "err", err)
+		}
+	}
+
+	// Apply changes of the configuration file on SIGHUP.
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			cfg, err := loadConfig()
+			if err == nil {
+				err = p.Reload(cfg)
+			}
+			if err != nil {
+				proxyLog.Error("reloading config", "err", err)
+			}
+		}
+	}()
+
+	if *adminAddr != "" {
+		go func() {
+			proxyLog.Info("admin listening", "addr", *adminAddr)
+			err := http.ListenAndServe(*adminAddr, p.adminHandler())
+			proxyLog.Fatal("admin listener", "err", err)
+		}()
+	}
+
+	if *tlsCert != "" {
+		err := serveTLS(*listenAddr, p, *tlsCert, *tlsKey, *tlsCA, *tlsReload)
+		tlsLog.Fatal("serving HTTPS", "err", err)
+	}
+
+	var domains []string
+	if *domain != "" {
+		domains = strings.Split(*domain, ",")
 	}
-	if *https && *domain != "" {
-		domains := strings.Split(*domain, ",")
-		log.Fatal(serveAutoCert(*listenAddr, p, *cacheDir, domains...))
+	domains = append(domains, cfg.hosts()...)
+	if *https && len(domains) > 0 {
+		err := serveAutoCert(*listenAddr, p, *cacheDir, domains...)
+		tlsLog.Fatal("serving HTTPS", "err", err)
 	}
 
-	log.Printf("listening on %s\n", *listenAddr)
-	log.Fatal(http.ListenAndServe(*listenAddr, p))
+	proxyLog.Info("listening", "addr", *listenAddr)
+	err = http.ListenAndServe(*listenAddr, p)
+	proxyLog.Fatal("listener", "err", err)
 }
 
 // Proxy denotes a reverse proxy for an InfluxDB HTTP endpoint.
@@ -76,18 +202,56 @@ func main() {
 //  /ping
 //  /query
 //
+// The allowed sources, rate limits and authentication requirements are
+// defined by policy profiles, which are selected by virtual host or path
+// prefix. Responses of allowed queries are stored in the cache, if one is
+// configured.
 type Proxy struct {
-	proxy   *httputil.ReverseProxy
-	sources []string // allowed data sources. (measurements)
+	addr          string       // address of the default InfluxDB server.
+	pol           atomic.Value // current *policy, see Reload.
+	reloadMu      sync.Mutex
+	flushInterval time.Duration
+	cache         Cache // query response cache, nil if disabled.
+	cacheTTL      time.Duration
+	slowQuery     time.Duration       // threshold for logging slow queries, 0 if disabled.
+	quarantineLog int                 // bytes of quarantined queries logged, 0 if not logged.
+	sentry        *sentryReporter     // nil if error reporting is disabled.
+	bursts        *burstDetector      // upstream error bursts, nil if not reported.
+	exports       *exporter           // nil if exports are disabled.
+	ha            *elector            // leader election, nil without HA.
+	statements    *statementSemaphore // statements executed at once, nil if unlimited.
+	coverage      *coverageCache      // time coverage of measurements for the catalog.
+	rejections    *rejectionStore     // rejected queries by client, measurement and reason.
 }
 
-// NewProxy creates a new reverse proxy for the given addr and for the allowed
-// sources.
-func NewProxy(addr string, sources []string) (*Proxy, error) {
+// NewProxy creates a new reverse proxy for the given addr and the policy
+// profiles of cfg. Profiles with their own backend are proxied to it instead
+// of addr.
+func NewProxy(addr string, cfg *Config) (*Proxy, error) {
 	if addr == "" {
 		return nil, errors.New("no -addr provided to be proxied to")
 	}
 
+	p := &Proxy{addr: addr, coverage: newCoverageCache(), rejections: newRejectionStore()}
+	if cfg.Sentry != nil {
+		if err := p.setupSentry(cfg.Sentry); err != nil {
+			return nil, err
+		}
+	}
+
+	pol, err := p.newPolicy(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.pol.Store(pol)
+	setInfoMetrics(pol)
+	return p, nil
+}
+
+// newReverseProxy returns a reverse proxy forwarding requests to the InfluxDB
+// server at addr. Server errors of the backend are accounted with
+// upstreamError.
+func (p *Proxy) newReverseProxy(addr string) (*httputil.ReverseProxy, error) {
 	target, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
@@ -108,22 +272,74 @@ func NewProxy(addr string, sources []string) (*Proxy, error) {
 			r.Header.Set("User-Agent", "")
 		}
 	}
-
-	return &Proxy{
-		proxy:   &httputil.ReverseProxy{Director: director},
-		sources: sources,
+	return &httputil.ReverseProxy{
+		Director:      director,
+		ErrorLog:      proxyLog.stdLogger(levelError),
+		FlushInterval: p.flushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode >= 500 {
+				p.upstreamError(addr)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+				proxyLog.Warn("query timed out", "backend", addr)
+				reportError(w, ErrQueryTimeout, http.StatusGatewayTimeout)
+				return
+			}
+			proxyLog.Error("proxying request", "backend", addr, "err", err)
+			// Requests canceled by the client are not the backend's fault.
+			if r.Context().Err() == nil {
+				p.upstreamError(addr)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
 	}, nil
 }
 
 // ServeHTTP satisfies the http.Handler interface for a server.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
+	pol := p.policy()
+	prof, path := pol.selectProfile(r)
+	r.URL.Path, r.URL.RawPath = path, ""
+
+	if slos := prof.endpointSLOs(path); len(slos) > 0 {
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		start := time.Now()
+		defer func() {
+			now := time.Now()
+			for _, s := range slos {
+				s.record(now.Sub(start), sw.status, now)
+			}
+		}()
+	}
+	defer p.recoverPanic(w, r)
+
+	// Parameters of queries and exports are checked on admission, so that
+	// their rejections are recorded.
+	if path != "/query" && path != "/export" {
+		if err := prof.checkEndpoint(r); errors.Is(err, ErrUnknownEndpoint) {
+			reportError(w, err, http.StatusNotFound)
+			return
+		} else if err != nil {
+			reportError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch path {
 	default:
+		if strings.HasPrefix(path, "/export/") && p.exports != nil {
+			p.serveExport(w, r, prof, strings.TrimPrefix(path, "/export/"))
+			return
+		}
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 
 	case "/ping":
-		p.proxy.ServeHTTP(w, r)
+		prof.proxy.ServeHTTP(w, r)
 		return
 
 	case "/write":
@@ -131,56 +347,321 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 
 	case "/query":
-		q := r.URL.Query().Get("q")
-		if err := allowed(q, p.sources); err != nil {
-			reportError(w, err, http.StatusNotAcceptable)
+		query, _, ok := p.admitQuery(w, r, pol, prof)
+		if !ok {
+			return
+		}
+		w, done := prof.shadow.mirror(w, r, prof, query)
+		defer done()
+		p.serveQuery(w, r, pol, prof, query)
+		return
+
+	case "/export":
+		if p.exports == nil {
+			reportError(w, ErrExportDisabled, http.StatusNotImplemented)
+			return
+		}
+		if r.Method != http.MethodPost {
+			reportError(w, ErrMethodNotAllowed, http.StatusMethodNotAllowed)
+			return
+		}
+		// Parameters may be given in the body as well.
+		if err := r.ParseForm(); err != nil {
+			reportError(w, err, http.StatusBadRequest)
+			return
+		}
+		r.URL.RawQuery = r.Form.Encode()
+
+		query, user, ok := p.admitQuery(w, r, pol, prof)
+		if !ok {
 			return
 		}
+		p.startExport(w, r, prof, user, query)
+		return
+
+	case "/api.json":
+		p.serveAPI(w, r, prof)
+		return
 
-		p.proxy.ServeHTTP(w, r)
+	case "/catalog":
+		p.serveCatalog(w, r, prof)
 		return
 
 	case "/debug/version":
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(version))
-		w.Write([]byte("\n"))
-		w.Write([]byte(commit))
+		serveVersion(w)
+		return
+	}
+}
+
+// admitQuery authenticates and rate limits the query request r and validates
+// its query against the profile. It returns the parsed query and the
+// authenticated user. If the query is not admitted, an error is sent to the
+// client and ok is false. All decisions are recorded in the audit log.
+func (p *Proxy) admitQuery(w http.ResponseWriter, r *http.Request, pol *policy, prof *profile) (query *influxql.Query, user string, ok bool) {
+	client := clientID(r, "")
+	grafana := pol.grafanaSource(r).fields()
+	reject := func(reason string, err error, code int) {
+		rejectionsTotal.Inc(prof.name, reason)
+		p.rejections.record(client, reason, attemptedMeasurements(r.URL.Query().Get("q")), time.Now())
+		audit(pol, prof, client, "query rejected", append([]interface{}{"reason", reason, "err", err}, grafana...)...)
+		reportError(w, err, code)
+	}
+	rejectDeprecated := func(err error) {
+		// Counted by the configured name, whatever spelling the client
+		// used.
+		var de *deprecatedError
+		if errors.As(err, &de) {
+			deprecatedQueries.Inc(prof.name, de.measurement)
+		}
+		reject("deprecated_measurement", err, http.StatusGone)
+	}
+	// admitAccess is checked again for queries rewritten by the
+	// authorizer.
+	admitAccess := func(query *influxql.Query) bool {
+		err := prof.checkAccess(query, time.Now())
+		if err == nil {
+			return true
+		}
+		var aw *accessWindowError
+		if errors.As(err, &aw) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(aw.next).Seconds())+1))
+		}
+		reject("access_window", err, http.StatusForbidden)
+		return false
+	}
+
+	// Internal requests, like warm-up queries, are neither authenticated
+	// nor rate limited.
+	if name, ok := internalRequest(r); ok {
+		client = "internal:" + name
+	} else {
+		var err error
+		user, err = prof.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="InfluxDB"`)
+			reject("unauthorized", err, http.StatusUnauthorized)
+			return nil, "", false
+		}
+		client = clientID(r, user)
+		if !prof.allow(client) {
+			reject("rate_limited", ErrRateLimited, http.StatusTooManyRequests)
+			return nil, "", false
+		}
+	}
+
+	if err := prof.checkParams(r); err != nil {
+		reason := "invalid_parameter"
+		if errors.Is(err, ErrUnknownParameter) {
+			reason = "unknown_parameter"
+		}
+		reject(reason, err, http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	q := r.URL.Query().Get("q")
+	if err := prof.checkTombstones(q); err != nil {
+		rejectDeprecated(err)
+		return nil, "", false
+	}
+	query, err := validate(q, prof.allows)
+	if errors.Is(err, ErrQueryQuarantined) {
+		p.quarantine(prof, client, q, err)
+		reject("quarantined", err, http.StatusBadRequest)
+		return nil, "", false
+	}
+	if err != nil {
+		reject("not_allowed", err, http.StatusNotAcceptable)
+		return nil, "", false
+	}
+	prof.rewriteAliases(r, query)
+	if err := prof.checkTags(query); err != nil {
+		reason := "forbidden_tag"
+		if errors.Is(err, ErrGroupByNotAllowed) {
+			reason = "group_by_not_allowed"
+		}
+		reject(reason, err, http.StatusNotAcceptable)
+		return nil, "", false
+	}
+	if _, ok := internalRequest(r); !ok {
+		if !admitAccess(query) {
+			return nil, "", false
+		}
+		authorized, err := prof.authorize(r, client, user, query)
+		if errors.Is(err, ErrMeasurementDeprecated) {
+			rejectDeprecated(err)
+			return nil, "", false
+		} else if errors.Is(err, ErrAuthorizerFailed) {
+			reject("authorizer_failed", err, http.StatusServiceUnavailable)
+			return nil, "", false
+		} else if err != nil {
+			reject("authorizer_denied", err, http.StatusNotAcceptable)
+			return nil, "", false
+		}
+		if authorized != query && !admitAccess(authorized) {
+			return nil, "", false
+		}
+		query = authorized
+	}
+	if err := prof.rewriteDatabases(r, query); err != nil {
+		reject("database_not_allowed", err, http.StatusNotAcceptable)
+		return nil, "", false
+	}
+	// Queries whose series cannot be counted are rejected, as the limit
+	// could be bypassed otherwise.
+	if err := prof.checkSeries(r, query); errors.Is(err, ErrTooManySeries) {
+		reject("too_many_series", err, http.StatusNotAcceptable)
+		return nil, "", false
+	} else if err != nil {
+		seriesCheckFailures.Inc(prof.name)
+		proxyLog.Warn("series cardinality check failed, query rejected", "profile", prof.name, "err", err)
+		reject("series_check_failed", ErrSeriesCheck, http.StatusServiceUnavailable)
+		return nil, "", false
+	}
+	// The statement budget is charged last, so that rejected queries do
+	// not use it up.
+	if _, ok := internalRequest(r); !ok && !prof.allowStatements(client, len(query.Statements)) {
+		reject("statement_limit", ErrStatementLimit, http.StatusTooManyRequests)
+		return nil, "", false
+	}
+
+	_, fp := fingerprint(query)
+	audit(pol, prof, client, "query allowed", append([]interface{}{"fingerprint", fp}, grafana...)...)
+	return query, user, true
+}
+
+// serveQuery proxies the allowed query to the backend, using the cache if one
+// is configured, and records the query metrics by fingerprint.
+func (p *Proxy) serveQuery(w http.ResponseWriter, r *http.Request, pol *policy, prof *profile, query *influxql.Query) {
+	start := time.Now()
+	normalized, fp := fingerprint(query)
+	grafana := pol.grafanaSource(r)
+	cw := &countingWriter{ResponseWriter: w}
+	w = cw
+	defer func() {
+		d := time.Since(start)
+		responseBytes.Add(float64(cw.n), prof.name)
+		queriesTotal.Inc(fp)
+		queryDuration.Observe(d.Seconds(), fp)
+		queryFingerprints.Set(1, fp, normalized)
+		if grafana != nil {
+			grafanaQueries.Inc(grafana.Org, grafana.Dashboard, grafana.Panel)
+		}
+		if p.slowQuery > 0 && d >= p.slowQuery {
+			kv := []interface{}{"profile", prof.name, "fingerprint", fp, "duration", d, "query", normalized}
+			proxyLog.Warn("slow query", append(kv, grafana.fields()...)...)
+		}
+	}()
+
+	// Cached responses are unfiltered, so filter them on the way out as
+	// well. Responses of SHOW TAG VALUES are small enough to be buffered,
+	// while other responses with aliased series are renamed as they are
+	// streamed.
+	if filter := prof.tagValueFilter(query); filter != nil {
+		rw := newRewriteWriter(w, r, chainRewrites(filter, prof.aliasRenamer(query)))
+		defer rw.finish()
+		w = rw
+	} else if rename := prof.aliasRenamer(query); rename != nil {
+		aw := newAliasWriter(w, r, prof, rename)
+		defer aw.finish()
+		w = aw
+	}
+
+	if prof.splits(r, query) {
+		p.serveSplit(w, r, prof, query)
+		return
+	}
+	p.serveCachedOrForward(w, r, prof, query)
+}
+
+// serveCachedOrForward serves the response of query from the cache, if it
+// is cacheable and cached, and forwards it to the backend otherwise.
+func (p *Proxy) serveCachedOrForward(w http.ResponseWriter, r *http.Request, prof *profile, query *influxql.Query) {
+	if p.cache == nil || r.Method != http.MethodGet {
+		p.forward(w, r, prof, query)
+		return
+	}
+	ttl := prof.queryCacheTTL(query, p.cacheTTL, time.Now())
+	if ttl <= 0 {
+		cacheRequests.Inc("bypass")
+		w.Header().Set("X-Cache", "BYPASS")
+		p.forward(w, r, prof, query)
+		return
+	}
+
+	key := cacheKey(prof.backend, r)
+	if p.serveCached(w, key) {
+		cacheRequests.Inc("hit")
 		return
 	}
+	cacheRequests.Inc("miss")
+	w.Header().Set("X-Cache", "MISS")
+	rec := &cacheRecorder{ResponseWriter: w}
+	p.forward(rec, r, prof, query)
+	rec.store(p.cache, key, ttl)
 }
 
-// allowed checks if the query is a SELECT query and it's source (FROM) is allowed
-// to be queried. If not an error will be returned.
+// allowed checks if the query is a SELECT or SHOW TAG VALUES query and it's
+// source (FROM) is allowed to be queried. If not an error will be returned.
+// Measurement names are case sensitive, like in InfluxDB.
 func allowed(q string, allowed []string) error {
+	_, err := validate(q, func(name string) bool {
+		return lookup(allowed, name)
+	})
+	return err
+}
+
+// validate is like allowed but returns the parsed query if it is allowed.
+// The allows function reports whether a measurement is allowed.
+//
+// Besides SELECT queries, SHOW TAG VALUES queries are allowed if they are
+// restricted to allowed sources with a FROM clause.
+func validate(q string, allows func(name string) bool) (*influxql.Query, error) {
 	if q == "" {
-		return ErrQueryEmpty
+		return nil, ErrQueryEmpty
 	}
 
-	query, err := influxql.NewParser(strings.NewReader(q)).ParseQuery()
+	query, err := parseQuery(q)
+	if errors.Is(err, ErrQueryQuarantined) {
+		return nil, err
+	}
 	if err != nil {
-		return fmt.Errorf("error parsing InfluxQL statement %w", err)
+		return nil, fmt.Errorf("error parsing InfluxQL statement %w", err)
 	}
 
 	// A query can contain multiple statements.
 	for _, stmt := range query.Statements {
-		if !strings.HasPrefix(strings.ToLower(stmt.String()), "select") {
-			return ErrQueryNotAllowed
+		var sources influxql.Sources
+		switch stmt := stmt.(type) {
+		case *influxql.SelectStatement:
+			// SELECT INTO writes to the backend.
+			if stmt.Target != nil {
+				return nil, ErrQueryNotAllowed
+			}
+			sources = stmt.Sources
+		case *influxql.ShowTagValuesStatement:
+			if len(stmt.Sources) == 0 {
+				return nil, ErrQueryNotAllowed
+			}
+			sources = stmt.Sources
+		default:
+			return nil, ErrQueryNotAllowed
 		}
 
-		selectStmt := stmt.(*influxql.SelectStatement)
-		for _, m := range selectStmt.Sources.Measurements() {
-			if !lookup(allowed, m.Name) {
-				return ErrQueryNotAllowed
+		// Regular expression sources are never allowed, as it is unknown
+		// which measurements they match.
+		for _, m := range sources.Measurements() {
+			if m.Regex != nil || !allows(m.Name) {
+				return nil, ErrQueryNotAllowed
 			}
 		}
 	}
 
-	return nil
+	return query, nil
 }
 
 func lookup(allowed []string, name string) bool {
 	for _, item := range allowed {
-		if strings.EqualFold(item, name) {
+		if item == name {
 			return true
 		}
 	}
@@ -220,8 +701,9 @@ func serveAutoCert(addr string, handler http.Handler, cache string, domains ...s
 		if err != nil || host == "" {
 			host = "0.0.0.0"
 		}
-		log.Println("Redirecting traffic from HTTP to HTTPS.")
-		log.Fatal(http.ListenAndServe(host+":80", redirectHandler()))
+		tlsLog.Info("redirecting traffic from HTTP to HTTPS")
+		err = http.ListenAndServe(host+":80", redirectHandler())
+		tlsLog.Fatal("redirect listener", "err", err)
 	}()
 
 	m := &autocert.Manager{
@@ -231,24 +713,21 @@ func serveAutoCert(addr string, handler http.Handler, cache string, domains ...s
 	}
 
 	tlsConfig := m.TLSConfig()
-	tlsConfig.MinVersion = tls.VersionTLS12
-	tlsConfig.CurvePreferences = []tls.CurveID{
-		tls.CurveP256,
-		tls.X25519, // Go 1.8 only
-	}
-	tlsConfig.CipherSuites = []uint16{
-		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, // Go 1.8 only
-		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,   // Go 1.8 only
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := m.GetCertificate(hello)
+		isChallenge := len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+		if err == nil && !isChallenge {
+			servedCertificates.observe(cert)
+		}
+		return cert, err
 	}
+	hardenTLS(tlsConfig)
 
 	s := &http.Server{
 		Addr:      addr,
 		Handler:   handler,
 		TLSConfig: tlsConfig,
+		ErrorLog:  tlsLog.stdLogger(levelDebug),
 	}
 
 	return s.ListenAndServeTLS("", "")
@@ -5,12 +5,16 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -92,11 +96,16 @@ func TestAllowed(t *testing.T) {
 		"mixedCasesAllowed": {
 			"select a FROM m0",
 			[]string{"M0", "m1", "M2"},
-			nil,
+			ErrQueryNotAllowed,
 		},
 		"mixedCasesFrom": {
 			"select a FROM M1",
 			[]string{"M0", "m1", "M2"},
+			ErrQueryNotAllowed,
+		},
+		"exactCase": {
+			"select a FROM M0",
+			[]string{"M0", "m1", "M2"},
 			nil,
 		},
 		"multipleQueriesFirstOK": {
@@ -114,11 +123,51 @@ func TestAllowed(t *testing.T) {
 			[]string{"M0", "m1", "M2"},
 			ErrQueryNotAllowed,
 		},
-		"multipleQueriesOK": {
+		"multipleQueriesMixedCase": {
 			"select m1 FROM M1;SELECT m0 FROM M0;select m2 from M2;",
 			[]string{"M0", "m1", "M2"},
+			ErrQueryNotAllowed,
+		},
+		"multipleQueriesOK": {
+			"select m1 FROM m1;SELECT m0 FROM M0;select m2 from M2;",
+			[]string{"M0", "m1", "M2"},
+			nil,
+		},
+		"showTagValuesOK": {
+			`SHOW TAG VALUES FROM m1 WITH KEY = "station"`,
+			[]string{"m0", "m1"},
 			nil,
 		},
+		"showTagValuesMultipleOK": {
+			`SHOW TAG VALUES ON db FROM m0, m1 WITH KEY IN ("station", "sensor") WHERE a = 'b'`,
+			[]string{"m0", "m1"},
+			nil,
+		},
+		"showTagValuesNotOK": {
+			`SHOW TAG VALUES FROM m1, m2 WITH KEY = "station"`,
+			[]string{"m0", "m1"},
+			ErrQueryNotAllowed,
+		},
+		"showTagValuesNoFrom": {
+			`SHOW TAG VALUES WITH KEY = "station"`,
+			[]string{"m0", "m1"},
+			ErrQueryNotAllowed,
+		},
+		"showTagValuesRegex": {
+			`SHOW TAG VALUES FROM /m.*/ WITH KEY = "station"`,
+			[]string{"m0", "m1"},
+			ErrQueryNotAllowed,
+		},
+		"selectInto": {
+			"SELECT * INTO m1 FROM m0",
+			[]string{"m0", "m1"},
+			ErrQueryNotAllowed,
+		},
+		"showTagKeys": {
+			"SHOW TAG KEYS FROM m1",
+			[]string{"m0", "m1"},
+			ErrQueryNotAllowed,
+		},
 	}
 
 	for name, tc := range testCases {
@@ -131,6 +180,41 @@ func TestAllowed(t *testing.T) {
 	}
 }
 
+// FuzzAllowed checks that allowed neither panics nor lets queries through
+// which use other sources than the allowed ones.
+func FuzzAllowed(f *testing.F) {
+	for _, q := range []string{
+		"SELECT * FROM m1",
+		"select a, c, b, d, e FROM (SELECT * FROM (SELECT * FROM m1)) WHERE a=1",
+		"SELECT mean(v) FROM db.rt.m1 WHERE time > now() - 1h GROUP BY time(1m), station fill(0)",
+		"SELECT a FROM m1; SELECT b FROM m2",
+		`SHOW TAG VALUES ON db FROM m0, m1 WITH KEY IN ("station", "sensor") WHERE a = 'b'`,
+		"SELECT * FROM /m.*/",
+		"SELECT * INTO m2 FROM m1",
+		"DROP MEASUREMENT m1",
+		"SELECT * FROM (",
+	} {
+		f.Add(q)
+	}
+
+	allowlist := []string{"m0", "m1"}
+	f.Fuzz(func(t *testing.T, q string) {
+		err := allowed(q, allowlist)
+		if err != nil {
+			return
+		}
+		query, err := parseQuery(q)
+		if err != nil {
+			t.Fatalf("allowed query %q does not parse: %v", q, err)
+		}
+		for _, name := range queryMeasurements(query) {
+			if !lookup(allowlist, name) {
+				t.Fatalf("allowed query %q uses %q", q, name)
+			}
+		}
+	})
+}
+
 func TestDefaultEndpoint(t *testing.T) {
 	want := http.StatusNotFound
 
@@ -229,7 +313,7 @@ func TestMain(m *testing.M) {
 	server := httptest.NewServer(mux)
 
 	// run proxy server
-	p, err := NewProxy(server.URL, []string{"test"})
+	p, err := NewProxy(server.URL, sourcesConfig("test"))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -241,3 +325,57 @@ func TestMain(m *testing.M) {
 	// call flag.Parse() here if TestMain uses flags
 	os.Exit(m.Run())
 }
+
+// sourcesConfig returns a configuration allowing the given sources in the
+// default profile.
+func sourcesConfig(sources ...string) *Config {
+	cfg := new(Config)
+	for _, s := range sources {
+		cfg.Measurements = append(cfg.Measurements, Measurement{Name: s})
+	}
+	return cfg
+}
+
+func TestStreaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"results":[{"statement_id":0}]}`+"\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, `{"results":[{"statement_id":0}]}`+"\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	p, err := NewProxy(backend.URL, sourcesConfig("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache = newMemoryCache()
+	p.cacheTTL = time.Minute
+	p.setFlushInterval(10 * time.Millisecond)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/query?chunked=true&q=select%20*%20FROM%20test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first chunk must arrive while the backend is still blocked.
+	line := make(chan string)
+	go func() {
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if !strings.Contains(s, "statement_id") {
+			t.Fatalf("got unexpected first chunk %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first chunk was not streamed to the client")
+	}
+}
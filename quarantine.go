@@ -0,0 +1,45 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/influxdata/influxql"
+)
+
+// ErrQueryQuarantined is returned if the InfluxQL parser panicked on a
+// query. Such queries are rejected instead of taking down the handler.
+var ErrQueryQuarantined = errors.New("query quarantined, it crashed the parser")
+
+// parseInfluxQL parses InfluxQL queries. It is replaced in tests.
+var parseInfluxQL = influxql.ParseQuery
+
+// parseQuery parses q like influxql.ParseQuery, but converts panics of the
+// parser into an ErrQueryQuarantined error.
+func parseQuery(q string) (query *influxql.Query, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			query, err = nil, fmt.Errorf("%w: %v", ErrQueryQuarantined, v)
+		}
+	}()
+	return parseInfluxQL(q)
+}
+
+// quarantine accounts the query q of client the parser panicked on and
+// logs its first -log-quarantined bytes, if enabled.
+func (p *Proxy) quarantine(prof *profile, client, q string, err error) {
+	quarantinedQueries.Inc(prof.name)
+	if p.quarantineLog <= 0 {
+		return
+	}
+	kv := []interface{}{"profile", prof.name, "client", client, "err", err, "size", len(q)}
+	if len(q) > p.quarantineLog {
+		q = q[:p.quarantineLog]
+		kv = append(kv, "truncated", true)
+	}
+	proxyLog.Warn("query quarantined", append(kv, "query", q)...)
+}
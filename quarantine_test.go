@@ -0,0 +1,85 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxql"
+)
+
+// panickingParser makes the parser panic on queries containing "boom" for
+// the duration of the test.
+func panickingParser(t *testing.T) {
+	t.Helper()
+	parse := parseInfluxQL
+	parseInfluxQL = func(s string) (*influxql.Query, error) {
+		if strings.Contains(s, "boom") {
+			panic("index out of range")
+		}
+		return parse(s)
+	}
+	t.Cleanup(func() { parseInfluxQL = parse })
+}
+
+func TestParseQueryPanic(t *testing.T) {
+	panickingParser(t)
+
+	if _, err := parseQuery("SELECT * FROM m1"); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	_, err := parseQuery("SELECT * FROM boom")
+	if !errors.Is(err, ErrQueryQuarantined) {
+		t.Fatalf("got error %v, want %v", err, ErrQueryQuarantined)
+	}
+	if err := allowed("SELECT * FROM boom", []string{"boom"}); !errors.Is(err, ErrQueryQuarantined) {
+		t.Fatalf("got error %v from allowed, want %v", err, ErrQueryQuarantined)
+	}
+	if got := attemptedMeasurements("SELECT * FROM boom"); got != nil {
+		t.Fatalf("got measurements %v, want none", got)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	panickingParser(t)
+	logs := captureLogs(t, "warn", "console")
+
+	p, err := NewProxy("http://localhost:8086", sourcesConfig("boom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.quarantineLog = 20
+
+	testCases := map[string]struct {
+		query string
+		log   string
+	}{
+		"short": {"SELECT * FROM boom", `query="SELECT * FROM boom"`},
+		"long":  {"SELECT * FROM boom WHERE station = 'a'", `truncated=true query="SELECT * FROM boom W"`},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			logs.Reset()
+			before := counterValue(quarantinedQueries, defaultProfileName)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape(tc.query), nil))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if got := counterValue(quarantinedQueries, defaultProfileName) - before; got != 1 {
+				t.Fatalf("got %v quarantined queries, want 1", got)
+			}
+			if !strings.Contains(logs.String(), tc.log) {
+				t.Fatalf("got logs %q, want %q", logs, tc.log)
+			}
+		})
+	}
+}
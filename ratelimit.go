@@ -0,0 +1,84 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxLimiterBuckets is the number of clients tracked by a rateLimiter after
+// which full buckets are dropped.
+const maxLimiterBuckets = 10000
+
+// rateLimiter is a token bucket rate limiter keeping one bucket per client.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing n tokens per duration per
+// client, with up to burst tokens at once.
+func newRateLimiter(n float64, per time.Duration, burst float64) *rateLimiter {
+	if burst <= 0 {
+		burst = n
+	}
+	return &rateLimiter{
+		rate:    n / per.Seconds(),
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// sameRate reports whether l and o are both set and limit at the same rate.
+func (l *rateLimiter) sameRate(o *rateLimiter) bool {
+	return l != nil && o != nil && l.rate == o.rate && l.burst == o.burst
+}
+
+// take removes n tokens from the bucket of client at time now. It reports
+// whether enough tokens were available; if not no tokens are removed.
+func (l *rateLimiter) take(client string, n float64, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxLimiterBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// prune removes the buckets which are full at time now, as they are
+// equivalent to new ones. The caller must hold l.mu.
+func (l *rateLimiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(60, time.Minute, 2)
+
+	for i, want := range []bool{true, true, false} {
+		if got := l.take("a", 1, now); got != want {
+			t.Fatalf("take %d: got %v, want %v", i, got, want)
+		}
+	}
+	if !l.take("b", 1, now) {
+		t.Fatal("clients must have separate buckets")
+	}
+
+	now = now.Add(time.Second)
+	if !l.take("a", 1, now) {
+		t.Fatal("bucket not refilled")
+	}
+	if l.take("a", 1, now) {
+		t.Fatal("bucket refilled too much")
+	}
+
+	now = now.Add(time.Hour)
+	if l.take("a", 3, now) {
+		t.Fatal("took more than burst")
+	}
+	if !l.take("a", 2, now) {
+		t.Fatal("bucket not refilled up to burst")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout is the dial and I/O timeout used for Redis commands.
+const redisTimeout = 2 * time.Second
+
+// redisClient is a minimal client for the Redis serialization protocol
+// (RESP), supporting just enough to be used as a cache backend. Connections
+// are kept in a small pool.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisClient returns a client for the given redis://[:password@]host:port[/db]
+// URL.
+func newRedisClient(rawurl string) (*redisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid redis URL scheme %q", u.Scheme)
+	}
+
+	c := &redisClient{
+		addr: u.Host,
+		pool: make(chan *redisConn, 8),
+	}
+	if _, _, err := net.SplitHostPort(c.addr); err != nil {
+		var addrErr *net.AddrError
+		if !errors.As(err, &addrErr) || addrErr.Err != "missing port in address" {
+			return nil, fmt.Errorf("invalid redis address %q: %v", c.addr, err)
+		}
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) conn() (*redisConn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := cn.do("AUTH", c.password); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *redisClient) release(cn *redisConn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// Do executes the command with args and returns its reply. A nil reply is
+// returned as nil interface{}.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	cn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	v, err := cn.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection is in an unknown state.
+		cn.Close()
+		return nil, err
+	}
+	c.release(cn)
+	return v, err
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (cn *redisConn) do(args ...string) (interface{}, error) {
+	cn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(cn, b.String()); err != nil {
+		return nil, err
+	}
+	return cn.readReply()
+}
+
+func (cn *redisConn) readReply() (interface{}, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: invalid reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = cn.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+}
+
+// redisCache is a Cache storing entries in Redis.
+type redisCache struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisCache(rawurl string) (*redisCache, error) {
+	c, err := newRedisClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: c, prefix: "influxdb-proxy:cache:"}, nil
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool, error) {
+	v, err := c.client.Do("GET", c.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, false, nil
+	}
+	return b, true, nil
+}
+
+func (c *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return nil
+	}
+	_, err := c.client.Do("SET", c.prefix+key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
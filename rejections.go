@@ -0,0 +1,286 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// Rejection analytics.
+const (
+	// rejectionBucket is the granularity of the aggregated rejections.
+	rejectionBucket = 10 * time.Minute
+
+	// rejectionRetention is how long rejections are kept.
+	rejectionRetention = 7 * 24 * time.Hour
+
+	// maxRejectionKeys limits the combinations of client, measurement and
+	// reason per bucket. Further ones are accounted to "other".
+	maxRejectionKeys = 1000
+)
+
+// rejectionKey identifies the rejections of a client, aggregated per
+// measurement attempted and reason.
+type rejectionKey struct {
+	Client      string `json:"client"`
+	Measurement string `json:"measurement"` // "" if the query could not be parsed.
+	Reason      string `json:"reason"`
+}
+
+// rejectionStore aggregates rejected queries in buckets over the retention
+// period and optionally persists them to a file, so that clients probing
+// forbidden data can be found without searching the audit log.
+type rejectionStore struct {
+	mu      sync.Mutex
+	buckets map[int64]map[rejectionKey]uint64 // by start of the bucket in Unix seconds.
+}
+
+func newRejectionStore() *rejectionStore {
+	return &rejectionStore{buckets: make(map[int64]map[rejectionKey]uint64)}
+}
+
+// record records a rejected query of client with the measurements it
+// attempted to query.
+func (s *rejectionStore) record(client, reason string, measurements []string, now time.Time) {
+	if len(measurements) == 0 {
+		measurements = []string{""}
+	}
+
+	start := now.Truncate(rejectionBucket).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[start]
+	if !ok {
+		b = make(map[rejectionKey]uint64)
+		s.buckets[start] = b
+	}
+	for _, m := range measurements {
+		key := rejectionKey{Client: client, Measurement: m, Reason: reason}
+		if _, ok := b[key]; !ok && len(b) >= maxRejectionKeys {
+			key = rejectionKey{Client: "other", Measurement: "other", Reason: "other"}
+		}
+		b[key]++
+	}
+}
+
+// attemptedMeasurements returns the measurements queried by q, or nil if q
+// cannot be parsed.
+func attemptedMeasurements(q string) []string {
+	query, err := parseQuery(q)
+	if err != nil {
+		return nil
+	}
+	return queryMeasurements(query)
+}
+
+// queryMeasurements returns the measurements queried by query, including
+// regular expressions and the sources of subqueries.
+func queryMeasurements(query *influxql.Query) []string {
+	seen := make(map[string]bool)
+	var names []string
+	influxql.WalkFunc(query, func(n influxql.Node) {
+		m, ok := n.(*influxql.Measurement)
+		if !ok {
+			return
+		}
+		name := m.Name
+		if m.Regex != nil {
+			name = m.Regex.String()
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+// rejectionClient are the rejections of a client within a window.
+type rejectionClient struct {
+	Client       string            `json:"client"`
+	Total        uint64            `json:"total"`
+	Reasons      map[string]uint64 `json:"reasons"`
+	Measurements map[string]uint64 `json:"measurements"`
+}
+
+// top returns the n clients with the most rejections within the window
+// before now, optionally only those for reason.
+func (s *rejectionStore) top(window time.Duration, n int, reason string, now time.Time) []rejectionClient {
+	from := now.Add(-window).Truncate(rejectionBucket).Unix()
+
+	byClient := make(map[string]*rejectionClient)
+	s.mu.Lock()
+	for start, b := range s.buckets {
+		if start < from {
+			continue
+		}
+		for key, count := range b {
+			if reason != "" && key.Reason != reason {
+				continue
+			}
+			c, ok := byClient[key.Client]
+			if !ok {
+				c = &rejectionClient{
+					Client:       key.Client,
+					Reasons:      make(map[string]uint64),
+					Measurements: make(map[string]uint64),
+				}
+				byClient[key.Client] = c
+			}
+			c.Total += count
+			c.Reasons[key.Reason] += count
+			if key.Measurement != "" {
+				c.Measurements[key.Measurement] += count
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	clients := make([]rejectionClient, 0, len(byClient))
+	for _, c := range byClient {
+		clients = append(clients, *c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Total != clients[j].Total {
+			return clients[i].Total > clients[j].Total
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	if len(clients) > n {
+		clients = clients[:n]
+	}
+	return clients
+}
+
+// prune removes the buckets older than the retention period.
+func (s *rejectionStore) prune(now time.Time) {
+	from := now.Add(-rejectionRetention).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for start := range s.buckets {
+		if start < from {
+			delete(s.buckets, start)
+		}
+	}
+}
+
+// rejectionRecord is the persisted form of an aggregate.
+type rejectionRecord struct {
+	Bucket int64 `json:"bucket"`
+	rejectionKey
+	Count uint64 `json:"count"`
+}
+
+// save writes the rejections to the file at path, replacing it atomically.
+func (s *rejectionStore) save(path string) error {
+	s.mu.Lock()
+	records := []rejectionRecord{}
+	for start, b := range s.buckets {
+		for key, count := range b {
+			records = append(records, rejectionRecord{Bucket: start, rejectionKey: key, Count: count})
+		}
+	}
+	s.mu.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".rejections-*")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(records)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// load adds the rejections saved to the file at path. A missing file is
+// not an error.
+func (s *rejectionStore) load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []rejectionRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range records {
+		b, ok := s.buckets[rec.Bucket]
+		if !ok {
+			b = make(map[rejectionKey]uint64)
+			s.buckets[rec.Bucket] = b
+		}
+		b[rec.rejectionKey] += rec.Count
+	}
+	return nil
+}
+
+// run prunes the rejections and saves them to path, if set, every
+// interval.
+func (s *rejectionStore) run(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		s.prune(time.Now())
+		if path == "" {
+			continue
+		}
+		if err := s.save(path); err != nil {
+			proxyLog.Error("saving rejections", "path", path, "err", err)
+		}
+	}
+}
+
+// rejectionsHandler serves the clients with the most rejected queries as
+// JSON on the admin listener. The window (default 24h), the number of
+// clients (top, default 10) and the reason can be given as parameters.
+func (p *Proxy) rejectionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		window := 24 * time.Hour
+		if s := params.Get("window"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				reportError(w, fmt.Errorf("invalid window %q", s), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		n := 10
+		if s := params.Get("top"); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 {
+				reportError(w, fmt.Errorf("invalid top %q", s), http.StatusBadRequest)
+				return
+			}
+			n = v
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.rejections.top(window, n, params.Get("reason"), time.Now()))
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAttemptedMeasurements(t *testing.T) {
+	testCases := map[string]struct {
+		in   string
+		want []string
+	}{
+		"single":   {"SELECT * FROM secret", []string{"secret"}},
+		"multiple": {"SELECT * FROM a, b; SELECT * FROM a", []string{"a", "b"}},
+		"subquery": {"SELECT max(v) FROM (SELECT v FROM inner)", []string{"inner"}},
+		"regex":    {"SELECT * FROM /.*/", []string{"/.*/"}},
+		"invalid":  {"SELECT", nil},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := attemptedMeasurements(tc.in); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRejectionStore(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := newRejectionStore()
+	s.record("ip:10.0.0.1", "not_allowed", []string{"secret"}, now.Add(-2*time.Hour))
+	s.record("ip:10.0.0.1", "not_allowed", []string{"secret", "private"}, now)
+	s.record("ip:10.0.0.1", "rate_limited", nil, now)
+	s.record("user:alice", "forbidden_tag", []string{"m1"}, now)
+
+	got := s.top(time.Hour, 10, "", now)
+	want := []rejectionClient{
+		{Client: "ip:10.0.0.1", Total: 3, Reasons: map[string]uint64{"not_allowed": 2, "rate_limited": 1}, Measurements: map[string]uint64{"secret": 1, "private": 1}},
+		{Client: "user:alice", Total: 1, Reasons: map[string]uint64{"forbidden_tag": 1}, Measurements: map[string]uint64{"m1": 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("last hour: got %+v, want %+v", got, want)
+	}
+	if got := s.top(24*time.Hour, 1, "not_allowed", now); len(got) != 1 || got[0].Total != 3 {
+		t.Fatalf("last day: got %+v, want 3 not_allowed rejections of ip:10.0.0.1", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "rejections.json")
+	if err := s.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newRejectionStore()
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.top(24*time.Hour, 10, "", now); !reflect.DeepEqual(got, s.top(24*time.Hour, 10, "", now)) {
+		t.Fatalf("after loading: got %+v", got)
+	}
+	if err := newRejectionStore().load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("missing file: unexpected error: %v", err)
+	}
+
+	loaded.prune(now.Add(rejectionRetention - time.Hour))
+	if got := loaded.top(rejectionRetention*2, 10, "not_allowed", now); len(got) != 1 || got[0].Total != 2 {
+		t.Fatalf("after pruning: got %+v, want the 2 recent not_allowed rejections", got)
+	}
+}
+
+func TestRejectionsHandler(t *testing.T) {
+	p, err := NewProxy("http://localhost:8086", sourcesConfig("m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/query?q=SELECT+*+FROM+secret", nil))
+
+	w := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/rejections?window=1h&top=5", nil))
+	var got []rejectionClient
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Reasons["not_allowed"] != 1 || got[0].Measurements["secret"] != 1 {
+		t.Fatalf("got %+v, want the rejected query of secret", got)
+	}
+
+	w = httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/rejections?window=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid window: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
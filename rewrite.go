@@ -0,0 +1,154 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrRewriteUnsupported is returned if a response needs to be
+	// rewritten but its format is not supported.
+	ErrRewriteUnsupported = errors.New("response format not supported for this query, use JSON or MessagePack")
+
+	// ErrRewriteTooLarge is returned if a response needs to be rewritten
+	// but is larger than maxRewriteSize.
+	ErrRewriteTooLarge = errors.New("response too large to be rewritten, use chunked=true")
+)
+
+// maxRewriteSize is the maximum size of a response, or of a single chunk of
+// a chunked JSON response, which is buffered to be rewritten.
+const maxRewriteSize = 32 << 20
+
+// rewriteFunc rewrites the decoded responses of a query in place.
+type rewriteFunc func(resps []*influxResponse) error
+
+// chainRewrites returns a rewriteFunc applying the given ones, which may be
+// nil, in order, or nil if all are nil.
+func chainRewrites(fns ...rewriteFunc) rewriteFunc {
+	var chain []rewriteFunc
+	for _, fn := range fns {
+		if fn != nil {
+			chain = append(chain, fn)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return func(resps []*influxResponse) error {
+		for _, fn := range chain {
+			if err := fn(resps); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rewriteWriter is a http.ResponseWriter which buffers a response so that it
+// can be rewritten before it is written to the underlying ResponseWriter by
+// finish. Only successful JSON and MessagePack responses of at most
+// maxRewriteSize are rewritten, other successful responses are replaced by
+// an error as they can not be inspected.
+type rewriteWriter struct {
+	w         http.ResponseWriter
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	truncated bool // the body exceeded maxRewriteSize and was discarded.
+	rewrite   rewriteFunc
+	pretty    bool // indent JSON responses, see the pretty parameter.
+}
+
+// newRewriteWriter returns a rewriteWriter applying fn to the response of r,
+// which is written to w. As the response must be inspected, r is modified so
+// that the backend does not compress it.
+func newRewriteWriter(w http.ResponseWriter, r *http.Request, fn rewriteFunc) *rewriteWriter {
+	r.Header.Del("Accept-Encoding")
+	return &rewriteWriter{
+		w:       w,
+		header:  make(http.Header),
+		rewrite: fn,
+		pretty:  r.URL.Query().Get("pretty") == "true",
+	}
+}
+
+func (rw *rewriteWriter) Header() http.Header { return rw.header }
+
+func (rw *rewriteWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+}
+
+func (rw *rewriteWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.truncated || rw.body.Len()+len(b) > maxRewriteSize {
+		rw.truncated = true
+		rw.body.Reset()
+		return len(b), nil
+	}
+	return rw.body.Write(b)
+}
+
+// finish rewrites the buffered response and writes it to the underlying
+// ResponseWriter.
+func (rw *rewriteWriter) finish() {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	body := rw.body.Bytes()
+	if rw.truncated {
+		reportError(rw.w, ErrRewriteTooLarge, http.StatusNotAcceptable)
+		return
+	}
+	if rw.status == http.StatusOK {
+		var err error
+		body, err = rw.apply(body)
+		if err != nil {
+			reportError(rw.w, err, http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	for k, v := range rw.header {
+		rw.w.Header()[k] = v
+	}
+	rw.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.w.WriteHeader(rw.status)
+	rw.w.Write(body)
+}
+
+func (rw *rewriteWriter) apply(body []byte) ([]byte, error) {
+	if rw.header.Get("Content-Encoding") != "" {
+		return nil, ErrRewriteUnsupported
+	}
+	ct := rw.header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/json") && !isMsgpack(ct) {
+		return nil, ErrRewriteUnsupported
+	}
+
+	resps, err := decodeResponsesAs(ct, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := rw.rewrite(resps); err != nil {
+		return nil, err
+	}
+	if isMsgpack(ct) {
+		return encodeMsgpackResponses(resps)
+	}
+	return encodeResponses(resps, rw.pretty)
+}
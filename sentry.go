@@ -0,0 +1,307 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the Sentry configuration.
+const (
+	defaultBurstThreshold = 10
+	defaultBurstWindow    = time.Minute
+)
+
+// sentryQueueSize is the number of events waiting to be sent, after which
+// further events are dropped.
+const sentryQueueSize = 64
+
+// sentryReporter reports events to Sentry using its store API. Events are
+// sent asynchronously, so reporting never blocks request handling. A nil
+// *sentryReporter discards all events.
+type sentryReporter struct {
+	endpoint    string // store API URL
+	auth        string // X-Sentry-Auth header
+	environment string
+	client      *http.Client
+	queue       chan *sentryEvent
+}
+
+// sentryEvent is the subset of the Sentry event payload used by the proxy.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Platform    string            `json:"platform"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	Exception   *sentryException  `json:"exception,omitempty"`
+}
+
+type sentryRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+type sentryException struct {
+	Values []sentryExceptionValue `json:"values"`
+}
+
+type sentryExceptionValue struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+// newSentryReporter returns a reporter for the given DSN, of the form
+// https://<key>@<host>/<project>.
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry DSN: %w", err)
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("invalid sentry DSN %q", dsn)
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=influxdb-proxy/%s, sentry_key=%s", version, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+
+	s := &sentryReporter{
+		endpoint:    fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth:        auth,
+		environment: environment,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *sentryEvent, sentryQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *sentryReporter) run() {
+	for ev := range s.queue {
+		if err := s.send(ev); err != nil {
+			proxyLog.Warn("sending event to sentry", "err", err)
+		}
+	}
+}
+
+func (s *sentryReporter) send(ev *sentryEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sentry responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// report queues ev, filling in the common fields.
+func (s *sentryReporter) report(ev *sentryEvent) {
+	if s == nil {
+		return
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	ev.EventID = hex.EncodeToString(id[:])
+	ev.Timestamp = time.Now().UTC().Format("2006-01-02T15:04:05")
+	ev.Platform = "go"
+	ev.Release = version
+	ev.Environment = s.environment
+	ev.ServerName, _ = os.Hostname()
+
+	select {
+	case s.queue <- ev:
+	default:
+		proxyLog.Warn("sentry queue full, dropping event", "msg", ev.Message)
+	}
+}
+
+// reportPanic reports the recovered panic value v, which occurred while
+// handling r. It must be called from the deferred function that recovered,
+// so that the stack trace includes the panicking frames.
+func (s *sentryReporter) reportPanic(v interface{}, r *http.Request) {
+	if s == nil {
+		return
+	}
+
+	ev := &sentryEvent{
+		Level:   "fatal",
+		Logger:  "proxy",
+		Message: fmt.Sprintf("panic: %v", v),
+		Exception: &sentryException{Values: []sentryExceptionValue{{
+			Type:       "panic",
+			Value:      fmt.Sprint(v),
+			Stacktrace: stacktrace(5),
+		}}},
+	}
+	if r != nil {
+		u := *r.URL
+		u.RawQuery = "" // may contain credentials
+		ev.Request = &sentryRequest{URL: u.String(), Method: r.Method}
+	}
+	s.report(ev)
+}
+
+// stacktrace returns the current stack, skipping skip frames like
+// runtime.Callers, with the innermost frame last as expected by Sentry.
+func stacktrace(skip int) *sentryStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var st []sentryFrame
+	for {
+		f, more := frames.Next()
+		st = append(st, sentryFrame{Function: f.Function, Filename: f.File, Lineno: f.Line})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(st)-1; i < j; i, j = i+1, j-1 {
+		st[i], st[j] = st[j], st[i]
+	}
+	return &sentryStacktrace{Frames: st}
+}
+
+// burstDetector detects sustained bursts of upstream server errors. A burst
+// is reported once at least threshold errors occurred within window, and then
+// at most once per window.
+type burstDetector struct {
+	threshold int
+	window    time.Duration
+	report    func(n int, backend string)
+
+	mu       sync.Mutex
+	errors   []time.Time
+	reported time.Time
+}
+
+// record records an upstream error of backend at time now.
+func (d *burstDetector) record(backend string, now time.Time) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	cutoff := now.Add(-d.window)
+	i := 0
+	for i < len(d.errors) && !d.errors[i].After(cutoff) {
+		i++
+	}
+	d.errors = append(d.errors[i:], now)
+
+	n := len(d.errors)
+	fire := n >= d.threshold && now.Sub(d.reported) >= d.window
+	if fire {
+		d.reported = now
+	}
+	d.mu.Unlock()
+
+	if fire {
+		d.report(n, backend)
+	}
+}
+
+// setupSentry enables the reporting of panics and upstream error bursts as
+// configured by cfg.
+func (p *Proxy) setupSentry(cfg *Sentry) error {
+	s, err := newSentryReporter(cfg.DSN, cfg.Environment)
+	if err != nil {
+		return err
+	}
+
+	d := &burstDetector{
+		threshold: cfg.BurstThreshold,
+		window:    time.Duration(cfg.BurstWindow),
+	}
+	if d.threshold == 0 {
+		d.threshold = defaultBurstThreshold
+	}
+	if d.window == 0 {
+		d.window = defaultBurstWindow
+	}
+	d.report = func(n int, backend string) {
+		proxyLog.Error("upstream error burst", "backend", backend, "errors", n, "window", d.window)
+		s.report(&sentryEvent{
+			Level:   "error",
+			Logger:  "proxy",
+			Message: fmt.Sprintf("%d upstream errors within %s", n, d.window),
+			Tags:    map[string]string{"backend": backend},
+		})
+	}
+
+	p.sentry, p.bursts = s, d
+	return nil
+}
+
+// upstreamError accounts a 5xx response or a failed request of backend.
+func (p *Proxy) upstreamError(backend string) {
+	upstreamErrors.Inc(backend)
+	p.bursts.record(backend, time.Now())
+}
+
+// recoverPanic recovers a panic of the handler serving r, logs and reports
+// it and replies with an internal server error. It must be deferred directly.
+func (p *Proxy) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		// Deliberate abort, e.g. by httputil.ReverseProxy when the
+		// client goes away.
+		panic(v)
+	}
+
+	panicsTotal.Inc()
+	proxyLog.Error("panic serving request", "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+	p.sentry.reportPanic(v, r)
+	reportError(w, ErrInternal, http.StatusInternalServerError)
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// maxShadowRequests is the number of shadow requests in flight per profile,
+// after which further queries are not mirrored.
+const maxShadowRequests = 16
+
+// shadowTimeout is the timeout of shadow requests.
+const shadowTimeout = time.Minute
+
+// shadower mirrors a share of the allowed queries of a profile to a
+// secondary backend, without delaying the response to the client.
+type shadower struct {
+	Shadow
+	target   *url.URL
+	client   *http.Client
+	inflight chan struct{}
+
+	mu    sync.Mutex
+	diffs map[string]*shadowDiff // comparisons by query fingerprint.
+}
+
+func newShadower(cfg Shadow) (*shadower, error) {
+	target, err := url.Parse(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	return &shadower{
+		Shadow:   cfg,
+		target:   target,
+		client:   &http.Client{Timeout: shadowTimeout},
+		inflight: make(chan struct{}, maxShadowRequests),
+		diffs:    make(map[string]*shadowDiff),
+	}, nil
+}
+
+// mirror sends a copy of the query r to the shadow backend, if r is in the
+// sampled share. Without Compare the copy is sent right away and its
+// response is discarded. With Compare, the response written to the
+// returned ResponseWriter is recorded and the copy is sent once done is
+// called, so that the responses can be compared.
+func (s *shadower) mirror(w http.ResponseWriter, r *http.Request, prof *profile, query *influxql.Query) (_ http.ResponseWriter, done func()) {
+	done = func() {}
+	if s == nil || rand.Float64()*100 >= s.Percent {
+		return w, done
+	}
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		shadowRequests.Inc(prof.name, "dropped")
+		return w, done
+	}
+
+	// r must not be used once the handler returned. The response is
+	// decompressed by the client if needed.
+	u := *s.target
+	u.Path, u.RawQuery = r.URL.Path, r.URL.RawQuery
+	header := r.Header.Clone()
+	header.Del("Accept-Encoding")
+	method := r.Method
+
+	if !s.Compare {
+		go s.run(prof, method, u.String(), header, nil, nil)
+		return w, done
+	}
+	rec := &cacheRecorder{ResponseWriter: w}
+	return rec, func() {
+		go s.run(prof, method, u.String(), header, query, rec)
+	}
+}
+
+// run sends the shadow request and, if primary is set, compares the
+// responses.
+func (s *shadower) run(prof *profile, method, target string, header http.Header, query *influxql.Query, primary *cacheRecorder) {
+	defer func() { <-s.inflight }()
+
+	status, body, err := s.send(method, target, header, primary != nil)
+	switch {
+	case err != nil:
+		shadowRequests.Inc(prof.name, "error")
+		proxyLog.Debug("shadow request failed", "profile", prof.name, "backend", s.Backend, "err", err)
+		return
+	case status >= 500:
+		shadowRequests.Inc(prof.name, "error")
+	default:
+		shadowRequests.Inc(prof.name, "ok")
+	}
+	if primary != nil {
+		s.compare(prof, query, primary, status, body)
+	}
+}
+
+// send sends the shadow request and returns the status and, if keep is
+// set, the body of the response.
+func (s *shadower) send(method, target string, header http.Header, keep bool) (int, []byte, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header = header
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if !keep {
+		io.Copy(ioutil.Discard, resp.Body)
+		return resp.StatusCode, nil, nil
+	}
+	// One byte more than recorded of the primary response tells whether
+	// the body was truncated.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCacheEntrySize+1))
+	return resp.StatusCode, body, err
+}
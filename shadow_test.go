@@ -0,0 +1,80 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShadow(t *testing.T) {
+	captureLogs(t, "error", "console")
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer primary.Close()
+
+	mirrored := make(chan *http.Request, 1)
+	release := make(chan struct{})
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		mirrored <- r
+	}))
+	defer secondary.Close()
+
+	cfg := sourcesConfig("m")
+	cfg.Databases = map[string]string{"public": "db0"}
+	cfg.Shadow = &Shadow{Backend: secondary.URL, Percent: 100}
+	p, err := NewProxy(primary.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is answered while the secondary backend is still busy.
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?db=public&q="+url.QueryEscape("SELECT * FROM m"), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	close(release)
+
+	select {
+	case r := <-mirrored:
+		if r.URL.Path != "/query" || r.URL.Query().Get("db") != "db0" || r.URL.Query().Get("q") != "SELECT * FROM m" {
+			t.Fatalf("got shadow request %s, want rewritten query", r.URL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not mirrored")
+	}
+
+	// Rejected queries are not mirrored.
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM x"), nil))
+	select {
+	case r := <-mirrored:
+		t.Fatalf("rejected query mirrored: %s", r.URL)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestShadowDropped(t *testing.T) {
+	s, err := newShadower(Shadow{Backend: "http://localhost:0", Percent: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxShadowRequests; i++ {
+		s.inflight <- struct{}{}
+	}
+	prof := newProfile(Profile{Name: "dropped"}, false)
+	s.mirror(httptest.NewRecorder(), httptest.NewRequest("GET", "/query?q=x", nil), prof, nil)
+	if len(s.inflight) != maxShadowRequests {
+		t.Fatal("request sent although too many are in flight")
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// maxShadowFingerprints is the number of query fingerprints whose
+// comparisons are kept per profile.
+const maxShadowFingerprints = 1000
+
+// defaultShadowEpsilon is the relative difference up to which floats are
+// considered equal if Shadow.Epsilon is not set.
+const defaultShadowEpsilon = 1e-9
+
+// shadowDiff are the comparisons of the responses to the queries of a
+// fingerprint.
+type shadowDiff struct {
+	Profile      string    `json:"profile"`
+	Fingerprint  string    `json:"fingerprint"`
+	Query        string    `json:"query"`
+	Compared     uint64    `json:"compared"`
+	Mismatches   uint64    `json:"mismatches"`
+	MismatchRate float64   `json:"mismatch_rate"`
+	LastDiff     string    `json:"last_diff,omitempty"`
+	LastMismatch time.Time `json:"last_mismatch,omitempty"`
+}
+
+// compare compares the primary response to the shadow response and records
+// the result by fingerprint of query.
+func (s *shadower) compare(prof *profile, query *influxql.Query, primary *cacheRecorder, status int, body []byte) {
+	if primary.status == 0 || primary.truncated || len(body) > maxCacheEntrySize {
+		shadowComparisons.Inc(prof.name, "skipped")
+		return
+	}
+
+	diff := ""
+	if primary.status != status {
+		diff = fmt.Sprintf("status %d != %d", primary.status, status)
+	} else if status == http.StatusOK {
+		a, err := primaryResponses(primary)
+		if err != nil {
+			// Neither JSON nor MessagePack, e.g. CSV requested with an
+			// Accept header.
+			shadowComparisons.Inc(prof.name, "skipped")
+			return
+		}
+		// The shadow backend got the same Accept header.
+		b, err := decodeResponsesAs(primary.Header().Get("Content-Type"), body)
+		if err == nil {
+			if fn := chainRewrites(prof.tagValueFilter(query), prof.aliasRenamer(query)); fn != nil {
+				err = fn(b)
+			}
+		}
+		if err != nil {
+			diff = fmt.Sprintf("shadow response: %v", err)
+		} else {
+			eps := s.Epsilon
+			if eps == 0 {
+				eps = defaultShadowEpsilon
+			}
+			diff = diffResponses(a, b, eps)
+		}
+	}
+
+	result := "match"
+	if diff != "" {
+		result = "mismatch"
+	}
+	shadowComparisons.Inc(prof.name, result)
+
+	normalized, fp := fingerprint(query)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.diffs[fp]
+	if !ok {
+		if len(s.diffs) >= maxShadowFingerprints {
+			return
+		}
+		d = &shadowDiff{Profile: prof.name, Fingerprint: fp, Query: normalized}
+		s.diffs[fp] = d
+	}
+	d.Compared++
+	if diff != "" {
+		d.Mismatches++
+		d.LastDiff, d.LastMismatch = diff, time.Now().UTC()
+	}
+	d.MismatchRate = float64(d.Mismatches) / float64(d.Compared)
+}
+
+// primaryResponses decodes the recorded primary response.
+func primaryResponses(rec *cacheRecorder) ([]*influxResponse, error) {
+	body := rec.body.Bytes()
+	if rec.Header().Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	return decodeResponsesAs(rec.Header().Get("Content-Type"), body)
+}
+
+// diffResponses returns the first difference between the responses a and b,
+// or "" if they are equal. The order of series, rows and columns is
+// ignored, as are differences of floats up to the relative epsilon.
+func diffResponses(a, b []*influxResponse, epsilon float64) string {
+	na, nb := normalizeResponses(a), normalizeResponses(b)
+	if len(na) != len(nb) {
+		return fmt.Sprintf("%d results != %d", len(na), len(nb))
+	}
+	for i := range na {
+		ra, rb := na[i], nb[i]
+		if ra.err != rb.err {
+			return fmt.Sprintf("statement %d: error %q != %q", i, ra.err, rb.err)
+		}
+		for key, sa := range ra.series {
+			sb, ok := rb.series[key]
+			if !ok {
+				return fmt.Sprintf("statement %d: series %q missing", i, key)
+			}
+			if d := diffSeries(sa, sb, epsilon); d != "" {
+				return fmt.Sprintf("statement %d: series %q: %s", i, key, d)
+			}
+		}
+		for key := range rb.series {
+			if _, ok := ra.series[key]; !ok {
+				return fmt.Sprintf("statement %d: series %q unexpected", i, key)
+			}
+		}
+	}
+	return ""
+}
+
+// normalizedResult is the result of a statement, merged from all chunks.
+type normalizedResult struct {
+	err    string
+	series map[string]*normalizedSeries // by name and tags.
+}
+
+// normalizedSeries has its columns in sorted order and its rows sorted.
+type normalizedSeries struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func normalizeResponses(resps []*influxResponse) []*normalizedResult {
+	var results []*normalizedResult
+	byID := make(map[int]*normalizedResult)
+	for _, resp := range resps {
+		if resp.Err != "" {
+			results = append(results, &normalizedResult{err: resp.Err})
+			continue
+		}
+		for _, res := range resp.Results {
+			nr, ok := byID[res.StatementID]
+			if !ok {
+				nr = &normalizedResult{series: make(map[string]*normalizedSeries)}
+				byID[res.StatementID] = nr
+				results = append(results, nr)
+			}
+			if res.Err != "" {
+				nr.err = res.Err
+			}
+			for _, s := range res.Series {
+				key := s.Name
+				if tags := formatTags(s.Tags, func(s string) string { return s }); tags != "" {
+					key += "," + tags
+				}
+				ns, ok := nr.series[key]
+				if !ok {
+					ns = &normalizedSeries{columns: append([]string(nil), s.Columns...)}
+					sort.Strings(ns.columns)
+					nr.series[key] = ns
+				}
+				ns.addRows(s.Columns, s.Values)
+			}
+		}
+	}
+	for _, nr := range results {
+		for _, ns := range nr.series {
+			ns.sortRows()
+		}
+	}
+	return results
+}
+
+// sortRows sorts the rows by time, then by the values which are not
+// numbers and finally by the numbers. Numbers come last, so that rows of
+// two responses are aligned even if their floats differ slightly.
+func (ns *normalizedSeries) sortRows() {
+	timeCol := -1
+	if i := sort.SearchStrings(ns.columns, "time"); i < len(ns.columns) && ns.columns[i] == "time" {
+		timeCol = i
+	}
+	sort.SliceStable(ns.rows, func(i, j int) bool {
+		a, b := ns.rows[i], ns.rows[j]
+		if timeCol >= 0 {
+			if c := compareValues(a[timeCol], b[timeCol], true); c != 0 {
+				return c < 0
+			}
+		}
+		for _, numbers := range []bool{false, true} {
+			for k := range ns.columns {
+				if k == timeCol {
+					continue
+				}
+				if c := compareValues(a[k], b[k], numbers); c != 0 {
+					return c < 0
+				}
+			}
+		}
+		return false
+	})
+}
+
+// compareValues compares the values a and b of a row. Numbers are compared
+// by value if numbers is set and considered equal otherwise. Other values
+// are compared by their string form and sort before numbers.
+func compareValues(a, b interface{}, numbers bool) int {
+	fa, aok := number(a)
+	fb, bok := number(b)
+	switch {
+	case aok && bok:
+		if !numbers || fa == fb {
+			return 0
+		}
+		if fa < fb {
+			return -1
+		}
+		return 1
+	case aok:
+		return 1
+	case bok:
+		return -1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// addRows adds the rows with the given columns in the column order of the
+// series. Values of unknown columns are dropped, which shows as difference
+// of the columns.
+func (ns *normalizedSeries) addRows(columns []string, rows [][]interface{}) {
+	for _, row := range rows {
+		nrow := make([]interface{}, len(ns.columns))
+		for i, c := range columns {
+			if j := sort.SearchStrings(ns.columns, c); j < len(ns.columns) && ns.columns[j] == c && i < len(row) {
+				nrow[j] = row[i]
+			}
+		}
+		ns.rows = append(ns.rows, nrow)
+	}
+}
+
+func diffSeries(a, b *normalizedSeries, epsilon float64) string {
+	if !equalStrings(a.columns, b.columns) {
+		return fmt.Sprintf("columns %v != %v", a.columns, b.columns)
+	}
+	if len(a.rows) != len(b.rows) {
+		return fmt.Sprintf("%d rows != %d", len(a.rows), len(b.rows))
+	}
+	for i := range a.rows {
+		for j, c := range a.columns {
+			if !equalValues(a.rows[i][j], b.rows[i][j], epsilon) {
+				return fmt.Sprintf("row %d column %q: %v != %v", i, c, a.rows[i][j], b.rows[i][j])
+			}
+		}
+	}
+	return ""
+}
+
+// equalValues reports whether the JSON or MessagePack values a and b are
+// equal. Numbers may differ up to epsilon relative to the larger one, or
+// absolute if both are below 1.
+func equalValues(a, b interface{}, epsilon float64) bool {
+	fa, aok := number(a)
+	fb, bok := number(b)
+	if aok != bok {
+		return false
+	}
+	if !aok || fmt.Sprint(a) == fmt.Sprint(b) {
+		return fmt.Sprint(a) == fmt.Sprint(b)
+	}
+	return math.Abs(fa-fb) <= epsilon*math.Max(1, math.Max(math.Abs(fa), math.Abs(fb)))
+}
+
+// number returns the value of a decoded JSON or MessagePack number.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// shadowReport returns the comparisons of all profiles of the current
+// policy, the highest mismatch rates first.
+func (p *Proxy) shadowReport() []shadowDiff {
+	pol := p.policy()
+
+	report := []shadowDiff{}
+	for _, prof := range append([]*profile{pol.defaultProfile}, pol.profiles...) {
+		s := prof.shadow
+		if s == nil {
+			continue
+		}
+		s.mu.Lock()
+		for _, d := range s.diffs {
+			report = append(report, *d)
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].MismatchRate != report[j].MismatchRate {
+			return report[i].MismatchRate > report[j].MismatchRate
+		}
+		if report[i].Compared != report[j].Compared {
+			return report[i].Compared > report[j].Compared
+		}
+		return report[i].Profile+report[i].Fingerprint < report[j].Profile+report[j].Fingerprint
+	})
+	return report
+}
+
+// shadowHandler serves the comparisons of shadowed queries as JSON on the
+// admin listener.
+func (p *Proxy) shadowHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.shadowReport())
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffResponses(t *testing.T) {
+	const base = `{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5],[2,2.5]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]}]}]}`
+
+	testCases := map[string]struct {
+		other string
+		want  string // prefix of the difference, "" if equal.
+	}{
+		"equal":          {base, ""},
+		"seriesOrder":    {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]},{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5],[2,2.5]]}]}]}`, ""},
+		"rowOrder":       {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[2,2.5],[1,1.5]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]}]}]}`, ""},
+		"columnOrder":    {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["v","time"],"values":[[1.5,1],[2.5,2]]},{"name":"m","tags":{"s":"b"},"columns":["v","time"],"values":[[3,1]]}]}]}`, ""},
+		"epsilon":        {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5000000000001],[2,2.5]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3.0]]}]}]}`, ""},
+		"chunked":        {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5]],"partial":true}],"partial":true}]}` + "\n" + `{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[2,2.5]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]}]}]}`, ""},
+		"value":          {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5],[2,2.6]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]}]}]}`, `statement 0: series "m,s=a": row 1 column "v"`},
+		"missingRow":     {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]}]}]}`, `statement 0: series "m,s=a": 2 rows != 1`},
+		"missingSeries":  {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,1.5],[2,2.5]]}]}]}`, `statement 0: series "m,s=b" missing`},
+		"stringVsNumber": {`{"results":[{"statement_id":0,"series":[{"name":"m","tags":{"s":"a"},"columns":["time","v"],"values":[[1,"1.5"],[2,2.5]]},{"name":"m","tags":{"s":"b"},"columns":["time","v"],"values":[[1,3]]}]}]}`, `statement 0: series "m,s=a": row 0 column "v"`},
+		"error":          {`{"results":[{"statement_id":0,"error":"timeout"}]}`, `statement 0: error`},
+		"results":        {`{"results":[{"statement_id":0},{"statement_id":1}]}`, `1 results != 2`},
+	}
+
+	a, err := decodeResponses([]byte(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b, err := decodeResponses([]byte(tc.other))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := diffResponses(a, b, defaultShadowEpsilon)
+			if (tc.want == "") != (got == "") || !strings.HasPrefix(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffResponsesAlignment(t *testing.T) {
+	// Rows are aligned by time and the string column b, although the
+	// floats in a, which sorts first, differ slightly.
+	a, err := decodeResponses([]byte(`{"results":[{"statement_id":0,"series":[{"name":"m","columns":["time","a","b"],"values":[[1,1,"x"],[1,1.0000000000001,"y"],[2,5,"x"]]}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := decodeResponses([]byte(`{"results":[{"statement_id":0,"series":[{"name":"m","columns":["time","a","b"],"values":[[2,5,"x"],[1,1,"y"],[1,1.0000000000001,"x"]]}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := diffResponses(a, b, defaultShadowEpsilon); got != "" {
+		t.Fatalf("got difference %q, want none", got)
+	}
+}
+
+func TestShadowCompare(t *testing.T) {
+	captureLogs(t, "error", "console")
+
+	backend := func(v string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Both backends agree on all but m1.
+			value := v
+			if !strings.Contains(r.URL.Query().Get("q"), "m1") {
+				value = "1"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"m","columns":["time","v"],"values":[[0,%s]]}]}]}`, value)
+		}))
+	}
+	primary, secondary := backend("1"), backend("2")
+	defer primary.Close()
+	defer secondary.Close()
+
+	cfg := sourcesConfig("m1", "m2", "m")
+	cfg.Aliases = map[string]string{"alias": "m"}
+	cfg.Shadow = &Shadow{Backend: secondary.URL, Percent: 100, Compare: true}
+	p, err := NewProxy(primary.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"SELECT * FROM m1", "SELECT * FROM m1", "SELECT * FROM m2", "SELECT * FROM alias"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape(q), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+
+	var report []shadowDiff
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		report = p.shadowReport()
+		compared := uint64(0)
+		for _, d := range report {
+			compared += d.Compared
+		}
+		if compared == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got report %+v, want 4 comparisons", report)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(report) != 3 {
+		t.Fatalf("got %d fingerprints, want 3", len(report))
+	}
+	if d := report[0]; d.Query != "SELECT * FROM m1" || d.Compared != 2 || d.MismatchRate != 1 || !strings.Contains(d.LastDiff, "1 != 2") {
+		t.Fatalf("got %+v, want mismatches of m1", d)
+	}
+	// The series of the shadow backend are renamed to the alias as well.
+	for _, d := range report[1:] {
+		if d.Mismatches != 0 {
+			t.Fatalf("got %+v, want matches", d)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sloWindows are the windows over which burn rates are calculated. Comparing
+// a short and a long window tells whether the error budget is burning right
+// now or has been for a while.
+var sloWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// sloBuckets is the number of one minute buckets kept per SLO, enough for
+// the longest window.
+const sloBuckets = 6 * 60
+
+// sloTracker counts the good and bad requests of an SLO in one minute
+// buckets.
+type sloTracker struct {
+	SLO
+	profile string
+
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket // ring buffer indexed by minute.
+}
+
+type sloBucket struct {
+	minute int64 // minutes since the epoch.
+	total  uint64
+	bad    uint64
+}
+
+// endpointSLOs returns the SLO trackers of the profile for the endpoint at
+// path.
+func (prof *profile) endpointSLOs(path string) []*sloTracker {
+	var slos []*sloTracker
+	for _, s := range prof.slos {
+		if s.Endpoint == path {
+			slos = append(slos, s)
+		}
+	}
+	return slos
+}
+
+// record records a request which took d and was answered with status.
+func (s *sloTracker) record(d time.Duration, status int, now time.Time) {
+	bad := status >= 500 || (s.Latency > 0 && d > time.Duration(s.Latency))
+
+	s.mu.Lock()
+	m := now.Unix() / 60
+	b := &s.buckets[m%sloBuckets]
+	if b.minute != m {
+		*b = sloBucket{minute: m}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+	s.mu.Unlock()
+
+	result := "good"
+	if bad {
+		result = "bad"
+	}
+	sloRequests.Inc(s.profile, s.Endpoint, s.name(), result)
+}
+
+// burnRate returns the rate at which the error budget was spent during the
+// window up to now, together with the number of requests. A burn rate of 1
+// exhausts the budget exactly if sustained; above 1 the objective is
+// missed.
+func (s *sloTracker) burnRate(window time.Duration, now time.Time) (rate float64, total, bad uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := now.Unix() / 60
+	for i := int64(0); i < int64(window/time.Minute) && i < sloBuckets; i++ {
+		b := s.buckets[(m-i)%sloBuckets]
+		if b.minute == m-i {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	if total == 0 {
+		return 0, 0, 0
+	}
+	return float64(bad) / float64(total) / (1 - s.Objective), total, bad
+}
+
+// statusWriter is a http.ResponseWriter recording the response status. It
+// passes flushes through, so responses are streamed.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sloSummary is the state of an SLO as served on the admin listener.
+type sloSummary struct {
+	Profile   string                    `json:"profile"`
+	Endpoint  string                    `json:"endpoint"`
+	Name      string                    `json:"name"`
+	Latency   duration                  `json:"latency,omitempty"`
+	Objective float64                   `json:"objective"`
+	Windows   map[string]sloWindowState `json:"windows"`
+}
+
+type sloWindowState struct {
+	Requests uint64  `json:"requests"`
+	Bad      uint64  `json:"bad"`
+	BurnRate float64 `json:"burn_rate"`
+}
+
+// sloSummaries returns the state of all SLOs of the current policy and
+// updates the burn rate metrics accordingly.
+func (p *Proxy) sloSummaries(now time.Time) []sloSummary {
+	pol := p.policy()
+
+	summaries := []sloSummary{}
+	sloBurnRate.Reset()
+	for _, prof := range append([]*profile{pol.defaultProfile}, pol.profiles...) {
+		for _, s := range prof.slos {
+			sum := sloSummary{
+				Profile:   prof.name,
+				Endpoint:  s.Endpoint,
+				Name:      s.name(),
+				Latency:   s.Latency,
+				Objective: s.Objective,
+				Windows:   make(map[string]sloWindowState),
+			}
+			for _, w := range sloWindows {
+				rate, total, bad := s.burnRate(w.d, now)
+				sum.Windows[w.name] = sloWindowState{Requests: total, Bad: bad, BurnRate: rate}
+				sloBurnRate.Set(rate, prof.name, s.Endpoint, s.name(), w.name)
+			}
+			summaries = append(summaries, sum)
+		}
+	}
+	return summaries
+}
+
+// sloHandler serves the state of all SLOs as JSON on the admin listener.
+func (p *Proxy) sloHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.sloSummaries(time.Now()))
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOTracker(t *testing.T) {
+	s := &sloTracker{SLO: SLO{Endpoint: "/query", Latency: duration(time.Second), Objective: 0.9}}
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Two hours ago, only within the 6h window.
+	for i := 0; i < 10; i++ {
+		s.record(2*time.Second, http.StatusOK, now.Add(-2*time.Hour))
+	}
+	// Within the last minute: 1 slow, 1 error, 8 good.
+	s.record(2*time.Second, http.StatusOK, now)
+	s.record(time.Millisecond, http.StatusBadGateway, now)
+	for i := 0; i < 8; i++ {
+		s.record(time.Millisecond, http.StatusOK, now)
+	}
+	// Client errors are good.
+	s.record(time.Millisecond, http.StatusNotAcceptable, now)
+
+	testCases := map[string]struct {
+		window     time.Duration
+		total, bad uint64
+		rate       float64
+	}{
+		"5m": {5 * time.Minute, 11, 2, 2.0 / 11 / 0.1},
+		"6h": {6 * time.Hour, 21, 12, 12.0 / 21 / 0.1},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rate, total, bad := s.burnRate(tc.window, now)
+			if total != tc.total || bad != tc.bad {
+				t.Fatalf("got %d requests, %d bad, want %d, %d", total, bad, tc.total, tc.bad)
+			}
+			if diff := rate - tc.rate; diff > 1e-9 || diff < -1e-9 {
+				t.Fatalf("got burn rate %v, want %v", rate, tc.rate)
+			}
+		})
+	}
+
+	// Buckets older than the ring buffer are not counted again.
+	if _, total, _ := s.burnRate(6*time.Hour, now.Add(7*time.Hour)); total != 0 {
+		t.Fatalf("got %d requests after 7h, want 0", total)
+	}
+}
+
+func TestSLOEndpoint(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("q"), "fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("a", "fail")
+	cfg.SLOs = []SLO{{Endpoint: "/query", Objective: 0.5}}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"a", "a", "a", "fail", "b"} {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/query?q=SELECT+*+FROM+"+q, nil))
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping", nil))
+
+	w := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/slo", nil))
+	var got []sloSummary
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Profile != defaultProfileName || got[0].Name != "errors" {
+		t.Fatalf("got %+v, want errors SLO of the default profile", got)
+	}
+	if ws := got[0].Windows["5m"]; ws.Requests != 5 || ws.Bad != 1 || ws.BurnRate != 0.4 {
+		t.Fatalf("got 5m window %+v, want 5 requests, 1 bad, burn rate 0.4", ws)
+	}
+
+	w = httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `influxdb_proxy_slo_burn_rate{profile="default",endpoint="/query",slo="errors",window="5m"} 0.4`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("metrics do not contain %q", want)
+	}
+}
+
+func TestReloadSLO(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	cfg := sourcesConfig("a")
+	cfg.SLOs = []SLO{{Endpoint: "/query", Objective: 0.99}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := p.policy().defaultProfile.slos[0]
+
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.policy().defaultProfile.slos[0]; s != old {
+		t.Fatal("unchanged SLO not kept on reload")
+	}
+
+	cfg.SLOs[0].Objective = 0.9
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.policy().defaultProfile.slos[0]; s == old || s.Objective != 0.9 {
+		t.Fatal("changed SLO not applied on reload")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/influxql"
+)
+
+// splits reports whether the statements of query sent with r are run as
+// separate backend queries. Chunked responses are streamed and CSV
+// responses cannot be merged, so such queries are forwarded as they are.
+func (prof *profile) splits(r *http.Request, query *influxql.Query) bool {
+	if prof.split == 0 || len(query.Statements) < 2 {
+		return false
+	}
+	return r.URL.Query().Get("chunked") != "true" && !strings.Contains(r.Header.Get("Accept"), "csv")
+}
+
+// serveSplit runs each statement of query as a backend query of its own, at
+// most prof.split at once, and writes the merged responses to w in the
+// order of the statements. Each statement is cached on its own. If a
+// statement fails, its response is written instead.
+func (p *Proxy) serveSplit(w http.ResponseWriter, r *http.Request, prof *profile, query *influxql.Query) {
+	parts := make([]*bufferedResponse, len(query.Statements))
+	sem := make(chan struct{}, prof.split)
+	var wg sync.WaitGroup
+	for i, stmt := range query.Statements {
+		select {
+		case sem <- struct{}{}:
+		case <-r.Context().Done():
+			// The client is gone.
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(i int, stmt influxql.Statement) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			parts[i] = p.serveStatement(r, prof, stmt)
+		}(i, stmt)
+	}
+	wg.Wait()
+
+	for _, part := range parts {
+		if part.status != http.StatusOK {
+			part.writeTo(w)
+			return
+		}
+	}
+
+	merged := &influxResponse{}
+	for i, part := range parts {
+		resps, err := decodeResponsesAs(part.header.Get("Content-Type"), part.body.Bytes())
+		if err != nil {
+			reportError(w, fmt.Errorf("decoding response of statement %d: %v", i, err), http.StatusBadGateway)
+			return
+		}
+		for _, resp := range resps {
+			if resp.Err != "" {
+				part.writeTo(w)
+				return
+			}
+			for _, res := range resp.Results {
+				res.StatementID = i
+				merged.Results = append(merged.Results, res)
+			}
+		}
+	}
+
+	var (
+		body []byte
+		err  error
+	)
+	if header := parts[0].header; isMsgpack(header.Get("Content-Type")) {
+		body, err = encodeMsgpackResponses([]*influxResponse{merged})
+	} else {
+		body, err = encodeResponses([]*influxResponse{merged}, r.URL.Query().Get("pretty") == "true")
+	}
+	if err != nil {
+		reportError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for k, v := range parts[0].header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("X-Cache")
+	if c := splitCacheStatus(parts); c != "" {
+		w.Header().Set("X-Cache", c)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// serveStatement runs the single statement stmt of the query r, from the
+// cache if possible, and returns the buffered response.
+func (p *Proxy) serveStatement(r *http.Request, prof *profile, stmt influxql.Statement) *bufferedResponse {
+	sub := r.Clone(r.Context())
+	params := sub.URL.Query()
+	params.Set("q", stmt.String())
+	sub.URL.RawQuery = params.Encode()
+	sub.Body, sub.ContentLength = http.NoBody, 0
+	// The responses are merged, so they must not be compressed.
+	sub.Header.Del("Accept-Encoding")
+
+	w := &bufferedResponse{header: make(http.Header)}
+	p.serveCachedOrForward(w, sub, prof, &influxql.Query{Statements: influxql.Statements{stmt}})
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w
+}
+
+// splitCacheStatus returns the X-Cache header of merged responses: HIT if
+// all statements were served from the cache, MISS if any cacheable
+// statement was not, and BYPASS otherwise. It is empty without cache.
+func splitCacheStatus(parts []*bufferedResponse) string {
+	hits, misses := 0, 0
+	for _, part := range parts {
+		switch part.header.Get("X-Cache") {
+		case "":
+			return ""
+		case "HIT":
+			hits++
+		case "MISS":
+			misses++
+		}
+	}
+	switch {
+	case hits == len(parts):
+		return "HIT"
+	case misses > 0:
+		return "MISS"
+	}
+	return "BYPASS"
+}
+
+// bufferedResponse is a http.ResponseWriter buffering the response of a
+// single statement.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) Flush() {}
+
+// writeTo writes the buffered response to w.
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
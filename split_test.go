@@ -0,0 +1,144 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// splitBackend answers each statement with a series named after its
+// measurement and records the queries and the maximum number of queries
+// running at once.
+type splitBackend struct {
+	mu      sync.Mutex
+	queries []string
+	running int
+	max     int
+}
+
+func (b *splitBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	b.mu.Lock()
+	b.queries = append(b.queries, q)
+	b.running++
+	if b.running > b.max {
+		b.max = b.running
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.running--
+		b.mu.Unlock()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Contains(q, "broken") {
+		fmt.Fprint(w, `{"results":[{"statement_id":0,"error":"shard unavailable"}]}`)
+		return
+	}
+	if strings.Contains(q, ";") {
+		fmt.Fprint(w, `{"results":[{"statement_id":0},{"statement_id":1}]}`)
+		return
+	}
+	name := strings.TrimSpace(q[strings.Index(q, "FROM")+4:])
+	fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":%q,"columns":["time","v"],"values":[[0,1]]}]}]}`, name)
+}
+
+func (b *splitBackend) reset() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queries := b.queries
+	b.queries, b.max = nil, 0
+	return queries
+}
+
+func TestSplitStatements(t *testing.T) {
+	b := new(splitBackend)
+	backend := httptest.NewServer(b)
+	defer backend.Close()
+
+	cfg := sourcesConfig("m1", "m2", "m3", "m4", "m5", "broken")
+	cfg.SplitStatements = 2
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache = newMemoryCache()
+	p.cacheTTL = time.Minute
+
+	query := func(q string, params ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		values := url.Values{"db": {"mydb"}, "q": {q}}
+		for i := 0; i < len(params); i += 2 {
+			values.Set(params[i], params[i+1])
+		}
+		r := httptest.NewRequest("GET", "/query?"+values.Encode(), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		return w
+	}
+
+	w := query("SELECT * FROM m1; SELECT * FROM m2; SELECT * FROM m3; SELECT * FROM m4")
+	want := `{"results":[` +
+		`{"statement_id":0,"series":[{"name":"m1","columns":["time","v"],"values":[[0,1]]}]},` +
+		`{"statement_id":1,"series":[{"name":"m2","columns":["time","v"],"values":[[0,1]]}]},` +
+		`{"statement_id":2,"series":[{"name":"m3","columns":["time","v"],"values":[[0,1]]}]},` +
+		`{"statement_id":3,"series":[{"name":"m4","columns":["time","v"],"values":[[0,1]]}]}]}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("got X-Cache %q, want MISS", got)
+	}
+	if got := len(b.queries); got != 4 {
+		t.Fatalf("got %d backend queries, want 4", got)
+	}
+	if b.max != 2 {
+		t.Fatalf("got %d statements at once, want 2", b.max)
+	}
+	b.reset()
+
+	// Statements are cached on their own.
+	w = query("SELECT * FROM m4; SELECT * FROM m1")
+	if got := w.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("got X-Cache %q, want HIT", got)
+	}
+	w = query("SELECT * FROM m1; SELECT * FROM m5; SELECT * FROM m2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if got, want := b.reset(), []string{"SELECT * FROM m5"}; len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("got backend queries %q, want %q", got, want)
+	}
+
+	// Errors of single statements are kept.
+	w = query("SELECT * FROM m1; SELECT * FROM broken")
+	if got := w.Body.String(); !strings.Contains(got, `{"statement_id":1,"error":"shard unavailable"}`) {
+		t.Fatalf("got %s", got)
+	}
+	b.reset()
+
+	// Chunked and CSV responses are not split.
+	query("SELECT * FROM m2; SELECT * FROM m3", "chunked", "true")
+	r := httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM m2; SELECT * FROM m3"), nil)
+	r.Header.Set("Accept", "application/csv")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	for _, q := range b.reset() {
+		if !strings.Contains(q, ";") {
+			t.Fatalf("got split query %q", q)
+		}
+	}
+}
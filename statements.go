@@ -0,0 +1,86 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/influxdata/influxql"
+)
+
+// ErrStatementLimit is returned if a client sent more statements than
+// allowed by the statement limit of its profile.
+var ErrStatementLimit = errors.New("statement limit exceeded")
+
+// statementSemaphore limits the number of statements executed by the
+// backends at once, as a query with many statements fans out into parallel
+// work on the backend.
+type statementSemaphore struct {
+	mu     sync.Mutex // serializes acquire, so that partial acquisitions cannot deadlock.
+	tokens chan struct{}
+}
+
+// newStatementSemaphore returns a semaphore allowing n statements at once.
+func newStatementSemaphore(n int) *statementSemaphore {
+	return &statementSemaphore{tokens: make(chan struct{}, n)}
+}
+
+// acquire blocks until n statements may be executed or ctx is done. Queries
+// with more statements than allowed at once acquire all of them. It returns
+// the number of statements to release.
+func (s *statementSemaphore) acquire(ctx context.Context, n int) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	if n > cap(s.tokens) {
+		n = cap(s.tokens)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		select {
+		case s.tokens <- struct{}{}:
+		case <-ctx.Done():
+			s.release(i)
+			return 0, ctx.Err()
+		}
+	}
+	backendStatements.Set(float64(len(s.tokens)))
+	return n, nil
+}
+
+// release releases n statements acquired before.
+func (s *statementSemaphore) release(n int) {
+	if s == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-s.tokens
+	}
+	backendStatements.Set(float64(len(s.tokens)))
+}
+
+// forward proxies the query r to the backend of the profile once its
+// statements may be executed, within the query timeout of the profile.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, prof *profile, query *influxql.Query) {
+	n, err := p.statements.acquire(r.Context(), len(query.Statements))
+	if err != nil {
+		// The client is gone.
+		return
+	}
+	defer p.statements.release(n)
+
+	client := r.Context()
+	r, cancel := prof.withDeadline(r)
+	defer cancel()
+	// Deferred, as the reverse proxy aborts with a panic if the response
+	// is cut off while streaming.
+	defer countCancelled(prof, client, r.Context())
+	prof.proxy.ServeHTTP(w, r)
+}
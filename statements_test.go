@@ -0,0 +1,90 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStatementSemaphore(t *testing.T) {
+	s := newStatementSemaphore(3)
+
+	n, err := s.acquire(context.Background(), 2)
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v, want 2 statements", n, err)
+	}
+
+	// Two more statements have to wait for the first ones.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, 2); err == nil {
+		t.Fatal("acquired more statements than allowed")
+	}
+	if got := len(s.tokens); got != 2 {
+		t.Fatalf("got %d statements after canceled acquire, want 2", got)
+	}
+
+	done := make(chan int)
+	go func() {
+		n, _ := s.acquire(context.Background(), 2)
+		done <- n
+	}()
+	s.release(2)
+	if n := <-done; n != 2 {
+		t.Fatalf("got %d statements, want 2", n)
+	}
+	s.release(2)
+
+	// Queries with more statements than allowed at once acquire all.
+	if n, _ := s.acquire(context.Background(), 10); n != 3 {
+		t.Fatalf("got %d statements, want 3", n)
+	}
+}
+
+func TestStatementLimit(t *testing.T) {
+	captureLogs(t, "error", "console")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer backend.Close()
+
+	cfg := sourcesConfig("m")
+	cfg.Measurements[0].ForbiddenTags = []string{"owner"}
+	cfg.Profile.StatementLimit = &StatementLimit{Statements: 5, Per: duration(time.Hour)}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.statements = newStatementSemaphore(2)
+
+	query := func(q string) int {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape(q), nil))
+		return w.Code
+	}
+	// Rejected queries are not charged.
+	if code := query("SELECT * FROM m WHERE owner = 'a'; SELECT * FROM m; SELECT * FROM m"); code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d, want %d", code, http.StatusNotAcceptable)
+	}
+	if code := query("SELECT * FROM m; SELECT * FROM m; SELECT * FROM m"); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if code := query("SELECT * FROM m; SELECT * FROM m; SELECT * FROM m"); code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := query("SELECT * FROM m; SELECT * FROM m"); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if got := len(p.statements.tokens); got != 0 {
+		t.Fatalf("got %d statements in flight, want 0", got)
+	}
+}
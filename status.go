@@ -0,0 +1,134 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statusFiles are the static assets of the status page, embedded so that
+// the binary stays self-contained.
+//
+//go:embed status
+var statusFiles embed.FS
+
+// pingTimeout is the time backends have to answer the health check of the
+// status page.
+const pingTimeout = 2 * time.Second
+
+// statusData is the state of the proxy shown on the status page. Counts are
+// totals since the start, the page derives rates from successive polls.
+type statusData struct {
+	Time       time.Time          `json:"time"`
+	Info       *proxyInfo         `json:"info"`
+	Queries    float64            `json:"queries"`
+	Rejections map[string]float64 `json:"rejections"` // by reason.
+	Cache      map[string]float64 `json:"cache"`      // lookups by result, nil without cache.
+	Backends   []backendStatus    `json:"backends"`
+	Profiles   []profileInfo      `json:"profiles"`
+}
+
+// backendStatus is the result of the health check of a backend.
+type backendStatus struct {
+	Address   string  `json:"address"`
+	Up        bool    `json:"up"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// statusHandler serves the status page below /status/ and its data as
+// JSON on /status/data.
+func (p *Proxy) statusHandler() http.Handler {
+	files, err := fs.Sub(statusFiles, "status")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/status/", http.StripPrefix("/status/", http.FileServer(http.FS(files))))
+	mux.HandleFunc("/status/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(p.status(r.Context(), time.Now()))
+	})
+	return mux
+}
+
+// status collects the state of the proxy at now, checking the health of
+// all backends.
+func (p *Proxy) status(ctx context.Context, now time.Time) *statusData {
+	pol := p.policy()
+	s := &statusData{
+		Time:       now,
+		Info:       p.info(now),
+		Queries:    queriesTotal.totals("")[""],
+		Rejections: rejectionsTotal.totals("reason"),
+		Profiles:   pol.profileInfos(),
+	}
+	if p.cache != nil {
+		s.Cache = cacheRequests.totals("result")
+	}
+
+	seen := make(map[string]bool)
+	for _, prof := range append([]*profile{pol.defaultProfile}, pol.profiles...) {
+		if !seen[prof.backend] {
+			seen[prof.backend] = true
+			s.Backends = append(s.Backends, backendStatus{Address: prof.backend})
+		}
+	}
+	sort.Slice(s.Backends, func(i, j int) bool { return s.Backends[i].Address < s.Backends[j].Address })
+
+	var wg sync.WaitGroup
+	for i := range s.Backends {
+		wg.Add(1)
+		go func(b *backendStatus) {
+			defer wg.Done()
+			start := time.Now()
+			err := ping(ctx, b.Address)
+			b.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+			b.Up = err == nil
+			if err != nil {
+				b.Error = err.Error()
+			}
+		}(&s.Backends[i])
+	}
+	wg.Wait()
+	return s
+}
+
+// ping checks the health of the InfluxDB server at addr with its /ping
+// endpoint.
+func ping(ctx context.Context, addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	u.Path = "/ping"
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("backend responded with %s", resp.Status)
+	}
+	return nil
+}
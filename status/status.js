@@ -0,0 +1,103 @@
+// Status page of the InfluxDB proxy. It polls the state of the proxy and
+// derives rates from the totals of successive polls.
+"use strict";
+
+const interval = 5000;
+let previous = null;
+
+function cell(row, text, className) {
+	const td = row.insertCell();
+	td.textContent = text;
+	if (className) {
+		td.className = className;
+	}
+	return td;
+}
+
+function fill(id, rows) {
+	const body = document.getElementById(id);
+	body.replaceChildren();
+	for (const values of rows) {
+		const row = body.insertRow();
+		for (const v of values) {
+			if (Array.isArray(v)) {
+				cell(row, v[0], v[1]);
+			} else {
+				cell(row, v);
+			}
+		}
+	}
+}
+
+// perMinute returns the rate of a total since the previous poll.
+function perMinute(total, prev, seconds) {
+	if (prev === undefined || seconds <= 0) {
+		return "–";
+	}
+	return (Math.max(total - prev, 0) * 60 / seconds).toFixed(1);
+}
+
+function sum(counts) {
+	return Object.values(counts || {}).reduce((a, b) => a + b, 0);
+}
+
+function render(s) {
+	const seconds = previous ? (Date.parse(s.time) - Date.parse(previous.time)) / 1000 : 0;
+	const prev = previous || {rejections: {}};
+	const rejected = sum(s.rejections);
+
+	document.getElementById("info").textContent =
+		`version ${s.info.version} (${s.info.commit}), policy ${s.info.policy_version}, ` +
+		`up ${Math.floor(s.info.uptime_seconds / 3600)}h ${Math.floor(s.info.uptime_seconds / 60) % 60}m`;
+
+	document.getElementById("queries-rate").textContent = perMinute(s.queries, prev.queries, seconds) + " / min";
+	document.getElementById("queries-total").textContent = s.queries;
+	document.getElementById("rejections-rate").textContent =
+		perMinute(rejected, previous ? sum(prev.rejections) : undefined, seconds) + " / min";
+	document.getElementById("rejections-total").textContent = rejected;
+
+	fill("rejections", Object.keys(s.rejections).sort().map(reason => [
+		reason,
+		[perMinute(s.rejections[reason], previous ? prev.rejections[reason] || 0 : undefined, seconds), "num"],
+		[s.rejections[reason], "num"],
+	]));
+
+	fill("backends", s.backends.map(b => [
+		b.address,
+		b.up ? ["up", "up"] : ["down: " + b.error, "down"],
+		[b.latency_ms.toFixed(1) + " ms", "num"],
+	]));
+
+	if (s.cache) {
+		const hits = s.cache.hit || 0, misses = s.cache.miss || 0;
+		const ratio = hits + misses > 0 ? (100 * hits / (hits + misses)).toFixed(1) + " %" : "–";
+		fill("cache", [[[hits, "num"], [misses, "num"], [s.cache.bypass || 0, "num"], [ratio, "num"]]]);
+	} else {
+		fill("cache", [["disabled"]]);
+	}
+
+	fill("profiles", s.profiles.map(p => [
+		p.name,
+		[p.prefix || ""].concat(p.hosts || []).filter(Boolean).join(", ") || "/",
+		p.backend,
+		p.measurements.join(", "),
+	]));
+
+	document.getElementById("updated").textContent = "Updated " + new Date(s.time).toLocaleTimeString();
+	previous = s;
+}
+
+async function poll() {
+	try {
+		const resp = await fetch("data", {cache: "no-store"});
+		if (!resp.ok) {
+			throw new Error(resp.status + " " + resp.statusText);
+		}
+		render(await resp.json());
+	} catch (err) {
+		document.getElementById("updated").textContent = "Update failed: " + err.message;
+	}
+	setTimeout(poll, interval);
+}
+
+poll();
@@ -0,0 +1,88 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStatusPage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer backend.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := sourcesConfig("m1", "m2")
+	cfg.AdminAuth = &Auth{Users: map[string]string{"admin": string(hash)}}
+	cfg.Profiles = []Profile{{Name: "down", Prefix: "/down", Backend: "http://127.0.0.1:1", Measurements: []Measurement{{Name: "m3"}}}}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := p.adminHandler()
+
+	get := func(path string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if auth {
+			r.SetBasicAuth("admin", "secret")
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, path := range []string{"/status/", "/status/data", "/metrics", "/policy"} {
+		if w := get(path, false); w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: got status %d without credentials, want %d", path, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	for path, want := range map[string]string{"/status/": "<title>InfluxDB proxy status</title>", "/status/status.js": "fetch(\"data\""} {
+		w := get(path, true)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("%s: got status %d, body %q", path, w.Code, w.Body)
+		}
+	}
+
+	w := get("/status/data", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var s statusData
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Backends) != 2 {
+		t.Fatalf("got backends %+v", s.Backends)
+	}
+	for _, b := range s.Backends {
+		if up := b.Address == backend.URL; b.Up != up {
+			t.Fatalf("%s: got up %v, want %v (%s)", b.Address, b.Up, up, b.Error)
+		}
+	}
+	if s.Cache != nil {
+		t.Fatalf("got cache stats %v without cache", s.Cache)
+	}
+	var allowlist [][]string
+	for _, prof := range s.Profiles {
+		allowlist = append(allowlist, prof.Measurements)
+	}
+	if want := [][]string{{"m1", "m2"}, {"m3"}}; !reflect.DeepEqual(allowlist, want) {
+		t.Fatalf("got allowlist %v, want %v", allowlist, want)
+	}
+}
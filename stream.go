@@ -0,0 +1,43 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// setFlushInterval sets the interval in which the reverse proxies of all
+// profiles flush the response to the client while copying the response body.
+// A negative value flushes immediately after each write.
+//
+// It must be called before the proxy serves requests.
+func (p *Proxy) setFlushInterval(d time.Duration) {
+	p.flushInterval = d
+	pol := p.policy()
+	pol.defaultProfile.proxy.FlushInterval = d
+	for _, prof := range pol.profiles {
+		prof.proxy.FlushInterval = d
+	}
+}
+
+// countingWriter is a http.ResponseWriter counting the bytes written to the
+// client. It passes flushes through, so responses are streamed.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
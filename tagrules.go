@@ -0,0 +1,138 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/influxdata/influxql"
+)
+
+// Tag rule errors.
+var (
+	// ErrForbiddenTag is returned if a query filters or groups by a tag
+	// which is forbidden for one of its measurements.
+	ErrForbiddenTag = errors.New("filtering or grouping by tag not allowed")
+
+	// ErrGroupByNotAllowed is returned if a query groups by a tag which is
+	// not in the GROUP BY allowlist of one of its measurements.
+	ErrGroupByNotAllowed = errors.New("grouping by tag not allowed")
+)
+
+// checkTags checks that the statements of q, including their subqueries,
+// do not filter or group by tags which are forbidden for the measurements
+// they query, and only group by tags allowed for them. Tags referenced by an
+// outer query apply to the measurements of its subqueries.
+func (prof *profile) checkTags(q *influxql.Query) error {
+	var err error
+	influxql.WalkFunc(q, func(n influxql.Node) {
+		if err != nil {
+			return
+		}
+		switch s := n.(type) {
+		case *influxql.SelectStatement:
+			forbidden := prof.forbiddenTags(s.Sources)
+			err = checkCondition(s.Condition, forbidden)
+			if err == nil {
+				err = checkDimensions(s.Dimensions, forbidden)
+			}
+			if err == nil {
+				err = checkGroupBy(s.Dimensions, prof.groupByAllowlists(s.Sources))
+			}
+		case *influxql.ShowTagValuesStatement:
+			err = checkCondition(s.Condition, prof.forbiddenTags(s.Sources))
+		}
+	})
+	return err
+}
+
+// forbiddenTags returns the tags forbidden for any of the measurements of
+// sources.
+func (prof *profile) forbiddenTags(sources influxql.Sources) map[string]bool {
+	var forbidden map[string]bool
+	for _, m := range sources.Measurements() {
+		for _, tag := range prof.measurements[prof.key(m.Name)].ForbiddenTags {
+			if forbidden == nil {
+				forbidden = make(map[string]bool)
+			}
+			forbidden[tag] = true
+		}
+	}
+	return forbidden
+}
+
+// groupByAllowlists returns the GROUP BY allowlists of the measurements of
+// sources which have one.
+func (prof *profile) groupByAllowlists(sources influxql.Sources) [][]string {
+	var lists [][]string
+	for _, m := range sources.Measurements() {
+		if list := prof.measurements[prof.key(m.Name)].GroupBy; list != nil {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// checkCondition returns an error if cond references a forbidden tag.
+func checkCondition(cond influxql.Expr, forbidden map[string]bool) error {
+	if len(forbidden) == 0 || cond == nil {
+		return nil
+	}
+
+	var err error
+	influxql.WalkFunc(cond, func(n influxql.Node) {
+		if ref, ok := n.(*influxql.VarRef); ok && err == nil && forbidden[ref.Val] {
+			err = fmt.Errorf("%w: %s", ErrForbiddenTag, ref.Val)
+		}
+	})
+	return err
+}
+
+// checkDimensions returns an error if the GROUP BY dimensions contain a
+// forbidden tag. Wildcards and regular expressions are rejected if any tag
+// is forbidden, as they may match one.
+func checkDimensions(dims influxql.Dimensions, forbidden map[string]bool) error {
+	if len(forbidden) == 0 {
+		return nil
+	}
+
+	for _, d := range dims {
+		switch e := d.Expr.(type) {
+		case *influxql.VarRef:
+			if forbidden[e.Val] {
+				return fmt.Errorf("%w: %s", ErrForbiddenTag, e.Val)
+			}
+		case *influxql.Wildcard, *influxql.RegexLiteral:
+			return fmt.Errorf("%w: %s", ErrForbiddenTag, e)
+		}
+	}
+	return nil
+}
+
+// checkGroupBy returns an error if the GROUP BY dimensions contain a tag
+// which is not in all allowlists. Grouping by time is always allowed,
+// wildcards and regular expressions are rejected if there is an allowlist.
+func checkGroupBy(dims influxql.Dimensions, allowlists [][]string) error {
+	if len(allowlists) == 0 {
+		return nil
+	}
+
+	for _, d := range dims {
+		switch e := d.Expr.(type) {
+		case *influxql.Call:
+			// time(), the only function allowed in GROUP BY.
+		case *influxql.VarRef:
+			for _, list := range allowlists {
+				if !lookup(list, e.Val) {
+					return fmt.Errorf("%w: %s", ErrGroupByNotAllowed, e.Val)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: %s", ErrGroupByNotAllowed, e)
+		}
+	}
+	return nil
+}
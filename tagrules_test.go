@@ -0,0 +1,82 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckTags(t *testing.T) {
+	prof := newProfile(Profile{Measurements: []Measurement{
+		{Name: "m1", ForbiddenTags: []string{"owner_email"}},
+		{Name: "m2"},
+		{Name: "m3", GroupBy: []string{"station", "sensor"}},
+		{Name: "m4", GroupBy: []string{"station"}},
+		{Name: "m5", GroupBy: []string{}},
+	}}, false)
+
+	testCases := map[string]struct {
+		q   string
+		err error
+	}{
+		"noTags":           {"SELECT * FROM m1", nil},
+		"allowedWhere":     {"SELECT * FROM m1 WHERE station = 's1'", nil},
+		"allowedGroupBy":   {"SELECT mean(v) FROM m1 GROUP BY time(1h), station", nil},
+		"where":            {"SELECT * FROM m1 WHERE owner_email = 'a@example.org'", ErrForbiddenTag},
+		"whereNested":      {"SELECT * FROM m1 WHERE time > now() - 1h AND (station = 's1' OR owner_email =~ /example/)", ErrForbiddenTag},
+		"whereTyped":       {"SELECT * FROM m1 WHERE owner_email::tag = 'x'", ErrForbiddenTag},
+		"groupBy":          {"SELECT mean(v) FROM m1 GROUP BY owner_email", ErrForbiddenTag},
+		"groupByWildcard":  {"SELECT mean(v) FROM m1 GROUP BY *", ErrForbiddenTag},
+		"groupByRegex":     {"SELECT mean(v) FROM m1 GROUP BY /owner/", ErrForbiddenTag},
+		"otherMeasurement": {"SELECT * FROM m2 WHERE owner_email = 'x' GROUP BY *", nil},
+		"multipleSources":  {"SELECT * FROM m2, m1 WHERE owner_email = 'x'", ErrForbiddenTag},
+		"subquery":         {"SELECT * FROM (SELECT * FROM m1 WHERE owner_email = 'x')", ErrForbiddenTag},
+		"outerOfSubquery":  {"SELECT count(v) FROM (SELECT * FROM m1) GROUP BY owner_email", ErrForbiddenTag},
+		"deepSubquery":     {"SELECT * FROM (SELECT * FROM (SELECT * FROM m1)) WHERE owner_email = 'x'", ErrForbiddenTag},
+		"secondStatement":  {"SELECT * FROM m2; SELECT * FROM m1 WHERE owner_email = 'x'", ErrForbiddenTag},
+		"showTagValues":    {"SHOW TAG VALUES FROM m1 WITH KEY = station WHERE owner_email = 'x'", ErrForbiddenTag},
+		"showTagValuesOK":  {"SHOW TAG VALUES FROM m1 WITH KEY = station", nil},
+		"groupByAllowed":   {"SELECT mean(v) FROM m3 GROUP BY time(1h), station, sensor", nil},
+		"groupByNotListed": {"SELECT mean(v) FROM m3 GROUP BY serial_number", ErrGroupByNotAllowed},
+		"groupByAllWild":   {"SELECT mean(v) FROM m3 GROUP BY *", ErrGroupByNotAllowed},
+		"groupByAllRegex":  {"SELECT mean(v) FROM m3 GROUP BY /station/", ErrGroupByNotAllowed},
+		"groupByTimeOnly":  {"SELECT mean(v) FROM m5 GROUP BY time(1h)", nil},
+		"groupByEmptyList": {"SELECT mean(v) FROM m5 GROUP BY station", ErrGroupByNotAllowed},
+		"groupByUnlisted":  {"SELECT mean(v) FROM m2 GROUP BY serial_number", nil},
+		"groupByBoth":      {"SELECT mean(v) FROM m3, m4 GROUP BY station", nil},
+		"groupByNotInAll":  {"SELECT mean(v) FROM m3, m4 GROUP BY sensor", ErrGroupByNotAllowed},
+		"groupBySubquery":  {"SELECT count(v) FROM (SELECT * FROM m3) GROUP BY serial_number", ErrGroupByNotAllowed},
+		"groupByInner":     {"SELECT max(c) FROM (SELECT count(v) AS c FROM m3 GROUP BY serial_number)", ErrGroupByNotAllowed},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := prof.checkTags(mustParseQuery(t, tc.q))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestForbiddenTagRejected(t *testing.T) {
+	captureLogs(t, "warn", "console")
+
+	cfg := &Config{Profile: Profile{Measurements: []Measurement{{Name: "m1", ForbiddenTags: []string{"owner_email"}}}}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM m1 WHERE owner_email = 'x'"), nil))
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "github.com/influxdata/influxql"
+
+// visibleTagValues returns the visible values of the tag keys of the given
+// measurements, as sets keyed by measurement key (see profile.key) and tag
+// key.
+func visibleTagValues(measurements []Measurement, key func(string) string) map[string]map[string]map[string]bool {
+	visible := make(map[string]map[string]map[string]bool)
+	for _, m := range measurements {
+		if len(m.TagValues) == 0 {
+			continue
+		}
+		keys := make(map[string]map[string]bool)
+		for tagKey, values := range m.TagValues {
+			set := make(map[string]bool)
+			for _, v := range values {
+				set[v] = true
+			}
+			keys[tagKey] = set
+		}
+		visible[key(m.Name)] = keys
+	}
+	return visible
+}
+
+// tagValueFilter returns a rewriteFunc removing the tag values which are not
+// visible in the profile from the results of the SHOW TAG VALUES statements
+// of q. It returns nil if no results need to be filtered.
+func (prof *profile) tagValueFilter(q *influxql.Query) rewriteFunc {
+	stmts := make(map[int]bool)
+	for i, stmt := range q.Statements {
+		s, ok := stmt.(*influxql.ShowTagValuesStatement)
+		if !ok {
+			continue
+		}
+		for _, m := range s.Sources.Measurements() {
+			if prof.tagValues[prof.key(m.Name)] != nil {
+				stmts[i] = true
+			}
+		}
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	return func(resps []*influxResponse) error {
+		for _, resp := range resps {
+			for i := range resp.Results {
+				res := &resp.Results[i]
+				if !stmts[res.StatementID] {
+					continue
+				}
+
+				series := res.Series[:0]
+				for _, s := range res.Series {
+					prof.filterTagValues(&s)
+					if len(s.Values) > 0 {
+						series = append(series, s)
+					}
+				}
+				res.Series = series
+			}
+		}
+		return nil
+	}
+}
+
+// filterTagValues removes the rows of a SHOW TAG VALUES series whose value is
+// not visible.
+func (prof *profile) filterTagValues(s *influxSeries) {
+	visible := prof.tagValues[prof.key(s.Name)]
+	if visible == nil {
+		return
+	}
+
+	keyCol, valueCol := -1, -1
+	for i, c := range s.Columns {
+		switch c {
+		case "key":
+			keyCol = i
+		case "value":
+			valueCol = i
+		}
+	}
+	if keyCol < 0 || valueCol < 0 {
+		return
+	}
+
+	rows := s.Values[:0]
+	for _, row := range s.Values {
+		if len(row) <= keyCol || len(row) <= valueCol {
+			continue
+		}
+		key, _ := row[keyCol].(string)
+		value, _ := row[valueCol].(string)
+		if values, ok := visible[key]; ok && !values[value] {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	s.Values = rows
+}
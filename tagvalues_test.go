@@ -0,0 +1,145 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const showTagValuesResponse = `{"results":[{"statement_id":0,"series":[` +
+	`{"name":"m1","columns":["key","value"],"values":[["station","s1"],["station","s2"],["station","s3"],["sensor","t1"]]},` +
+	`{"name":"m2","columns":["key","value"],"values":[["station","s9"]]}]}]}`
+
+func TestTagValueFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Accept") {
+		case "application/csv":
+			w.Header().Set("Content-Type", "application/csv")
+		case msgpackContentType:
+			resps, _ := decodeResponses([]byte(showTagValuesResponse))
+			b, _ := encodeMsgpackResponses(resps)
+			w.Header().Set("Content-Type", msgpackContentType)
+			w.Write(b)
+			return
+		}
+		io.WriteString(w, showTagValuesResponse)
+	}))
+	defer backend.Close()
+
+	cfg := &Config{
+		Profile: Profile{
+			Measurements: []Measurement{
+				{Name: "m1", TagValues: map[string][]string{"station": {"s1", "s3"}}},
+				{Name: "m2", TagValues: map[string][]string{"station": {"s1"}}},
+				{Name: "m3"},
+			},
+		},
+	}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache = newMemoryCache()
+	p.cacheTTL = time.Minute
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	const filtered = `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"m1","columns":["key","value"],"values":[["station","s1"],["station","s3"],["sensor","t1"]]}]}]}` + "\n"
+
+	testCases := map[string]struct {
+		query  string
+		params string
+		accept string
+		status int
+		want   string
+	}{
+		"filtered": {
+			query:  `SHOW TAG VALUES FROM m1, m2 WITH KEY IN ("station", "sensor")`,
+			status: http.StatusOK,
+			want:   filtered,
+		},
+		"pretty": {
+			query:  `SHOW TAG VALUES FROM m1, m2 WITH KEY IN ("station", "sensor")`,
+			params: "&pretty=true",
+			status: http.StatusOK,
+			want:   filtered,
+		},
+		"msgpack": {
+			query:  `SHOW TAG VALUES FROM m1, m2 WITH KEY IN ("station", "sensor")`,
+			accept: msgpackContentType,
+			status: http.StatusOK,
+			want:   filtered,
+		},
+		"unfiltered": {
+			query:  `SHOW TAG VALUES FROM m3 WITH KEY = "station"`,
+			status: http.StatusOK,
+			want:   showTagValuesResponse,
+		},
+		"select": {
+			query:  `SELECT * FROM m1`,
+			status: http.StatusOK,
+			want:   showTagValuesResponse,
+		},
+		"csv": {
+			query:  `SHOW TAG VALUES FROM m1 WITH KEY = "station"`,
+			accept: "application/csv",
+			status: http.StatusNotAcceptable,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// Twice to get the response from the cache.
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest("GET", ts.URL+"/query?q="+url.QueryEscape(tc.query)+tc.params, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.accept != "" {
+					req.Header.Set("Accept", tc.accept)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if resp.StatusCode != tc.status {
+					t.Fatalf("got %q, want %q", resp.Status, http.StatusText(tc.status))
+				}
+				switch {
+				case isMsgpack(resp.Header.Get("Content-Type")):
+					resps, err := decodeMsgpackResponses(body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					body, _ = encodeResponses(resps, false)
+				case tc.params == "&pretty=true":
+					if !bytes.Contains(body, []byte("\n    ")) {
+						t.Fatalf("got %s, want indented JSON", body)
+					}
+					var buf bytes.Buffer
+					json.Compact(&buf, body)
+					body = buf.Bytes()
+				}
+				if tc.want != "" && strings.TrimSpace(string(body)) != strings.TrimSpace(tc.want) {
+					t.Fatalf("got:\n%s\nwant:\n%s", body, tc.want)
+				}
+			}
+		})
+	}
+}
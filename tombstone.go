@@ -0,0 +1,69 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMeasurementDeprecated is returned if a query uses a measurement which
+// has been removed and replaced by a tombstone.
+var ErrMeasurementDeprecated = errors.New("measurement is deprecated")
+
+// tombstone is a configured tombstone with the name of its measurement.
+type tombstone struct {
+	measurement string
+	Tombstone
+}
+
+// newTombstones returns the tombstones by key of their measurement, or nil
+// if there are none.
+func newTombstones(tombstones map[string]Tombstone, key func(string) string) map[string]tombstone {
+	if len(tombstones) == 0 {
+		return nil
+	}
+	m := make(map[string]tombstone)
+	for name, t := range tombstones {
+		m[key(name)] = tombstone{measurement: name, Tombstone: t}
+	}
+	return m
+}
+
+// deprecatedError is the error of queries using a tombstoned measurement,
+// by the name the client used.
+type deprecatedError struct {
+	name string
+	tombstone
+}
+
+func (e *deprecatedError) Error() string {
+	s := fmt.Sprintf("measurement %q is deprecated", e.name)
+	if e.Replacement != "" {
+		s += fmt.Sprintf(", use %q instead", e.Replacement)
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+func (e *deprecatedError) Unwrap() error { return ErrMeasurementDeprecated }
+
+// checkTombstones returns an error explaining the deprecation of the first
+// tombstoned measurement queried by q. It is consulted before the query is
+// validated, so that clients get a hint instead of the generic error of
+// measurements which are not allowed.
+func (prof *profile) checkTombstones(q string) error {
+	if prof.tombstones == nil {
+		return nil
+	}
+	for _, name := range attemptedMeasurements(q) {
+		if t, ok := prof.tombstones[prof.key(name)]; ok {
+			return &deprecatedError{name: name, tombstone: t}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckTombstones(t *testing.T) {
+	prof := newProfile(Profile{
+		Measurements: []Measurement{{Name: "airtemp_hourly"}},
+		Tombstones: map[string]Tombstone{
+			"air_t":  {Replacement: "airtemp_hourly", Message: "removed in June 2020"},
+			"old_rh": {},
+		},
+	}, true)
+
+	testCases := map[string]struct {
+		query string
+		want  string // empty if not deprecated.
+	}{
+		"allowed":     {"SELECT * FROM airtemp_hourly", ""},
+		"replacement": {"SELECT * FROM air_t", `measurement "air_t" is deprecated, use "airtemp_hourly" instead: removed in June 2020`},
+		"plain":       {"SELECT * FROM old_rh", `measurement "old_rh" is deprecated`},
+		"folded":      {"SELECT * FROM AIR_T", `measurement "AIR_T" is deprecated, use "airtemp_hourly" instead: removed in June 2020`},
+		"subquery":    {"SELECT mean(v) FROM (SELECT * FROM old_rh)", `measurement "old_rh" is deprecated`},
+		"second":      {"SELECT * FROM airtemp_hourly; SELECT * FROM old_rh", `measurement "old_rh" is deprecated`},
+		"unparsable":  {"SELECT * FROM", ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := prof.checkTombstones(tc.query)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMeasurementDeprecated) || err.Error() != tc.want {
+				t.Fatalf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTombstoneRejected(t *testing.T) {
+	cfg := sourcesConfig("airtemp_hourly")
+	cfg.CaseInsensitive = true
+	cfg.Tombstones = map[string]Tombstone{"air_t": {Replacement: "airtemp_hourly"}}
+	p, err := NewProxy("http://localhost:8086", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := counterValue(deprecatedQueries, defaultProfileName, "air_t")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM air_t"), nil))
+	if w.Code != http.StatusGone {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusGone)
+	}
+	if want := `{"error":"measurement \"air_t\" is deprecated, use \"airtemp_hourly\" instead"}`; w.Body.String() != want {
+		t.Fatalf("got body %s, want %s", w.Body, want)
+	}
+	if got := counterValue(deprecatedQueries, defaultProfileName, "air_t") - before; got != 1 {
+		t.Fatalf("got %v deprecated queries, want 1", got)
+	}
+
+	// Other spellings are counted by the configured name.
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/query?q="+url.QueryEscape("SELECT * FROM AIR_T"), nil))
+	if got := counterValue(deprecatedQueries, defaultProfileName, "air_t") - before; got != 2 {
+		t.Fatalf("got %v deprecated queries, want 2", got)
+	}
+}
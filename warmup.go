@@ -0,0 +1,193 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxWarmupBody is the maximum size of a warm-up response which is checked
+// for errors. Larger responses are only checked by their status.
+const maxWarmupBody = 1 << 20
+
+type contextKey int
+
+const internalRequestKey contextKey = iota
+
+// internalRequest reports whether r was issued by the proxy itself and
+// returns the name of the issuing subsystem.
+func internalRequest(r *http.Request) (string, bool) {
+	name, ok := r.Context().Value(internalRequestKey).(string)
+	return name, ok
+}
+
+// warmupFailure is a failed warm-up query, as reported to the webhook.
+type warmupFailure struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+	Error   string `json:"error"`
+}
+
+// warmupProfile returns the profile of the warm-up query q or nil.
+func (pol *policy) warmupProfile(q WarmupQuery) *profile {
+	if q.Profile == "" {
+		return pol.defaultProfile
+	}
+	return pol.profile(q.Profile)
+}
+
+// runWarmups runs the warm-up queries of the current policy in their
+// interval. It never returns.
+func (p *Proxy) runWarmups() {
+	for {
+		w := p.policy().warmup
+		if w == nil {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(time.Duration(w.Interval))
+
+		// With HA only the leader warms the shared cache.
+		pol := p.policy()
+		if pol.warmup == nil || !p.ha.isLeader() {
+			continue
+		}
+		if failures := p.warmup(pol); len(failures) > 0 && pol.warmup.Webhook != "" {
+			if err := notifyWebhook(pol.warmup.Webhook, failures); err != nil {
+				proxyLog.Error("warmup webhook", "err", err)
+			}
+		}
+	}
+}
+
+// warmup runs the warm-up queries of pol once and returns the failed ones.
+func (p *Proxy) warmup(pol *policy) []warmupFailure {
+	var failures []warmupFailure
+	for _, q := range pol.warmup.Queries {
+		prof := pol.warmupProfile(q)
+		err := p.warmupQuery(prof, q)
+		if err != nil {
+			proxyLog.Warn("warmup query failed", "name", q.Name, "profile", prof.name, "err", err)
+			warmupQueries.Inc(q.Name, "failure")
+			failures = append(failures, warmupFailure{Name: q.Name, Profile: prof.name, Error: err.Error()})
+			continue
+		}
+		warmupQueries.Inc(q.Name, "success")
+		warmupLastSuccess.Set(float64(time.Now().Unix()), q.Name)
+	}
+	return failures
+}
+
+// warmupQuery runs q through the proxy as a client of prof would, so that
+// the response is cached.
+func (p *Proxy) warmupQuery(prof *profile, q WarmupQuery) error {
+	params := url.Values{"q": {q.Query}}
+	if q.DB != "" {
+		params.Set("db", q.DB)
+	}
+	ctx := context.WithValue(context.Background(), internalRequestKey, "warmup")
+	r, err := http.NewRequestWithContext(ctx, "GET", prof.prefix+"/query?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if len(prof.hosts) > 0 {
+		r.Host = prof.hosts[0]
+	}
+	for k, v := range q.Headers {
+		r.Header.Set(k, v)
+	}
+
+	w := &warmupWriter{header: make(http.Header)}
+	p.ServeHTTP(w, r)
+	return w.err()
+}
+
+// warmupWriter is a http.ResponseWriter checking the response of a warm-up
+// query.
+type warmupWriter struct {
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *warmupWriter) Header() http.Header { return w.header }
+
+func (w *warmupWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *warmupWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.truncated && w.body.Len()+len(b) <= maxWarmupBody {
+		w.body.Write(b)
+	} else {
+		w.truncated = true
+	}
+	return len(b), nil
+}
+
+func (w *warmupWriter) Flush() {}
+
+// err returns the error of the response, if any.
+func (w *warmupWriter) err() error {
+	if w.status != http.StatusOK && w.status != 0 {
+		return fmt.Errorf("status %d: %s", w.status, bytes.TrimSpace(w.body.Bytes()))
+	}
+	if w.truncated || w.header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	resps, err := decodeResponsesAs(w.header.Get("Content-Type"), w.body.Bytes())
+	if err != nil {
+		// Neither JSON nor MessagePack, e.g. CSV requested with an Accept
+		// header.
+		return nil
+	}
+	for _, resp := range resps {
+		if resp.Err != "" {
+			return errors.New(resp.Err)
+		}
+		for _, res := range resp.Results {
+			if res.Err != "" {
+				return fmt.Errorf("statement %d: %s", res.StatementID, res.Err)
+			}
+		}
+	}
+	return nil
+}
+
+// notifyWebhook posts the failures of a warm-up run as JSON to webhook.
+func notifyWebhook(webhook string, failures []warmupFailure) error {
+	b, err := json.Marshal(struct {
+		Time     time.Time       `json:"time"`
+		Failures []warmupFailure `json:"failures"`
+	}{time.Now().UTC(), failures})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Eurac Research. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWarmup(t *testing.T) {
+	captureLogs(t, "error", "console")
+
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Query().Get("q"), "broken") {
+			w.Write([]byte(`{"results":[{"statement_id":0,"error":"shard not found"}]}`))
+			return
+		}
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer backend.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Profiles: []Profile{{
+			Name:         "partner",
+			Prefix:       "/partner",
+			Measurements: []Measurement{{Name: "m"}, {Name: "broken"}},
+			Auth:         &Auth{Users: map[string]string{"alice": string(hash)}},
+		}},
+		Warmup: &Warmup{
+			Interval: duration(time.Hour),
+			Queries: []WarmupQuery{
+				{Name: "ok", Profile: "partner", DB: "db0", Query: "SELECT * FROM m"},
+				{Name: "broken", Profile: "partner", DB: "db0", Query: "SELECT * FROM broken"},
+			},
+		},
+	}
+	p, err := NewProxy(backend.URL, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache, p.cacheTTL = newMemoryCache(), time.Minute
+
+	failures := p.warmup(p.policy())
+	if len(failures) != 1 || failures[0].Name != "broken" || failures[0].Error != "statement 0: shard not found" {
+		t.Fatalf("got failures %+v, want broken", failures)
+	}
+
+	// The warm-up populated the cache for clients.
+	r := httptest.NewRequest("GET", "/partner/query?db=db0&q=SELECT+*+FROM+m", nil)
+	r.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if got := w.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("got X-Cache %q, want HIT", got)
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Fatalf("got %d backend requests, want 2", n)
+	}
+}
+
+func TestWarmupNotAllowed(t *testing.T) {
+	cfg := sourcesConfig("m")
+	cfg.Warmup = &Warmup{
+		Interval: duration(time.Hour),
+		Queries:  []WarmupQuery{{Name: "q", Query: "SELECT * FROM secret"}},
+	}
+	if _, err := NewProxy("http://localhost:8086", cfg); err == nil {
+		t.Fatal("expected error for warm-up query which is not allowed")
+	}
+
+	cfg.Warmup.Queries[0] = WarmupQuery{Name: "q", Profile: "missing", Query: "SELECT * FROM m"}
+	if _, err := NewProxy("http://localhost:8086", cfg); err == nil {
+		t.Fatal("expected error for unknown profile")
+	}
+}
+
+func TestNotifyWebhook(t *testing.T) {
+	var got struct {
+		Failures []warmupFailure
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	failures := []warmupFailure{{Name: "q", Profile: "default", Error: "status 502"}}
+	if err := notifyWebhook(srv.URL, failures); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Failures) != 1 || got.Failures[0] != failures[0] {
+		t.Fatalf("got %+v, want %+v", got.Failures, failures)
+	}
+}